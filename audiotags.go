@@ -0,0 +1,869 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAudioTagSize bounds how much of a file is read for one tag block, so
+// a corrupt length cannot make the indexer allocate gigabytes.
+const maxAudioTagSize = 16 << 20
+
+var errNoAudioTags = errors.New("no audio tags")
+
+// audioTags is the metadata embedded in an audio file.
+type audioTags struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Year        int
+	Date        time.Time // Full release date, when the tag has more than the year
+	Track       int
+	Disc        int
+	Duration    time.Duration
+	HasCover    bool
+	Cover       []byte // Only filled in when requested
+	CoverType   string // MIME type of Cover
+}
+
+// readAudioTags reads ID3v2 (MP3), Vorbis comments (FLAC, Ogg Vorbis and
+// Opus), MP4 atoms (M4A) and RIFF INFO (WAV) tags. The cover art is only
+// kept when withCover is set.
+func readAudioTags(fullPath string, withCover bool) (*audioTags, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tags := &audioTags{}
+	switch strings.ToLower(filepath.Ext(fullPath)) {
+	case ".flac":
+		err = readFLACTags(file, tags, withCover)
+	case ".ogg", ".oga", ".opus":
+		err = readOggTags(file, info.Size(), tags, withCover)
+	case ".m4a", ".m4b", ".mp4", ".m4v":
+		err = readMP4Tags(file, info.Size(), tags, withCover)
+	case ".wav":
+		err = readWAVTags(file, tags)
+	default:
+		err = readMP3Tags(file, info.Size(), tags, withCover)
+	}
+	return tags, err
+}
+
+// setCover records a picture, keeping its data only when wanted.
+func (t *audioTags) setCover(mimeType string, data []byte, withCover bool) {
+	if t.HasCover || len(data) == 0 {
+		return
+	}
+	t.HasCover = true
+	if withCover {
+		t.Cover = data
+		t.CoverType = mimeType
+	}
+}
+
+// setNumber parses values like "3" or "3/12".
+func setNumber(dest *int, value string) {
+	value, _, _ = strings.Cut(strings.TrimSpace(value), "/")
+	if n, err := strconv.Atoi(value); err == nil {
+		*dest = n
+	}
+}
+
+// setYear takes the year from a date such as "2019" or "2019-05-01".
+func setYear(dest *int, value string) {
+	value = strings.TrimSpace(value)
+	if len(value) >= 4 {
+		if n, err := strconv.Atoi(value[:4]); err == nil {
+			*dest = n
+		}
+	}
+}
+
+// dateLayouts are the full dates found in tags, most precise first.
+var dateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02"}
+
+// setDate takes the year and, when it is complete, the date from a tag
+// such as "2019", "2019-05-01" or "2019-05-01T18:30:00Z".
+func (t *audioTags) setDate(value string) {
+	setYear(&t.Year, value)
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			t.Date = date
+			return
+		}
+	}
+}
+
+// readBlock reads n bytes, refusing sizes above maxAudioTagSize.
+func readBlock(r io.Reader, n int64) ([]byte, error) {
+	if n < 0 || n > maxAudioTagSize {
+		return nil, errors.New("tag block too large")
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// --- ID3v2 and MPEG audio ---
+
+func syncsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 | int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+// removeUnsync undoes ID3 unsynchronisation (0xFF 0x00 -> 0xFF).
+func removeUnsync(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// decodeID3Text decodes a text frame value. Multiple values are joined.
+func decodeID3Text(encoding byte, data []byte) string {
+	var text string
+	switch encoding {
+	case 0:
+		text = decodeText(data, encodingLatin1)
+	case 1:
+		switch {
+		case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+			text = decodeText(data[2:], encodingUTF16BE)
+		case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+			text = decodeText(data[2:], encodingUTF16LE)
+		default:
+			text = decodeText(data, encodingUTF16LE)
+		}
+		// Each value of a v2.4 list carries its own byte order mark.
+		text = strings.ReplaceAll(text, "\x00\ufeff", "\x00")
+	case 2:
+		text = decodeText(data, encodingUTF16BE)
+	default:
+		text = string(data)
+	}
+	var values []string
+	for _, value := range strings.Split(text, "\x00") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return strings.Join(values, "; ")
+}
+
+// id3Genre resolves numeric ID3v1 style genres such as "(17)" or "17".
+func id3Genre(value string) string {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(value, "("), ")")
+	if n, err := strconv.Atoi(trimmed); err == nil && n >= 0 && n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return value
+}
+
+// id3v1Genres are the genres of the original ID3v1 list.
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychedelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// readID3v2 parses an ID3v2 tag at the start of r and returns the offset
+// of the data following it, or errNoAudioTags when there is none.
+func readID3v2(r io.ReadSeeker, tags *audioTags, withCover bool) (int64, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:3]) != "ID3" {
+		return 0, errNoAudioTags
+	}
+	major, flags, size := header[3], header[5], syncsafe(header[6:10])
+	end := 10 + size
+	if flags&0x10 != 0 {
+		end += 10 // footer
+	}
+	if size > maxAudioTagSize {
+		return end, nil
+	}
+	data, err := readBlock(r, size)
+	if err != nil {
+		return end, err
+	}
+	if major <= 3 && flags&0x80 != 0 {
+		data = removeUnsync(data)
+	}
+	pos := 0
+	if flags&0x40 != 0 && len(data) >= 4 {
+		switch major {
+		case 3:
+			pos = 4 + int(binary.BigEndian.Uint32(data))
+		case 4:
+			pos = int(syncsafe(data))
+		}
+	}
+
+	idLen, headerLen := 4, 10
+	if major == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for pos >= 0 && pos+headerLen <= len(data) {
+		id := string(data[pos : pos+idLen])
+		if id[0] == 0 {
+			break // padding
+		}
+		var frameSize int
+		var frameFlags byte
+		switch major {
+		case 2:
+			frameSize = int(data[pos+3])<<16 | int(data[pos+4])<<8 | int(data[pos+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(data[pos+4:]))
+			frameFlags = data[pos+9]
+		default:
+			frameSize = int(syncsafe(data[pos+4:]))
+			frameFlags = data[pos+9]
+		}
+		start := pos + headerLen
+		if frameSize < 0 || start+frameSize > len(data) {
+			break
+		}
+		frame := data[start : start+frameSize]
+		pos = start + frameSize
+
+		switch major {
+		case 3:
+			if frameFlags&0xC0 != 0 {
+				continue // compressed or encrypted
+			}
+			if frameFlags&0x20 != 0 && len(frame) > 0 {
+				frame = frame[1:]
+			}
+		case 4:
+			if frameFlags&0x0C != 0 {
+				continue
+			}
+			if frameFlags&0x40 != 0 && len(frame) > 0 {
+				frame = frame[1:]
+			}
+			if frameFlags&0x01 != 0 && len(frame) >= 4 {
+				frame = frame[4:]
+			}
+			if frameFlags&0x02 != 0 {
+				frame = removeUnsync(frame)
+			}
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		tags.applyID3Frame(id, frame, withCover)
+	}
+	return end, nil
+}
+
+func (t *audioTags) applyID3Frame(id string, frame []byte, withCover bool) {
+	if id == "APIC" || id == "PIC" {
+		t.applyID3Picture(id, frame, withCover)
+		return
+	}
+	if id[0] != 'T' {
+		return
+	}
+	value := decodeID3Text(frame[0], frame[1:])
+	switch id {
+	case "TIT2", "TT2":
+		t.Title = value
+	case "TPE1", "TP1":
+		t.Artist = value
+	case "TALB", "TAL":
+		t.Album = value
+	case "TPE2", "TP2":
+		t.AlbumArtist = value
+	case "TCON", "TCO":
+		t.Genre = id3Genre(value)
+	case "TRCK", "TRK":
+		setNumber(&t.Track, value)
+	case "TPOS", "TPA":
+		setNumber(&t.Disc, value)
+	case "TYER", "TYE", "TDRC":
+		t.setDate(value)
+	case "TLEN", "TLE":
+		if ms, err := strconv.Atoi(value); err == nil && t.Duration == 0 {
+			t.Duration = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+// applyID3Picture reads an APIC (v2.3+) or PIC (v2.2) frame.
+func (t *audioTags) applyID3Picture(id string, frame []byte, withCover bool) {
+	encoding, rest := frame[0], frame[1:]
+	var mimeType string
+	if id == "PIC" {
+		if len(rest) < 4 {
+			return
+		}
+		mimeType = "image/" + strings.ToLower(string(rest[:3]))
+		if mimeType == "image/jpg" {
+			mimeType = "image/jpeg"
+		}
+		rest = rest[3:]
+	} else {
+		var ok bool
+		var mimeBytes []byte
+		mimeBytes, rest, ok = bytes.Cut(rest, []byte{0})
+		if !ok {
+			return
+		}
+		mimeType = string(mimeBytes)
+	}
+	if len(rest) < 1 {
+		return
+	}
+	rest = rest[1:] // picture type
+	// Skip the description, terminated by one or two zero bytes.
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(rest); i += 2 {
+			if rest[i] == 0 && rest[i+1] == 0 {
+				t.setCover(mimeType, rest[i+2:], withCover)
+				return
+			}
+		}
+		return
+	}
+	if _, data, ok := bytes.Cut(rest, []byte{0}); ok {
+		t.setCover(mimeType, data, withCover)
+	}
+}
+
+// readID3v1 reads the 128 byte tag at the end of older MP3 files.
+func readID3v1(r io.ReadSeeker, size int64, tags *audioTags) {
+	if size < 128 {
+		return
+	}
+	tag := make([]byte, 128)
+	if _, err := r.Seek(size-128, io.SeekStart); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(r, tag); err != nil || string(tag[:3]) != "TAG" {
+		return
+	}
+	field := func(b []byte) string {
+		b, _, _ = bytes.Cut(b, []byte{0})
+		return strings.TrimSpace(decodeText(b, encodingLatin1))
+	}
+	tags.Title = field(tag[3:33])
+	tags.Artist = field(tag[33:63])
+	tags.Album = field(tag[63:93])
+	setYear(&tags.Year, field(tag[93:97]))
+	if tag[125] == 0 && tag[126] != 0 {
+		tags.Track = int(tag[126])
+	}
+	if int(tag[127]) < len(id3v1Genres) {
+		tags.Genre = id3v1Genres[tag[127]]
+	}
+}
+
+// MPEG audio bitrates in kbit/s for MPEG-1 and MPEG-2 layer III.
+var (
+	mpeg1Bitrates = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mpeg2Bitrates = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mpegRates     = [3]int{44100, 48000, 32000}
+)
+
+func readMP3Tags(r io.ReadSeeker, size int64, tags *audioTags, withCover bool) error {
+	audioStart, err := readID3v2(r, tags, withCover)
+	if err == errNoAudioTags {
+		readID3v1(r, size, tags)
+		audioStart = 0
+	} else if err != nil {
+		return err
+	}
+	if tags.Duration == 0 {
+		tags.Duration = mp3Duration(r, audioStart, size)
+	}
+	return nil
+}
+
+// mp3Duration reads the first MPEG frame, using its Xing/Info header for
+// VBR files and the bitrate otherwise.
+func mp3Duration(r io.ReadSeeker, start, size int64) time.Duration {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return 0
+	}
+	buf := make([]byte, 64<<10)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		version := (buf[i+1] >> 3) & 3 // 3 = MPEG-1, 2 = MPEG-2, 0 = MPEG-2.5
+		layer := (buf[i+1] >> 1) & 3   // 1 = layer III
+		bitrateIndex := buf[i+2] >> 4
+		rateIndex := (buf[i+2] >> 2) & 3
+		if version == 1 || layer != 1 || rateIndex == 3 || bitrateIndex == 0 || bitrateIndex == 15 {
+			continue
+		}
+		sampleRate := mpegRates[rateIndex]
+		bitrate := mpeg1Bitrates[bitrateIndex]
+		samplesPerFrame := 1152
+		sideInfo := 32
+		if buf[i+3]>>6 == 3 {
+			sideInfo = 17 // mono
+		}
+		if version != 3 {
+			sampleRate /= 2
+			if version == 0 {
+				sampleRate /= 2
+			}
+			bitrate = mpeg2Bitrates[bitrateIndex]
+			samplesPerFrame = 576
+			sideInfo = 17
+			if buf[i+3]>>6 == 3 {
+				sideInfo = 9
+			}
+		}
+		xing := i + 4 + sideInfo
+		if xing+12 <= len(buf) {
+			id := string(buf[xing : xing+4])
+			if (id == "Xing" || id == "Info") && buf[xing+7]&1 != 0 {
+				frames := binary.BigEndian.Uint32(buf[xing+8:])
+				return time.Duration(float64(frames) * float64(samplesPerFrame) / float64(sampleRate) * float64(time.Second))
+			}
+		}
+		audioBytes := size - start - int64(i)
+		return time.Duration(float64(audioBytes) * 8 / float64(bitrate*1000) * float64(time.Second))
+	}
+	return 0
+}
+
+// --- Vorbis comments (FLAC, Ogg) ---
+
+// applyVorbisComments parses a Vorbis comment block (without the
+// packet type prefix of Ogg streams).
+func (t *audioTags) applyVorbisComments(data []byte, withCover bool) {
+	if len(data) < 4 {
+		return
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(data))
+	pos := 4 + vendorLen
+	if pos+4 > len(data) || pos < 0 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	for i := 0; i < count && pos+4 <= len(data); i++ {
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(data) {
+			return
+		}
+		key, value, ok := strings.Cut(string(data[pos:pos+length]), "=")
+		pos += length
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			t.Title = value
+		case "ARTIST":
+			t.Artist = value
+		case "ALBUM":
+			t.Album = value
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			t.AlbumArtist = value
+		case "GENRE":
+			t.Genre = value
+		case "TRACKNUMBER":
+			setNumber(&t.Track, value)
+		case "DISCNUMBER":
+			setNumber(&t.Disc, value)
+		case "DATE", "YEAR":
+			t.setDate(value)
+		case "METADATA_BLOCK_PICTURE":
+			if picture, err := base64.StdEncoding.DecodeString(value); err == nil {
+				t.applyFLACPicture(picture, withCover)
+			}
+		}
+	}
+}
+
+// applyFLACPicture parses a FLAC PICTURE metadata block.
+func (t *audioTags) applyFLACPicture(data []byte, withCover bool) {
+	pos := 4 // picture type
+	field := func() []byte {
+		if pos+4 > len(data) {
+			pos = len(data) + 1
+			return nil
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(data) {
+			pos = len(data) + 1
+			return nil
+		}
+		value := data[pos : pos+length]
+		pos += length
+		return value
+	}
+	mimeType := string(field())
+	field()   // description
+	pos += 16 // width, height, depth and colour count
+	picture := field()
+	if pos <= len(data) {
+		t.setCover(mimeType, picture, withCover)
+	}
+}
+
+func readFLACTags(r io.ReadSeeker, tags *audioTags, withCover bool) error {
+	// Some taggers put an ID3v2 tag in front of the stream.
+	start, err := readID3v2(r, tags, withCover)
+	if err != nil && err != errNoAudioTags {
+		return err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return errNoAudioTags
+	}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		last, blockType := header[0]&0x80 != 0, header[0]&0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		switch {
+		case blockType == 0 || blockType == 4 || (blockType == 6 && !tags.HasCover):
+			block, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			switch blockType {
+			case 0: // STREAMINFO
+				if len(block) >= 18 {
+					sampleRate := int64(block[10])<<12 | int64(block[11])<<4 | int64(block[12])>>4
+					samples := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:]))
+					if sampleRate > 0 {
+						tags.Duration = time.Duration(samples * int64(time.Second) / sampleRate)
+					}
+				}
+			case 4:
+				tags.applyVorbisComments(block, withCover)
+			case 6:
+				tags.applyFLACPicture(block, withCover)
+			}
+		default:
+			if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// readOggTags reads the identification and comment packets of an Ogg
+// Vorbis or Opus stream, and the duration from the last page's granule
+// position.
+func readOggTags(r io.ReadSeeker, size int64, tags *audioTags, withCover bool) error {
+	var packets [][]byte
+	var packet []byte
+	header := make([]byte, 27)
+	for len(packets) < 2 {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		if string(header[:4]) != "OggS" {
+			return errNoAudioTags
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			data, err := readBlock(r, int64(segment))
+			if err != nil {
+				return err
+			}
+			if len(packet)+len(data) > maxAudioTagSize {
+				return errors.New("ogg packet too large")
+			}
+			packet = append(packet, data...)
+			if segment < 255 {
+				packets = append(packets, packet)
+				packet = nil
+				if len(packets) == 2 {
+					break
+				}
+			}
+		}
+	}
+
+	var sampleRate, preSkip int64
+	ident, comments := packets[0], packets[1]
+	switch {
+	case bytes.HasPrefix(ident, []byte("\x01vorbis")) && len(ident) >= 16:
+		sampleRate = int64(binary.LittleEndian.Uint32(ident[12:]))
+		if bytes.HasPrefix(comments, []byte("\x03vorbis")) {
+			tags.applyVorbisComments(comments[7:], withCover)
+		}
+	case bytes.HasPrefix(ident, []byte("OpusHead")) && len(ident) >= 12:
+		sampleRate = 48000
+		preSkip = int64(binary.LittleEndian.Uint16(ident[10:]))
+		if bytes.HasPrefix(comments, []byte("OpusTags")) {
+			tags.applyVorbisComments(comments[8:], withCover)
+		}
+	default:
+		return errNoAudioTags
+	}
+
+	// The granule position of the last page is the stream length in samples.
+	tailSize := min(size, 64<<10)
+	if _, err := r.Seek(size-tailSize, io.SeekStart); err != nil {
+		return nil
+	}
+	tail := make([]byte, tailSize)
+	if _, err := io.ReadFull(r, tail); err != nil {
+		return nil
+	}
+	if i := bytes.LastIndex(tail, []byte("OggS")); i >= 0 && i+14 <= len(tail) && sampleRate > 0 {
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6:]))
+		if granule > preSkip {
+			tags.Duration = time.Duration((granule - preSkip) * int64(time.Second) / sampleRate)
+		}
+	}
+	return nil
+}
+
+// --- MP4 ---
+
+// mp4Atom walks the child atoms of data, calling fn with each type and body.
+func mp4Atoms(data []byte, fn func(kind string, body []byte)) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		headerLen := 8
+		if size == 1 && len(data) >= 16 {
+			size = int(binary.BigEndian.Uint64(data[8:]))
+			headerLen = 16
+		} else if size == 0 {
+			size = len(data)
+		}
+		if size < headerLen || size > len(data) {
+			return
+		}
+		fn(string(data[4:8]), data[headerLen:size])
+		data = data[size:]
+	}
+}
+
+func readMP4Tags(r io.ReadSeeker, size int64, tags *audioTags, withCover bool) error {
+	// Find moov among the top level atoms, skipping the media data.
+	var moov []byte
+	header := make([]byte, 16)
+	for offset := int64(0); offset+8 <= size; {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return err
+		}
+		atomSize := int64(binary.BigEndian.Uint32(header))
+		headerLen := int64(8)
+		if atomSize == 1 {
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return err
+			}
+			atomSize = int64(binary.BigEndian.Uint64(header[8:]))
+			headerLen = 16
+		} else if atomSize == 0 {
+			atomSize = size - offset
+		}
+		if atomSize < headerLen {
+			return errNoAudioTags
+		}
+		if string(header[4:8]) == "moov" {
+			var err error
+			if moov, err = readBlock(r, atomSize-headerLen); err != nil {
+				return err
+			}
+			break
+		}
+		offset += atomSize
+	}
+	if moov == nil {
+		return errNoAudioTags
+	}
+
+	mp4Atoms(moov, func(kind string, body []byte) {
+		switch kind {
+		case "mvhd":
+			tags.Duration = mp4Duration(body)
+		case "udta":
+			mp4Atoms(body, func(kind string, body []byte) {
+				if kind != "meta" {
+					return
+				}
+				// meta is a full atom in MP4 but not in QuickTime files.
+				if len(body) >= 8 && string(body[4:8]) != "hdlr" {
+					body = body[4:]
+				}
+				mp4Atoms(body, func(kind string, body []byte) {
+					if kind == "ilst" {
+						mp4Atoms(body, func(kind string, body []byte) {
+							tags.applyMP4Item(kind, body, withCover)
+						})
+					}
+				})
+			})
+		}
+	})
+	return nil
+}
+
+// mp4Duration reads the duration of a movie header atom.
+func mp4Duration(body []byte) time.Duration {
+	if len(body) < 20 {
+		return 0
+	}
+	var timescale, duration uint64
+	if body[0] == 1 {
+		if len(body) < 32 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(body[20:]))
+		duration = binary.BigEndian.Uint64(body[24:])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(body[12:]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return time.Duration(duration * uint64(time.Second) / timescale)
+}
+
+// applyMP4Item reads one ilst entry through its data atom.
+func (t *audioTags) applyMP4Item(kind string, body []byte, withCover bool) {
+	mp4Atoms(body, func(child string, data []byte) {
+		if child != "data" || len(data) < 8 {
+			return
+		}
+		dataType, value := binary.BigEndian.Uint32(data)&0xffffff, data[8:]
+		text := string(value)
+		switch kind {
+		case "\xa9nam":
+			t.Title = text
+		case "\xa9ART":
+			t.Artist = text
+		case "\xa9alb":
+			t.Album = text
+		case "aART":
+			t.AlbumArtist = text
+		case "\xa9gen":
+			t.Genre = text
+		case "gnre":
+			if len(value) >= 2 {
+				t.Genre = id3Genre(strconv.Itoa(int(binary.BigEndian.Uint16(value)) - 1))
+			}
+		case "\xa9day":
+			t.setDate(text)
+		case "trkn":
+			if len(value) >= 4 {
+				t.Track = int(binary.BigEndian.Uint16(value[2:]))
+			}
+		case "disk":
+			if len(value) >= 4 {
+				t.Disc = int(binary.BigEndian.Uint16(value[2:]))
+			}
+		case "covr":
+			mimeType := "image/jpeg"
+			if dataType == 14 {
+				mimeType = "image/png"
+			}
+			t.setCover(mimeType, value, withCover)
+		}
+	})
+}
+
+// --- WAV ---
+
+// readWAVTags reads the duration from the fmt and data chunks and the tags
+// of a LIST INFO chunk.
+func readWAVTags(r io.ReadSeeker, tags *audioTags) error {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return errNoAudioTags
+	}
+	var byteRate int64
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil
+		}
+		id, length := string(chunk[:4]), int64(binary.LittleEndian.Uint32(chunk[4:]))
+		next := length + length%2
+		switch id {
+		case "fmt ", "LIST":
+			body, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if id == "fmt " && len(body) >= 12 {
+				byteRate = int64(binary.LittleEndian.Uint32(body[8:]))
+			} else if id == "LIST" && bytes.HasPrefix(body, []byte("INFO")) {
+				tags.applyRIFFInfo(body[4:])
+			}
+			next -= length
+		case "data":
+			if byteRate > 0 {
+				tags.Duration = time.Duration(length * int64(time.Second) / byteRate)
+			}
+		}
+		if _, err := r.Seek(next, io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
+
+func (t *audioTags) applyRIFFInfo(data []byte) {
+	for len(data) >= 8 {
+		id, length := string(data[:4]), int(binary.LittleEndian.Uint32(data[4:]))
+		if length < 0 || 8+length > len(data) {
+			return
+		}
+		value, _, _ := bytes.Cut(data[8:8+length], []byte{0})
+		text := strings.TrimSpace(string(value))
+		switch id {
+		case "INAM":
+			t.Title = text
+		case "IART":
+			t.Artist = text
+		case "IPRD":
+			t.Album = text
+		case "IGNR":
+			t.Genre = text
+		case "ITRK", "IPRT":
+			setNumber(&t.Track, text)
+		case "ICRD":
+			t.setDate(text)
+		}
+		data = data[min(8+length+length%2, len(data)):]
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// testCover stands in for a picture; the parsers don't decode it.
+var testCover = []byte("\x89PNG\r\n\x1a\ncover")
+
+// --- ID3 ---
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+func id3Tag(major, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	return append(append([]byte{'I', 'D', '3', major, 0, flags}, syncsafeBytes(len(body))...), body...)
+}
+
+func id3Frame(major byte, id string, flags byte, payload []byte) []byte {
+	frame := []byte(id)
+	switch major {
+	case 2:
+		frame = append(frame, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	case 3:
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+		frame = append(frame, 0, flags)
+	default:
+		frame = append(frame, syncsafeBytes(len(payload))...)
+		frame = append(frame, 0, flags)
+	}
+	return append(frame, payload...)
+}
+
+// utf16Text encodes s as UTF-16 with a byte order mark.
+func utf16Text(s string, order binary.AppendByteOrder) []byte {
+	var b []byte
+	for _, u := range append([]uint16{0xFEFF}, utf16.Encode([]rune(s))...) {
+		b = order.AppendUint16(b, u)
+	}
+	return b
+}
+
+func id3Text(encoding byte, text []byte) []byte {
+	return append([]byte{encoding}, text...)
+}
+
+// mpegFrameHeader is an MPEG-1 layer III frame header of 128 kbit/s at
+// 48 kHz, stereo.
+var mpegFrameHeader = []byte{0xFF, 0xFB, 0x94, 0x00}
+
+// xingFrame is a first frame whose Xing header counts 125 frames, which
+// are 3 seconds at 1152 samples each.
+func xingFrame() []byte {
+	frame := append(bytes.Clone(mpegFrameHeader), make([]byte, 32)...)
+	frame = append(frame, "Xing\x00\x00\x00\x01"...)
+	frame = binary.BigEndian.AppendUint32(frame, 125)
+	return append(frame, make([]byte, 400)...)
+}
+
+func id3v1Tag(title, artist, album, year string, track, genre byte) []byte {
+	field := func(s string, n int) []byte {
+		return append([]byte(s), make([]byte, n-len(s))...)
+	}
+	tag := []byte("TAG")
+	tag = append(tag, field(title, 30)...)
+	tag = append(tag, field(artist, 30)...)
+	tag = append(tag, field(album, 30)...)
+	tag = append(tag, field(year, 4)...)
+	tag = append(tag, make([]byte, 28)...)
+	return append(tag, 0, track, genre)
+}
+
+// --- FLAC and Vorbis comments ---
+
+func flacBlock(last bool, blockType byte, body []byte) []byte {
+	if last {
+		blockType |= 0x80
+	}
+	return append([]byte{blockType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// flacStreamInfo is a STREAMINFO block body of a 16 bit stereo stream.
+func flacStreamInfo(sampleRate int, samples int64) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate<<4) | 1<<1 // Two channels
+	info[13] = 15<<4 | byte(samples>>32)  // 16 bits per sample
+	binary.BigEndian.PutUint32(info[14:], uint32(samples))
+	return info
+}
+
+func vorbisComments(comments ...string) []byte {
+	vendor := "reference libFLAC 1.3.2 20170101"
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(vendor)))
+	data = append(data, vendor...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(comments)))
+	for _, comment := range comments {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(comment)))
+		data = append(data, comment...)
+	}
+	return data
+}
+
+func flacPicture(mimeType string, data []byte) []byte {
+	picture := binary.BigEndian.AppendUint32(nil, 3) // Front cover
+	picture = binary.BigEndian.AppendUint32(picture, uint32(len(mimeType)))
+	picture = append(picture, mimeType...)
+	picture = binary.BigEndian.AppendUint32(picture, 5)
+	picture = append(picture, "Front"...)
+	picture = append(picture, make([]byte, 16)...)
+	picture = binary.BigEndian.AppendUint32(picture, uint32(len(data)))
+	return append(picture, data...)
+}
+
+// --- MP4 ---
+
+func mp4Atom(kind string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(body))), kind...), body...)
+}
+
+func mp4Data(dataType uint32, value []byte) []byte {
+	return mp4Atom("data", binary.BigEndian.AppendUint32(nil, dataType), make([]byte, 4), value)
+}
+
+// mp4MovieHeader is a version 0 mvhd body.
+func mp4MovieHeader(timescale, duration uint32) []byte {
+	body := make([]byte, 100)
+	binary.BigEndian.PutUint32(body[12:], timescale)
+	binary.BigEndian.PutUint32(body[16:], duration)
+	return body
+}
+
+func mp4Items() []byte {
+	return mp4Atom("ilst",
+		mp4Atom("\xa9nam", mp4Data(1, []byte("Title"))),
+		mp4Atom("\xa9ART", mp4Data(1, []byte("Artist"))),
+		mp4Atom("\xa9alb", mp4Data(1, []byte("Album"))),
+		mp4Atom("aART", mp4Data(1, []byte("Album Artist"))),
+		mp4Atom("gnre", mp4Data(0, []byte{0, 18})),
+		mp4Atom("\xa9day", mp4Data(1, []byte("2015-06-30T07:00:00Z"))),
+		mp4Atom("trkn", mp4Data(0, []byte{0, 0, 0, 3, 0, 12, 0, 0})),
+		mp4Atom("disk", mp4Data(0, []byte{0, 0, 0, 2, 0, 2})),
+		mp4Atom("covr", mp4Data(14, testCover)),
+	)
+}
+
+func m4aFile(moov []byte) []byte {
+	return joinBytes(
+		mp4Atom("ftyp", []byte("M4A \x00\x00\x02\x00isomiso2")),
+		mp4Atom("mdat", make([]byte, 1000)),
+		moov,
+	)
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	fullPath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fullPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fullPath
+}
+
+func TestReadAudioTags(t *testing.T) {
+	silence := make([]byte, 32000) // Two seconds at 128 kbit/s, frame header included
+	tests := []struct {
+		name string
+		file string
+		data []byte
+		want audioTags
+	}{
+		{
+			name: "ID3v2.3",
+			file: "a.mp3",
+			data: joinBytes(id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0, id3Text(0, []byte("Caf\xe9"))),
+				id3Frame(3, "TPE1", 0, id3Text(1, utf16Text("Björk", binary.LittleEndian))),
+				id3Frame(3, "TALB", 0, id3Text(1, utf16Text("Début", binary.BigEndian))),
+				id3Frame(3, "TPE2", 0, id3Text(0, []byte("Various\x00"))),
+				id3Frame(3, "TCON", 0, id3Text(0, []byte("(17)"))),
+				id3Frame(3, "TRCK", 0, id3Text(0, []byte("3/12"))),
+				id3Frame(3, "TPOS", 0, id3Text(0, []byte("1/2"))),
+				id3Frame(3, "TYER", 0, id3Text(0, []byte("1993"))),
+				id3Frame(3, "TLEN", 0, id3Text(0, []byte("215000"))),
+				id3Frame(3, "COMM", 0, []byte("\x00engignored")),
+				id3Frame(3, "APIC", 0, joinBytes([]byte("\x00image/png\x00\x03Front\x00"), testCover)),
+				make([]byte, 64), // Padding
+			), mpegFrameHeader, silence[4:]),
+			want: audioTags{
+				Title: "Café", Artist: "Björk", Album: "Début", AlbumArtist: "Various", Genre: "Rock",
+				Year: 1993, Track: 3, Disc: 1, Duration: 215 * time.Second,
+				HasCover: true, Cover: testCover, CoverType: "image/png",
+			},
+		},
+		{
+			name: "ID3v2.4",
+			file: "a.mp3",
+			data: joinBytes(id3Tag(4, 0,
+				id3Frame(4, "TIT2", 0, id3Text(3, []byte("Title\x00Subtitle"))),
+				id3Frame(4, "TPE1", 0, id3Text(1, joinBytes(utf16Text("One", binary.LittleEndian), []byte{0, 0}, utf16Text("Two", binary.LittleEndian)))),
+				id3Frame(4, "TALB", 0, id3Text(2, []byte("\x00A\x00l\x00b\x00u\x00m"))),
+				id3Frame(4, "TCON", 0, id3Text(3, []byte("Synthwave"))),
+				id3Frame(4, "TDRC", 0, id3Text(3, []byte("2019-05-01T18:30:00"))),
+				// With a data length indicator.
+				id3Frame(4, "TRCK", 0x01, joinBytes(syncsafeBytes(3), id3Text(3, []byte("07")))),
+				// Unsynchronised: the 0x00 after the 0xFF is dropped.
+				id3Frame(4, "APIC", 0x02, joinBytes([]byte("\x01image/jpeg\x00\x03\xff\xfeF\x00\x00\x00"), []byte{0xFF, 0x00, 0xD8})),
+			), mpegFrameHeader, silence[4:]),
+			want: audioTags{
+				Title: "Title; Subtitle", Artist: "One; Two", Album: "Album", Genre: "Synthwave",
+				Year: 2019, Date: time.Date(2019, 5, 1, 18, 30, 0, 0, time.UTC), Track: 7, Duration: 2 * time.Second,
+				HasCover: true, Cover: []byte{0xFF, 0xD8}, CoverType: "image/jpeg",
+			},
+		},
+		{
+			name: "ID3v2.2",
+			file: "a.mp3",
+			data: joinBytes(id3Tag(2, 0,
+				id3Frame(2, "TT2", 0, id3Text(0, []byte("Old"))),
+				id3Frame(2, "TP1", 0, id3Text(0, []byte("Artist"))),
+				id3Frame(2, "TYE", 0, id3Text(0, []byte("2001"))),
+				id3Frame(2, "PIC", 0, joinBytes([]byte("\x00JPG\x03\x00"), testCover)),
+			), xingFrame()),
+			want: audioTags{
+				Title: "Old", Artist: "Artist", Year: 2001, Duration: 3 * time.Second,
+				HasCover: true, Cover: testCover, CoverType: "image/jpeg",
+			},
+		},
+		{
+			name: "ID3v2.3 skipped frames and unsynchronisation",
+			file: "a.mp3",
+			data: joinBytes(id3Tag(3, 0x80,
+				id3Frame(3, "TIT2", 0x80, id3Text(0, []byte("compressed"))),
+				id3Frame(3, "TPE1", 0, id3Text(0, []byte("Kept"))),
+				// Sizes count the frame before unsynchronisation.
+				bytes.ReplaceAll(id3Frame(3, "TALB", 0, id3Text(0, []byte("A\xffB"))), []byte{0xFF}, []byte{0xFF, 0x00}),
+			), xingFrame()),
+			want: audioTags{Artist: "Kept", Album: "AÿB", Duration: 3 * time.Second},
+		},
+		{
+			name: "ID3v1",
+			file: "a.mp3",
+			data: joinBytes(make([]byte, 1000), id3v1Tag("Song", "Band", "Record", "1987", 5, 17)),
+			want: audioTags{Title: "Song", Artist: "Band", Album: "Record", Genre: "Rock", Year: 1987, Track: 5},
+		},
+		{
+			name: "MPEG without tags",
+			file: "a.mp3",
+			data: joinBytes(mpegFrameHeader, silence[4:]),
+			want: audioTags{Duration: 2 * time.Second},
+		},
+		{
+			name: "FLAC",
+			file: "a.flac",
+			data: joinBytes([]byte("fLaC"),
+				flacBlock(false, 0, flacStreamInfo(44100, 441000)),
+				flacBlock(false, 1, make([]byte, 16)), // Padding
+				flacBlock(false, 4, vorbisComments(
+					"TITLE=Title", "artist=Artist", "ALBUM=Album", "ALBUM ARTIST=Album Artist",
+					"GENRE=Jazz", "TRACKNUMBER=2/10", "DISCNUMBER=1", "DATE=2001-02-03", "COMMENT", "UNKNOWN=x",
+				)),
+				flacBlock(true, 6, flacPicture("image/png", testCover)),
+			),
+			want: audioTags{
+				Title: "Title", Artist: "Artist", Album: "Album", AlbumArtist: "Album Artist", Genre: "Jazz",
+				Year: 2001, Date: time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC), Track: 2, Disc: 1, Duration: 10 * time.Second,
+				HasCover: true, Cover: testCover, CoverType: "image/png",
+			},
+		},
+		{
+			name: "FLAC with an ID3v2 tag and a picture comment",
+			file: "a.flac",
+			data: joinBytes(
+				id3Tag(3, 0, id3Frame(3, "TIT2", 0, id3Text(0, []byte("From ID3")))),
+				[]byte("fLaC"),
+				flacBlock(false, 0, flacStreamInfo(96000, 96000*90)),
+				flacBlock(true, 4, vorbisComments(
+					"YEAR=1970",
+					"METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(flacPicture("image/jpeg", testCover)),
+				)),
+			),
+			want: audioTags{
+				Title: "From ID3", Year: 1970, Duration: 90 * time.Second,
+				HasCover: true, Cover: testCover, CoverType: "image/jpeg",
+			},
+		},
+		{
+			name: "MP4",
+			file: "a.m4a",
+			data: m4aFile(mp4Atom("moov",
+				mp4Atom("mvhd", mp4MovieHeader(44100, 44100*215)),
+				mp4Atom("trak", make([]byte, 32)),
+				mp4Atom("udta", mp4Atom("meta", make([]byte, 4), mp4Atom("hdlr", make([]byte, 25)), mp4Items())),
+			)),
+			want: audioTags{
+				Title: "Title", Artist: "Artist", Album: "Album", AlbumArtist: "Album Artist", Genre: "Rock",
+				Year: 2015, Date: time.Date(2015, 6, 30, 7, 0, 0, 0, time.UTC), Track: 3, Disc: 2, Duration: 215 * time.Second,
+				HasCover: true, Cover: testCover, CoverType: "image/png",
+			},
+		},
+		{
+			name: "QuickTime meta and 64 bit sizes",
+			file: "a.m4a",
+			data: joinBytes(
+				mp4Atom("ftyp", []byte("M4A \x00\x00\x02\x00")),
+				// A 64 bit mdat size, as written for large files.
+				binary.BigEndian.AppendUint64([]byte("\x00\x00\x00\x01mdat"), 16+100), make([]byte, 100),
+				mp4Atom("moov",
+					mp4Atom("mvhd", joinBytes([]byte{1, 0, 0, 0}, make([]byte, 16), []byte{0, 0, 0x03, 0xe8}, binary.BigEndian.AppendUint64(nil, 90000))),
+					mp4Atom("udta", mp4Atom("meta", mp4Atom("hdlr", make([]byte, 25)), mp4Atom("ilst",
+						mp4Atom("\xa9nam", mp4Data(1, []byte("QuickTime"))),
+						mp4Atom("\xa9gen", mp4Data(1, []byte("Podcast"))),
+					))),
+				),
+			),
+			want: audioTags{Title: "QuickTime", Genre: "Podcast", Duration: 90 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullPath := writeTestFile(t, tt.file, tt.data)
+			got, err := readAudioTags(fullPath, true)
+			if err != nil {
+				t.Fatalf("readAudioTags() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("readAudioTags() =\n%+v\nwant\n%+v", *got, tt.want)
+			}
+
+			// Without the cover, its presence is still reported.
+			got, err = readAudioTags(fullPath, false)
+			if err != nil {
+				t.Fatalf("readAudioTags() without cover error = %v", err)
+			}
+			if got.HasCover != tt.want.HasCover || got.Cover != nil || got.CoverType != "" {
+				t.Errorf("readAudioTags() without cover: HasCover = %t, %d cover bytes of type %q", got.HasCover, len(got.Cover), got.CoverType)
+			}
+		})
+	}
+}
+
+func TestReadAudioTagsMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		want    audioTags
+		wantErr error
+	}{
+		{
+			name:    "ID3v2 larger than the file",
+			file:    "a.mp3",
+			data:    id3Tag(3, 0, id3Frame(3, "TIT2", 0, id3Text(0, []byte("Title"))))[:20],
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name: "ID3v2 frame larger than the tag",
+			file: "a.mp3",
+			data: id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0, id3Text(0, []byte("Title"))),
+				[]byte("TPE1\x00\x00\x10\x00\x00\x00\x00Artist"),
+			),
+			want: audioTags{Title: "Title"},
+		},
+		{
+			name: "ID3v2 frames after the padding",
+			file: "a.mp3",
+			data: id3Tag(4, 0, make([]byte, 10), id3Frame(4, "TIT2", 0, id3Text(3, []byte("Hidden")))),
+		},
+		{
+			name: "ID3v2 empty and truncated frames",
+			file: "a.mp3",
+			data: id3Tag(3, 0,
+				id3Frame(3, "TIT2", 0, nil),
+				id3Frame(3, "APIC", 0, []byte{0}),
+				id3Frame(3, "APIC", 0, []byte("\x00image/png")),
+				id3Frame(3, "APIC", 0, []byte("\x01image/png\x00\x03F\x00")),
+				id3Frame(3, "TRCK", 0, id3Text(0, []byte("x/y"))),
+				id3Frame(3, "TCON", 0, id3Text(0, []byte("(255)"))),
+			),
+			want: audioTags{Genre: "(255)"},
+		},
+		{
+			name: "ID3v2.2 truncated picture",
+			file: "a.mp3",
+			data: id3Tag(2, 0,
+				id3Frame(2, "PIC", 0, []byte("\x00PN")),
+				id3Frame(2, "TT2", 0, id3Text(0, []byte("Title"))),
+			),
+			want: audioTags{Title: "Title"},
+		},
+		{
+			name: "ID3v2 larger than the tag limit",
+			file: "a.mp3",
+			data: append([]byte{'I', 'D', '3', 3, 0, 0, 0x7f, 0x7f, 0x7f, 0x7f}, make([]byte, 100)...),
+		},
+		{
+			name: "no frame sync",
+			file: "a.mp3",
+			data: []byte("plain text, not audio"),
+		},
+		{
+			name:    "FLAC without magic",
+			file:    "a.flac",
+			data:    []byte("OggS\x00\x02"),
+			wantErr: errNoAudioTags,
+		},
+		{
+			name:    "FLAC block larger than the file",
+			file:    "a.flac",
+			data:    joinBytes([]byte("fLaC"), flacBlock(true, 4, vorbisComments("TITLE=Title"))[:20]),
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "FLAC without a last block",
+			file:    "a.flac",
+			data:    joinBytes([]byte("fLaC"), flacBlock(false, 0, flacStreamInfo(44100, 44100))),
+			want:    audioTags{Duration: time.Second},
+			wantErr: io.EOF,
+		},
+		{
+			name: "FLAC with broken comments and pictures",
+			file: "a.flac",
+			data: joinBytes([]byte("fLaC"),
+				flacBlock(false, 0, flacStreamInfo(0, 1000)),
+				// The second comment claims more bytes than the block has.
+				flacBlock(false, 4, append(vorbisComments("TITLE=Title", "ARTIST=Artist")[:55], 0xff, 0xff, 0, 0)),
+				flacBlock(false, 6, flacPicture("image/png", testCover)[:40]),
+				flacBlock(true, 4, []byte{0xff, 0xff, 0xff, 0x7f}),
+			),
+			want: audioTags{Title: "Title"},
+		},
+		{
+			name:    "MP4 atom smaller than its header",
+			file:    "a.m4a",
+			data:    []byte("\x00\x00\x00\x04ftyp"),
+			wantErr: errNoAudioTags,
+		},
+		{
+			name:    "MP4 without moov",
+			file:    "a.m4a",
+			data:    joinBytes(mp4Atom("ftyp", []byte("M4A ")), mp4Atom("mdat", make([]byte, 100))),
+			wantErr: errNoAudioTags,
+		},
+		{
+			name:    "MP4 moov larger than the file",
+			file:    "a.m4a",
+			data:    m4aFile(mp4Atom("moov", mp4Atom("mvhd", mp4MovieHeader(1000, 1000))))[:1050],
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name: "MP4 with broken atoms",
+			file: "a.m4a",
+			data: m4aFile(mp4Atom("moov",
+				mp4Atom("mvhd", mp4MovieHeader(0, 1000)),
+				mp4Atom("udta", mp4Atom("meta", make([]byte, 4), mp4Atom("ilst",
+					mp4Atom("\xa9nam", mp4Data(1, []byte("Title"))),
+					mp4Atom("trkn", mp4Data(0, []byte{0, 0})),
+					mp4Atom("\xa9ART", mp4Atom("data", []byte{0, 0, 0})),
+					// Claims more bytes than the list holds.
+					[]byte("\x00\x00\x10\x00\xa9alb"),
+				))),
+			)),
+			want: audioTags{Title: "Title"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readAudioTags(writeTestFile(t, tt.file, tt.data), true)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readAudioTags() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("readAudioTags() =\n%+v\nwant\n%+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReadAudioTagsTruncated cuts valid files off everywhere; the readers
+// may fail but must not read out of bounds.
+func TestReadAudioTagsTruncated(t *testing.T) {
+	files := map[string][]byte{
+		"a.mp3": joinBytes(id3Tag(4, 0,
+			id3Frame(4, "TIT2", 0, id3Text(1, utf16Text("Title", binary.LittleEndian))),
+			id3Frame(4, "APIC", 0, joinBytes([]byte("\x00image/png\x00\x03\x00"), testCover)),
+		), xingFrame()),
+		"b.mp3": joinBytes(id3Tag(2, 0, id3Frame(2, "PIC", 0, joinBytes([]byte("\x00PNG\x03\x00"), testCover))), mpegFrameHeader),
+		"a.flac": joinBytes([]byte("fLaC"),
+			flacBlock(false, 0, flacStreamInfo(44100, 441000)),
+			flacBlock(false, 4, vorbisComments("TITLE=Title")),
+			flacBlock(true, 6, flacPicture("image/png", testCover)),
+		),
+		"a.m4a": m4aFile(mp4Atom("moov",
+			mp4Atom("mvhd", mp4MovieHeader(1000, 1000)),
+			mp4Atom("udta", mp4Atom("meta", make([]byte, 4), mp4Items())),
+		)),
+	}
+	dir := t.TempDir()
+	for name, data := range files {
+		fullPath := filepath.Join(dir, name)
+		for n := range data {
+			if err := os.WriteFile(fullPath, data[:n], 0o644); err != nil {
+				t.Fatal(err)
+			}
+			readAudioTags(fullPath, true)
+		}
+	}
+}
+
+func TestDecodeID3Text(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding byte
+		data     []byte
+		want     string
+	}{
+		{"Latin-1", 0, []byte("Caf\xe9"), "Café"},
+		{"UTF-16 little endian", 1, utf16Text("Ωmega", binary.LittleEndian), "Ωmega"},
+		{"UTF-16 big endian", 1, utf16Text("Ωmega", binary.BigEndian), "Ωmega"},
+		{"UTF-16 without BOM", 1, []byte("O\x00K\x00"), "OK"},
+		{"UTF-16BE", 2, []byte("\x00O\x00K"), "OK"},
+		{"UTF-8", 3, []byte("Ωmega"), "Ωmega"},
+		{"UTF-8 list", 3, []byte("One\x00Two\x00"), "One; Two"},
+		{"UTF-16 list", 1, joinBytes(utf16Text("One", binary.LittleEndian), []byte{0, 0}, utf16Text("Two", binary.LittleEndian)), "One; Two"},
+		{"blank values", 0, []byte(" \x00Value\x00 "), "Value"},
+		{"empty", 0, nil, ""},
+		{"odd UTF-16", 1, []byte{0xFF, 0xFE, 'A', 0, 'B'}, "A"},
+	}
+	for _, tt := range tests {
+		if got := decodeID3Text(tt.encoding, tt.data); got != tt.want {
+			t.Errorf("%s: decodeID3Text() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAudioTagValues(t *testing.T) {
+	genres := map[string]string{"(17)": "Rock", "0": "Blues", "(79)": "Hard Rock", "(80)": "(80)", "(-1)": "(-1)", "Rock": "Rock"}
+	for value, want := range genres {
+		if got := id3Genre(value); got != want {
+			t.Errorf("id3Genre(%q) = %q, want %q", value, got, want)
+		}
+	}
+
+	numbers := map[string]int{"3": 3, "3/12": 3, " 07 ": 7, "x": -1, "": -1, "/5": -1}
+	for value, want := range numbers {
+		got := -1
+		setNumber(&got, value)
+		if got != want {
+			t.Errorf("setNumber(%q) = %d, want %d", value, got, want)
+		}
+	}
+
+	dates := []struct {
+		value string
+		year  int
+		date  time.Time
+	}{
+		{"2019", 2019, time.Time{}},
+		{"2019-05", 2019, time.Time{}},
+		{"2019-05-01", 2019, time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2019-05-01 18:30:00", 2019, time.Date(2019, 5, 1, 18, 30, 0, 0, time.UTC)},
+		{"2019-05-01T18:30", 2019, time.Date(2019, 5, 1, 18, 30, 0, 0, time.UTC)},
+		{"2019-05-01T18:30:00+02:00", 2019, time.Date(2019, 5, 1, 16, 30, 0, 0, time.UTC)},
+		{"19", 0, time.Time{}},
+		{"unknown", 0, time.Time{}},
+	}
+	for _, tt := range dates {
+		var tags audioTags
+		tags.setDate(tt.value)
+		if tags.Year != tt.year || !tags.Date.Equal(tt.date) {
+			t.Errorf("setDate(%q): year %d, date %v; want %d, %v", tt.value, tags.Year, tags.Date, tt.year, tt.date)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// assetHashLen is the number of hex digits of an asset's SHA-256 used in
+	// ETags and fingerprinted URLs.
+	assetHashLen         = 16
+	immutableCacheHeader = "public, max-age=31536000, immutable"
+	// maxFileETags caps the content hashes kept by etagCache.
+	maxFileETags = 50000
+)
+
+// cacheRule assigns a Cache-Control value to request paths matching pattern.
+// Patterns ending in "/" match by prefix, patterns without a "/" match the
+// base name, and everything else is a path.Match glob on the full URL path.
+type cacheRule struct {
+	pattern string
+	value   string
+}
+
+// parseCacheRules parses PATTERN=VALUE specifications.
+func parseCacheRules(specs []string) ([]cacheRule, error) {
+	rules := make([]cacheRule, 0, len(specs))
+	for _, spec := range specs {
+		pattern, value, ok := strings.Cut(spec, "=")
+		if !ok || pattern == "" || value == "" {
+			return nil, fmt.Errorf("invalid cache rule %q, expected PATTERN=VALUE", spec)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid cache rule pattern %q: %w", pattern, err)
+		}
+		rules = append(rules, cacheRule{pattern: pattern, value: value})
+	}
+	return rules, nil
+}
+
+func (rule cacheRule) matches(urlPath string) bool {
+	switch {
+	case strings.HasSuffix(rule.pattern, "/"):
+		return strings.HasPrefix(urlPath, rule.pattern)
+	case !strings.Contains(rule.pattern, "/"):
+		matched, _ := path.Match(rule.pattern, path.Base(urlPath))
+		return matched
+	}
+	matched, _ := path.Match(rule.pattern, urlPath)
+	return matched
+}
+
+// applyCacheRules sets Cache-Control from the first rule matching urlPath.
+// It reports whether a rule matched.
+func (s *Server) applyCacheRules(w http.ResponseWriter, urlPath string) bool {
+	for _, rule := range s.cacheRules {
+		if rule.matches(urlPath) {
+			w.Header().Set("Cache-Control", rule.value)
+			return true
+		}
+	}
+	return false
+}
+
+// hashAssets returns a truncated SHA-256 for every file in fsys, keyed by
+// its slash separated path.
+func hashAssets(fsys fs.FS) (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hashes[name] = hex.EncodeToString(sum[:])[:assetHashLen]
+		return nil
+	})
+	return hashes, err
+}
+
+// assetURL returns the fingerprinted URL of an embedded static asset.
+func assetURL(hashes map[string]string, name string) string {
+	if hash, ok := hashes[name]; ok {
+		return "/static/" + name + "?v=" + hash
+	}
+	return "/static/" + name
+}
+
+// staticAssetHandler adds content-hash ETags and a cache policy to the
+// embedded UI assets. Fingerprinted URLs never change, so they are cached
+// forever; plain URLs must be revalidated.
+func staticAssetHandler(s *Server, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hash, ok := s.assetHashes[strings.TrimPrefix(r.URL.Path, "/static/")]; ok {
+			w.Header().Set("ETag", `"`+hash+`"`)
+			if r.URL.Query().Get("v") == hash {
+				w.Header().Set("Cache-Control", immutableCacheHeader)
+			} else {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+		}
+		s.applyCacheRules(w, r.URL.Path)
+		next.ServeHTTP(w, r)
+	}
+}
+
+// etagCache remembers content hashes of served files, keyed by path and
+// invalidated whenever size or modification time change.
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{entries: make(map[string]etagEntry)}
+}
+
+// fileETag returns a strong ETag derived from the SHA-256 of the file.
+func (c *etagCache) fileETag(fullPath string, info fs.FileInfo) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[fullPath]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.etag, nil
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`
+
+	c.mu.Lock()
+	if len(c.entries) >= maxFileETags {
+		clear(c.entries)
+	}
+	c.entries[fullPath] = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	c.mu.Unlock()
+	return etag, nil
+}
+
+// dirVersionKey normalises a directory path relative to rootDir the same way
+// getDirectoryListing reports CurrentPath.
+func dirVersionKey(relativePath string) string {
+	cleanPath := filepath.Clean(relativePath)
+	if cleanPath == "." {
+		return ""
+	}
+	return cleanPath
+}
+
+// bumpDirVersion invalidates cached listings of the directory at fullPath.
+// Versions come from one counter, so a directory that is removed and
+// created again never repeats an earlier version.
+func (s *Server) bumpDirVersion(fullPath string) {
+	rel, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil {
+		return
+	}
+	key := dirVersionKey(rel)
+	s.versionMu.Lock()
+	s.versionCounter++
+	s.dirVersions[key] = s.versionCounter
+	s.versionMu.Unlock()
+}
+
+// forgetDirVersion drops the version of a removed directory.
+func (s *Server) forgetDirVersion(fullPath string) {
+	rel, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil {
+		return
+	}
+	s.versionMu.Lock()
+	delete(s.dirVersions, dirVersionKey(rel))
+	s.versionMu.Unlock()
+}
+
+// dirETag returns the current validator for the listing of relativePath. The
+// per-process seed keeps validators from colliding across restarts.
+func (s *Server) dirETag(relativePath string) string {
+	key := dirVersionKey(relativePath)
+	s.versionMu.Lock()
+	version := s.dirVersions[key]
+	s.versionMu.Unlock()
+	return fmt.Sprintf(`"%s-%d"`, s.versionSeed, version)
+}
+
+// etagMatches reports whether an If-None-Match header matches etag using the
+// weak comparison function.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
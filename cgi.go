@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cgiSupervisorArg makes serve run as the parent of a CGI script, see
+// runCGISupervisor. It is not a user facing flag.
+const cgiSupervisorArg = "__serve-cgi-exec"
+
+// scriptRule executes files matching pattern instead of serving them, either
+// as CGI with an optional interpreter or by forwarding to a FastCGI server.
+type scriptRule struct {
+	pattern     string
+	interpreter []string // CGI command prefix, empty to run the script itself
+	fcgiNetwork string   // "unix" or "tcp" for FastCGI rules
+	fcgiAddress string
+}
+
+func (rule scriptRule) matches(sitePath string) bool {
+	return cacheRule{pattern: rule.pattern}.matches(sitePath)
+}
+
+// String describes the rule for startup logging.
+func (rule scriptRule) String() string {
+	switch {
+	case rule.fcgiAddress != "":
+		return fmt.Sprintf("%s via FastCGI at %s:%s", rule.pattern, rule.fcgiNetwork, rule.fcgiAddress)
+	case len(rule.interpreter) > 0:
+		return fmt.Sprintf("%s as CGI with %s", rule.pattern, strings.Join(rule.interpreter, " "))
+	}
+	return rule.pattern + " as CGI"
+}
+
+// parseScriptRules parses --cgi PATTERN=INTERPRETER and --fastcgi
+// PATTERN=ADDRESS specifications. Patterns use the --cache-control syntax;
+// addresses are "unix:/path/to/socket" or "host:port".
+func parseScriptRules(cgiSpecs, fastcgiSpecs []string) ([]scriptRule, error) {
+	var rules []scriptRule
+	for _, spec := range cgiSpecs {
+		pattern, interpreter, ok := strings.Cut(spec, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid cgi rule %q, expected PATTERN=INTERPRETER", spec)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid cgi rule pattern %q: %w", pattern, err)
+		}
+		rule := scriptRule{pattern: pattern, interpreter: strings.Fields(interpreter)}
+		if len(rule.interpreter) > 0 {
+			resolved, err := exec.LookPath(rule.interpreter[0])
+			if err != nil {
+				return nil, fmt.Errorf("cgi interpreter for %q: %w", pattern, err)
+			}
+			rule.interpreter[0] = resolved
+		}
+		rules = append(rules, rule)
+	}
+	for _, spec := range fastcgiSpecs {
+		pattern, address, ok := strings.Cut(spec, "=")
+		if !ok || pattern == "" || address == "" {
+			return nil, fmt.Errorf("invalid fastcgi rule %q, expected PATTERN=ADDRESS", spec)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid fastcgi rule pattern %q: %w", pattern, err)
+		}
+		rule := scriptRule{pattern: pattern, fcgiNetwork: "tcp", fcgiAddress: address}
+		if socket, isUnix := strings.CutPrefix(address, "unix:"); isUnix {
+			rule.fcgiNetwork, rule.fcgiAddress = "unix", socket
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// scriptHandler runs CGI and FastCGI scripts below prefix and passes every
+// other request to next. The first path segment that is a matching file is
+// the script; the remainder of the path becomes PATH_INFO.
+func scriptHandler(s *Server, prefix string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.scriptRules) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sitePath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, prefix))
+		segments := strings.Split(strings.TrimPrefix(sitePath, "/"), "/")
+		for i := range segments {
+			scriptPath := "/" + strings.Join(segments[:i+1], "/")
+			for _, rule := range s.scriptRules {
+				if !rule.matches(scriptPath) {
+					continue
+				}
+				fullPath := resolveInRoot(s.rootDir, scriptPath)
+				if !isRegularFile(fullPath) || isSiteRulesFile(s.rootDir, fullPath) {
+					continue
+				}
+				pathInfo := strings.TrimPrefix(sitePath, scriptPath)
+				s.runScript(w, r, rule, fullPath, prefix+scriptPath, pathInfo)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func (s *Server) runScript(w http.ResponseWriter, r *http.Request, rule scriptRule, fullPath, scriptName, pathInfo string) {
+	// The server-wide write timeout is too short for slow scripts; the
+	// script timeout bounds the response instead.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(s.scriptTimeout + 5*time.Second)); err != nil {
+		log.Printf("Error setting write deadline for script %s: %v", fullPath, err)
+	}
+	// Scripts have no business seeing serve's session.
+	r = r.Clone(r.Context())
+	stripCookie(r, sessionCookieName)
+
+	if rule.fcgiAddress != "" {
+		s.serveFastCGI(w, r, rule, fullPath, scriptName, pathInfo)
+		return
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("Error locating serve executable for CGI: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	args := append([]string{cgiSupervisorArg, s.scriptTimeout.String()}, rule.interpreter...)
+	handler := &cgi.Handler{
+		Path:       self,
+		Root:       scriptName,
+		Dir:        filepath.Dir(fullPath),
+		Args:       append(args, fullPath),
+		InheritEnv: s.cgiEnv,
+		Env: []string{
+			"SCRIPT_FILENAME=" + fullPath,
+			"DOCUMENT_ROOT=" + s.rootDir,
+			"REDIRECT_STATUS=200", // required by php-cgi
+		},
+	}
+	// cgi.Handler derives PATH_INFO from the URL below Root.
+	r.URL.Path = scriptName + pathInfo
+	handler.ServeHTTP(w, r)
+}
+
+// runCGISupervisor runs a CGI script as its parent process so the script can
+// be killed after the per-request timeout, which net/http/cgi does not offer.
+// args are the timeout followed by the command line. A script that times out
+// before writing anything is answered with a 504.
+func runCGISupervisor(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: serve "+cgiSupervisorArg+" TIMEOUT COMMAND [ARGS...]")
+		return 2
+	}
+	timeout, err := time.ParseDuration(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid CGI timeout %q: %v\n", args[0], err)
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stdout := &countingWriter{w: os.Stdout}
+	cmd := exec.CommandContext(ctx, args[1], args[2:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "CGI script %s timed out after %s\n", args[len(args)-1], timeout)
+		if stdout.n == 0 {
+			fmt.Fprint(os.Stdout, "Status: 504 Gateway Timeout\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nGateway Timeout\n")
+		}
+		return 1
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running CGI script: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
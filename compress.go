@@ -0,0 +1,287 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the smallest response body worth compressing on the fly.
+const minCompressSize = 1024
+
+// precompressedExts maps a content coding to the sibling file extension that
+// holds a precompressed copy, in server preference order.
+var precompressedExts = []struct {
+	encoding string
+	ext      string
+}{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// dynamicEncodings are the codings we can produce on the fly, in server
+// preference order.
+var dynamicEncodings = []string{"zstd", "gzip"}
+
+var (
+	gzipWriterPool = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return w
+	}}
+	zstdWriterPool = sync.Pool{New: func() any {
+		w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// isCompressibleType reports whether a Content-Type is text-like. Images,
+// audio, video and archives are already compressed and are left alone.
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/xhtml+xml", "application/rss+xml", "application/atom+xml",
+		"application/manifest+json", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// negotiateEncoding picks the best coding from offered (in server preference
+// order) according to the request's Accept-Encoding header. It returns an
+// empty string when identity should be used.
+func negotiateEncoding(r *http.Request, offered []string) string {
+	header := r.Header.Get("Accept-Encoding")
+	if header == "" {
+		return ""
+	}
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		qualities[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range offered {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// servePrecompressed serves a .br/.zst/.gz sibling of fullPath if one exists
+// and the client accepts its coding. It reports whether a response was written.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, fullPath string) bool {
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	var available []string
+	for _, candidate := range precompressedExts {
+		if sibling, err := os.Stat(fullPath + candidate.ext); err == nil && !sibling.IsDir() {
+			available = append(available, candidate.encoding)
+		}
+	}
+	if len(available) == 0 {
+		return false
+	}
+	addVary(w.Header(), "Accept-Encoding")
+	// Byte ranges are only meaningful on the identity representation.
+	if r.Header.Get("Range") != "" {
+		return false
+	}
+	encoding := negotiateEncoding(r, available)
+	if encoding == "" {
+		return false
+	}
+
+	var ext string
+	for _, candidate := range precompressedExts {
+		if candidate.encoding == encoding {
+			ext = candidate.ext
+		}
+	}
+	file, err := os.Open(fullPath + ext)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	// The type must come from the original file; sniffing the compressed
+	// bytes would yield application/octet-stream.
+	contentType := mime.TypeByExtension(filepath.Ext(fullPath))
+	if contentType == "" {
+		contentType = sniffContentType(fullPath)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", encoding)
+	// Each representation needs its own validator.
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+	}
+	http.ServeContent(w, r, filepath.Base(fullPath), info.ModTime(), file)
+	return true
+}
+
+// addVary appends field to the Vary header unless it is already listed.
+func addVary(h http.Header, field string) {
+	for _, value := range h.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+func sniffContentType(fullPath string) string {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(file, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// compressHandler compresses text-like responses on the fly with zstd or
+// gzip. Range requests, HEAD requests, responses that already carry a
+// Content-Encoding and small bodies are passed through untouched.
+func compressHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: negotiateEncoding(r, dynamicEncodings)}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	}
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	h := cw.Header()
+	if !isCompressibleType(h.Get("Content-Type")) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	addVary(h, "Accept-Encoding")
+	contentLength, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	tooSmall := err == nil && contentLength < minCompressSize
+	if cw.encoding != "" && status == http.StatusOK && !tooSmall &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", cw.encoding)
+		// A weak validator, since the compressed bytes differ from the file.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.encoder = newEncoder(cw.encoding, cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressResponseWriter) Flush() {
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressResponseWriter) Close() {
+	if cw.encoder != nil {
+		_ = cw.encoder.Close()
+	}
+}
+
+// pooledEncoder returns its compressor to the pool once closed.
+type pooledEncoder struct {
+	io.WriteCloser
+	release func()
+}
+
+func (p *pooledEncoder) Close() error {
+	err := p.WriteCloser.Close()
+	p.release()
+	return err
+}
+
+func (p *pooledEncoder) Flush() error {
+	if flusher, ok := p.WriteCloser.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	switch encoding {
+	case "zstd":
+		zw := zstdWriterPool.Get().(*zstd.Encoder)
+		zw.Reset(w)
+		return &pooledEncoder{WriteCloser: zw, release: func() { zstdWriterPool.Put(zw) }}
+	default:
+		gw := gzipWriterPool.Get().(*gzip.Writer)
+		gw.Reset(w)
+		return &pooledEncoder{WriteCloser: gw, release: func() { gzipWriterPool.Put(gw) }}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// exifScanSize is how much of an image file is searched for EXIF data.
+const exifScanSize = 256 << 10
+
+// exifInfo holds the EXIF fields serve uses.
+type exifInfo struct {
+	Orientation int       // 1-8 as defined by the TIFF spec, 1 when absent
+	Taken       time.Time // DateTimeOriginal, or DateTime; zero when absent
+	Make        string
+	Model       string
+	GPS         *gpsPosition
+}
+
+// gpsPosition is a location in decimal degrees.
+type gpsPosition struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+}
+
+// Camera returns the camera make and model, without the make repeated.
+func (e *exifInfo) Camera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// EXIF tags.
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// exifTimeLayout is how EXIF stores dates; they carry no time zone.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+var errNoEXIF = errors.New("no EXIF data")
+
+// readEXIF extracts EXIF data from a JPEG, PNG or WebP file.
+func readEXIF(fullPath string) (*exifInfo, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	head, err := readHead(file)
+	if err != nil {
+		return nil, err
+	}
+	return exifFromHead(head)
+}
+
+// readHead reads the part of a file that is searched for EXIF data.
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, exifScanSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+func exifFromHead(head []byte) (*exifInfo, error) {
+	tiff := findEXIF(head)
+	if tiff == nil {
+		return nil, errNoEXIF
+	}
+	return parseEXIF(tiff)
+}
+
+// findEXIF returns the TIFF structured EXIF block of an image, or nil.
+func findEXIF(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		// JPEG: walk the marker segments up to the start of scan.
+		for i := 2; i+4 <= len(data); {
+			if data[i] != 0xFF {
+				return nil
+			}
+			marker := data[i+1]
+			if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 || marker == 0xFF {
+				i++
+				continue
+			}
+			if marker == 0xDA || marker == 0xD9 {
+				return nil
+			}
+			length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+			end := i + 2 + length
+			if length < 2 || end > len(data) {
+				return nil
+			}
+			segment := data[i+4 : end]
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:]
+			}
+			i = end
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		for i := 8; i+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i : i+4]))
+			chunkType := string(data[i+4 : i+8])
+			end := i + 12 + length
+			if length < 0 || end > len(data) {
+				return nil
+			}
+			if chunkType == "eXIf" {
+				return data[i+8 : i+8+length]
+			}
+			if chunkType == "IDAT" {
+				return nil
+			}
+			i = end
+		}
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		for i := 12; i+8 <= len(data); {
+			length := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+			end := i + 8 + length + length%2
+			if length < 0 || i+8+length > len(data) {
+				return nil
+			}
+			if string(data[i:i+4]) == "EXIF" {
+				chunk := data[i+8 : i+8+length]
+				return bytes.TrimPrefix(chunk, []byte("Exif\x00\x00"))
+			}
+			i = end
+		}
+	}
+	return nil
+}
+
+// tiffReader reads IFD entries from a TIFF structure.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // the raw value, resolved from its offset when not inline
+}
+
+// tiffTypeSizes gives the byte size of each TIFF field type.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+func newTIFFReader(data []byte) (*tiffReader, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, errNoEXIF
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, errNoEXIF
+	}
+	if t.order.Uint16(data[2:4]) != 42 {
+		return nil, 0, errNoEXIF
+	}
+	return t, t.order.Uint32(data[4:8]), nil
+}
+
+// readIFD returns the entries of the IFD at offset.
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errNoEXIF
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	entries := make(map[uint16]tiffEntry, count)
+	for i := 0; i < count; i++ {
+		pos := int(offset) + 2 + i*12
+		if pos+12 > len(t.data) {
+			break
+		}
+		entry := tiffEntry{
+			typ:   t.order.Uint16(t.data[pos+2:]),
+			count: t.order.Uint32(t.data[pos+4:]),
+		}
+		size := uint64(tiffTypeSizes[entry.typ]) * uint64(entry.count)
+		if size == 0 {
+			continue
+		}
+		if size <= 4 {
+			entry.value = t.data[pos+8 : pos+8+int(size)]
+		} else {
+			valueOffset := uint64(t.order.Uint32(t.data[pos+8:]))
+			if valueOffset+size > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[valueOffset : valueOffset+size]
+		}
+		entries[t.order.Uint16(t.data[pos:])] = entry
+	}
+	return entries, nil
+}
+
+// uint returns the first value of an integer entry.
+func (t *tiffReader) uint(entry tiffEntry) (uint32, bool) {
+	switch entry.typ {
+	case 1, 7:
+		return uint32(entry.value[0]), true
+	case 3:
+		return uint32(t.order.Uint16(entry.value)), true
+	case 4:
+		return t.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+// string returns an ASCII entry without its terminating NUL.
+func (t *tiffReader) string(entry tiffEntry) string {
+	if entry.typ != 2 {
+		return ""
+	}
+	value, _, _ := bytes.Cut(entry.value, []byte{0})
+	return strings.TrimSpace(string(value))
+}
+
+// degrees converts a GPS coordinate of three rationals (degrees, minutes,
+// seconds) to decimal degrees.
+func (t *tiffReader) degrees(entry tiffEntry) (float64, bool) {
+	if entry.typ != 5 || entry.count < 3 {
+		return 0, false
+	}
+	var result float64
+	for i, scale := range []float64{1, 60, 3600} {
+		num := t.order.Uint32(entry.value[i*8:])
+		den := t.order.Uint32(entry.value[i*8+4:])
+		if den == 0 {
+			if num == 0 {
+				continue
+			}
+			return 0, false
+		}
+		result += float64(num) / float64(den) / scale
+	}
+	return result, true
+}
+
+// subIFD returns the entries of the IFD an offset entry points to.
+func (t *tiffReader) subIFD(entries map[uint16]tiffEntry, tag uint16) map[uint16]tiffEntry {
+	entry, ok := entries[tag]
+	if !ok {
+		return nil
+	}
+	offset, ok := t.uint(entry)
+	if !ok {
+		return nil
+	}
+	sub, err := t.readIFD(offset)
+	if err != nil {
+		return nil
+	}
+	return sub
+}
+
+func parseEXIF(data []byte) (*exifInfo, error) {
+	t, ifd0, err := newTIFFReader(data)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := t.readIFD(ifd0)
+	if err != nil {
+		return nil, err
+	}
+	info := &exifInfo{Orientation: 1}
+	if entry, ok := entries[tagOrientation]; ok {
+		if orientation, ok := t.uint(entry); ok && orientation >= 1 && orientation <= 8 {
+			info.Orientation = int(orientation)
+		}
+	}
+	info.Make = t.string(entries[tagMake])
+	info.Model = t.string(entries[tagModel])
+
+	taken := t.string(t.subIFD(entries, tagExifIFD)[tagDateTimeOriginal])
+	if taken == "" {
+		taken = t.string(entries[tagDateTime])
+	}
+	if parsed, err := time.ParseInLocation(exifTimeLayout, taken, time.Local); err == nil {
+		info.Taken = parsed
+	}
+
+	if gps := t.subIFD(entries, tagGPSIFD); gps != nil {
+		lat, latOK := t.degrees(gps[tagGPSLatitude])
+		lon, lonOK := t.degrees(gps[tagGPSLongitude])
+		if latOK && lonOK {
+			if t.string(gps[tagGPSLatitudeRef]) == "S" {
+				lat = -lat
+			}
+			if t.string(gps[tagGPSLongitudeRef]) == "W" {
+				lon = -lon
+			}
+			info.GPS = &gpsPosition{Latitude: lat, Longitude: lon}
+		}
+	}
+	return info, nil
+}
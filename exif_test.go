@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// testTIFFField is an IFD entry of a TIFF structure built by buildTIFF.
+type testTIFFField struct {
+	tag  uint16
+	typ  uint16
+	str  string   // Type 2
+	nums []uint32 // Types 3 and 4, or numerator, denominator pairs of type 5
+	ifd  int      // When set, a long pointing at that IFD
+}
+
+// buildTIFF lays out a TIFF structure with ifds[0] as IFD0, followed by
+// the other IFDs and the values that don't fit in their entries.
+func buildTIFF(order binary.AppendByteOrder, ifds ...[]testTIFFField) []byte {
+	offsets := make([]uint32, len(ifds))
+	dataStart := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = dataStart
+		dataStart += 2 + 12*uint32(len(ifd)) + 4
+	}
+	buf := []byte("II")
+	if order.String() == binary.BigEndian.String() {
+		buf = []byte("MM")
+	}
+	buf = order.AppendUint16(buf, 42)
+	buf = order.AppendUint32(buf, offsets[0])
+	var data []byte
+	for _, ifd := range ifds {
+		buf = order.AppendUint16(buf, uint16(len(ifd)))
+		for _, f := range ifd {
+			typ, count := f.typ, uint32(len(f.nums))
+			var value []byte
+			switch {
+			case f.ifd != 0:
+				typ, count = 4, 1
+				value = order.AppendUint32(nil, offsets[f.ifd])
+			case typ == 2:
+				count = uint32(len(f.str) + 1)
+				value = append([]byte(f.str), 0)
+			case typ == 3:
+				for _, n := range f.nums {
+					value = order.AppendUint16(value, uint16(n))
+				}
+			case typ == 4 || typ == 5:
+				for _, n := range f.nums {
+					value = order.AppendUint32(value, n)
+				}
+				if typ == 5 {
+					count /= 2
+				}
+			}
+			buf = order.AppendUint16(buf, f.tag)
+			buf = order.AppendUint16(buf, typ)
+			buf = order.AppendUint32(buf, count)
+			if len(value) <= 4 {
+				buf = append(buf, value...)
+				buf = append(buf, make([]byte, 4-len(value))...)
+			} else {
+				buf = order.AppendUint32(buf, dataStart+uint32(len(data)))
+				data = append(data, value...)
+			}
+		}
+		buf = order.AppendUint32(buf, 0) // No next IFD
+	}
+	return append(buf, data...)
+}
+
+// testEXIF is a photo's EXIF data: a Canon turned 90° clockwise, taken at
+// 52°31'12"N 13°24'36"E.
+func testEXIF(order binary.AppendByteOrder) []byte {
+	return buildTIFF(order,
+		[]testTIFFField{
+			{tag: tagMake, typ: 2, str: "Canon"},
+			{tag: tagModel, typ: 2, str: "Canon EOS 5D"},
+			{tag: tagOrientation, typ: 3, nums: []uint32{6}},
+			{tag: tagDateTime, typ: 2, str: "2020:01:01 00:00:00"},
+			{tag: tagExifIFD, ifd: 1},
+			{tag: tagGPSIFD, ifd: 2},
+		},
+		[]testTIFFField{
+			{tag: tagDateTimeOriginal, typ: 2, str: "2019:07:14 18:30:05"},
+		},
+		[]testTIFFField{
+			{tag: tagGPSLatitudeRef, typ: 2, str: "N"},
+			{tag: tagGPSLatitude, typ: 5, nums: []uint32{52, 1, 31, 1, 1200, 100}},
+			{tag: tagGPSLongitudeRef, typ: 2, str: "E"},
+			{tag: tagGPSLongitude, typ: 5, nums: []uint32{13, 1, 24, 1, 36, 1}},
+		},
+	)
+}
+
+func TestParseEXIF(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		orientation int
+		taken       time.Time
+		camera      string
+		gps         *gpsPosition
+	}{
+		{
+			// A big-endian TIFF header and an IFD0 holding just Orientation 3.
+			name:        "minimal big endian",
+			data:        []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x03\x00\x00\x00\x00\x00\x00"),
+			orientation: 3,
+		},
+		{
+			name:        "little endian",
+			data:        testEXIF(binary.LittleEndian),
+			orientation: 6,
+			taken:       time.Date(2019, 7, 14, 18, 30, 5, 0, time.Local),
+			camera:      "Canon EOS 5D",
+			gps:         &gpsPosition{Latitude: 52.52, Longitude: 13.41},
+		},
+		{
+			name:        "big endian",
+			data:        testEXIF(binary.BigEndian),
+			orientation: 6,
+			taken:       time.Date(2019, 7, 14, 18, 30, 5, 0, time.Local),
+			camera:      "Canon EOS 5D",
+			gps:         &gpsPosition{Latitude: 52.52, Longitude: 13.41},
+		},
+		{
+			name: "southern and western hemisphere",
+			data: buildTIFF(binary.BigEndian,
+				[]testTIFFField{
+					{tag: tagMake, typ: 2, str: "NIKON CORPORATION"},
+					{tag: tagModel, typ: 2, str: "D750"},
+					{tag: tagGPSIFD, ifd: 1},
+				},
+				[]testTIFFField{
+					{tag: tagGPSLatitudeRef, typ: 2, str: "S"},
+					{tag: tagGPSLatitude, typ: 5, nums: []uint32{33, 1, 51, 1, 54, 1}},
+					{tag: tagGPSLongitudeRef, typ: 2, str: "W"},
+					{tag: tagGPSLongitude, typ: 5, nums: []uint32{70, 1, 39, 1, 0, 0}},
+				}),
+			orientation: 1,
+			camera:      "NIKON CORPORATION D750",
+			gps:         &gpsPosition{Latitude: -33.865, Longitude: -70.65},
+		},
+		{
+			name: "DateTime without an EXIF IFD",
+			data: buildTIFF(binary.LittleEndian, []testTIFFField{
+				{tag: tagDateTime, typ: 2, str: "2021:12:24 08:00:00"},
+				{tag: tagOrientation, typ: 4, nums: []uint32{8}},
+			}),
+			orientation: 8,
+			taken:       time.Date(2021, 12, 24, 8, 0, 0, 0, time.Local),
+		},
+		{
+			name: "invalid values",
+			data: buildTIFF(binary.LittleEndian,
+				[]testTIFFField{
+					{tag: tagOrientation, typ: 3, nums: []uint32{9}},
+					{tag: tagDateTime, typ: 2, str: "0000:00:00 00:00:00"},
+					{tag: tagModel, typ: 3, nums: []uint32{1}},
+					{tag: tagGPSIFD, ifd: 1},
+				},
+				[]testTIFFField{
+					// A zero denominator and no longitude.
+					{tag: tagGPSLatitude, typ: 5, nums: []uint32{52, 0, 0, 1, 0, 1}},
+				}),
+			orientation: 1,
+		},
+		{
+			name:        "sub IFD beyond the data",
+			data:        buildTIFF(binary.BigEndian, []testTIFFField{{tag: tagExifIFD, typ: 4, nums: []uint32{0xFFFFFF00}}}),
+			orientation: 1,
+		},
+		{
+			name: "value offset beyond the data",
+			data: func() []byte {
+				data := buildTIFF(binary.LittleEndian, []testTIFFField{{tag: tagModel, typ: 2, str: "Camera model"}})
+				binary.LittleEndian.PutUint32(data[18:], 0x7FFFFFFF)
+				return data
+			}(),
+			orientation: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parseEXIF(tt.data)
+			if err != nil {
+				t.Fatalf("parseEXIF() error = %v", err)
+			}
+			if info.Orientation != tt.orientation {
+				t.Errorf("Orientation = %d, want %d", info.Orientation, tt.orientation)
+			}
+			if !info.Taken.Equal(tt.taken) {
+				t.Errorf("Taken = %v, want %v", info.Taken, tt.taken)
+			}
+			if got := info.Camera(); got != tt.camera {
+				t.Errorf("Camera() = %q, want %q", got, tt.camera)
+			}
+			switch {
+			case tt.gps == nil && info.GPS != nil:
+				t.Errorf("GPS = %+v, want none", *info.GPS)
+			case tt.gps != nil && info.GPS == nil:
+				t.Errorf("GPS = none, want %+v", *tt.gps)
+			case tt.gps != nil && (math.Abs(info.GPS.Latitude-tt.gps.Latitude) > 1e-9 || math.Abs(info.GPS.Longitude-tt.gps.Longitude) > 1e-9):
+				t.Errorf("GPS = %+v, want %+v", *info.GPS, *tt.gps)
+			}
+		})
+	}
+}
+
+func TestParseEXIFMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("II*\x00")},
+		{"unknown byte order", []byte("XX\x2a\x00\x08\x00\x00\x00\x00\x00")},
+		{"bad magic", []byte("II\x2b\x00\x08\x00\x00\x00\x00\x00")},
+		{"IFD beyond the data", []byte("MM\x00\x2a\xff\xff\xff\xf0")},
+	}
+	for _, tt := range tests {
+		if _, err := parseEXIF(tt.data); !errors.Is(err, errNoEXIF) {
+			t.Errorf("%s: parseEXIF() error = %v, want %v", tt.name, err, errNoEXIF)
+		}
+	}
+	// Cut off anywhere, the data must not make the parser read out of
+	// bounds.
+	data := testEXIF(binary.BigEndian)
+	for n := range data {
+		parseEXIF(data[:n])
+	}
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+func pngChunk(typ string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, payload...)
+	return append(chunk, 0, 0, 0, 0) // The CRC isn't checked
+}
+
+func webpChunk(typ string, payload []byte) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(typ), uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+}
+
+func joinBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestFindEXIF(t *testing.T) {
+	tiff := testEXIF(binary.LittleEndian)
+	soi := []byte{0xFF, 0xD8}
+	jfif := jpegSegment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	exif := jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+	xmp := jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	sos := []byte{0xFF, 0xDA, 0x00, 0x08, 1, 2, 3, 4, 5, 6}
+	pngSignature := []byte("\x89PNG\r\n\x1a\n")
+	ihdr := pngChunk("IHDR", make([]byte, 13))
+	idat := pngChunk("IDAT", []byte{1, 2, 3})
+	vp8x := webpChunk("VP8X", make([]byte, 10))
+
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"JPEG", joinBytes(soi, jfif, exif, sos), tiff},
+		{"JPEG with XMP first", joinBytes(soi, xmp, exif, sos), tiff},
+		{"JPEG with fill bytes", joinBytes(soi, []byte{0xFF, 0xFF}, exif), tiff},
+		{"JPEG without EXIF", joinBytes(soi, jfif, xmp, sos), nil},
+		{"JPEG with EXIF after the scan", joinBytes(soi, jfif, sos, exif), nil},
+		{"JPEG with a segment past the end", joinBytes(soi, jpegSegment(0xE1, []byte("Exif\x00\x00"))[:4], []byte("Exif")), nil},
+		{"JPEG with a short segment length", joinBytes(soi, []byte{0xFF, 0xE1, 0x00, 0x01}, exif), nil},
+		{"JPEG without a marker", joinBytes(soi, []byte{0x00, 0xE1, 0x00, 0x10}, exif), nil},
+		{"PNG", joinBytes(pngSignature, ihdr, pngChunk("eXIf", tiff), idat), tiff},
+		{"PNG with EXIF after the image data", joinBytes(pngSignature, ihdr, idat, pngChunk("eXIf", tiff)), nil},
+		{"PNG with a chunk past the end", joinBytes(pngSignature, ihdr, pngChunk("eXIf", tiff)[:20]), nil},
+		{"WebP", webpFile(vp8x, webpChunk("EXIF", tiff)), tiff},
+		{"WebP with an Exif prefix", webpFile(vp8x, webpChunk("EXIF", append([]byte("Exif\x00\x00"), tiff...))), tiff},
+		{"WebP after an odd sized chunk", webpFile(webpChunk("ICCP", []byte{1, 2, 3}), webpChunk("EXIF", tiff)), tiff},
+		{"WebP with a chunk past the end", webpFile(vp8x, webpChunk("EXIF", tiff)[:20]), nil},
+		{"GIF", []byte("GIF89a\x01\x00\x01\x00"), nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findEXIF(tt.data); !bytes.Equal(got, tt.want) {
+				t.Errorf("findEXIF() = %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+
+	// Every prefix of a valid file is handled, with or without EXIF data.
+	for _, data := range [][]byte{joinBytes(soi, jfif, exif), joinBytes(pngSignature, ihdr, pngChunk("eXIf", tiff)), webpFile(vp8x, webpChunk("EXIF", tiff))} {
+		for n := range data {
+			if tiff := findEXIF(data[:n]); tiff != nil {
+				parseEXIF(tiff)
+			}
+		}
+	}
+}
+
+func TestExifFromHeadNoEXIF(t *testing.T) {
+	if _, err := exifFromHead([]byte{0xFF, 0xD8, 0xFF, 0xD9}); !errors.Is(err, errNoEXIF) {
+		t.Errorf("exifFromHead() error = %v, want %v", err, errNoEXIF)
+	}
+}
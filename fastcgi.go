@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal FastCGI responder client: one request per connection, no
+// multiplexing, as spoken by php-fpm and similar application servers.
+
+const (
+	fcgiVersion       = 1
+	fcgiBeginRequest  = 1
+	fcgiEndRequest    = 3
+	fcgiParams        = 4
+	fcgiStdin         = 5
+	fcgiStdout        = 6
+	fcgiStderr        = 7
+	fcgiRoleResponder = 1
+	fcgiRequestID     = 1
+	fcgiMaxContent    = 65535
+)
+
+// writeFCGIRecords writes content as records of recType, split at the
+// maximum record size. Empty content writes a single empty record, which
+// terminates a stream.
+func writeFCGIRecords(w io.Writer, recType uint8, content []byte) error {
+	for {
+		chunk := content
+		if len(chunk) > fcgiMaxContent {
+			chunk = chunk[:fcgiMaxContent]
+		}
+		padding := -len(chunk) & 7
+		header := [8]byte{fcgiVersion, recType, 0, fcgiRequestID, 0, 0, byte(padding), 0}
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(chunk)))
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if _, err := w.Write(make([]byte, padding)); err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+func appendFCGILength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+func encodeFCGIParams(params map[string]string) []byte {
+	var b []byte
+	for name, value := range params {
+		b = appendFCGILength(b, len(name))
+		b = appendFCGILength(b, len(value))
+		b = append(b, name...)
+		b = append(b, value...)
+	}
+	return b
+}
+
+// fcgiStdoutReader returns the STDOUT stream of a FastCGI response, logging
+// STDERR output and stopping at END_REQUEST.
+type fcgiStdoutReader struct {
+	r       *bufio.Reader
+	pending []byte
+	script  string
+	done    bool
+}
+
+func (fr *fcgiStdoutReader) Read(p []byte) (int, error) {
+	for len(fr.pending) == 0 {
+		if fr.done {
+			return 0, io.EOF
+		}
+		var header [8]byte
+		if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+			return 0, err
+		}
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:6]))+int(header[6]))
+		if _, err := io.ReadFull(fr.r, content); err != nil {
+			return 0, err
+		}
+		content = content[:len(content)-int(header[6])]
+		switch header[1] {
+		case fcgiStdout:
+			fr.pending = content
+		case fcgiStderr:
+			if len(content) > 0 {
+				log.Printf("FastCGI %s: %s", fr.script, strings.TrimSpace(string(content)))
+			}
+		case fcgiEndRequest:
+			fr.done = true
+		}
+	}
+	n := copy(p, fr.pending)
+	fr.pending = fr.pending[n:]
+	return n, nil
+}
+
+// fastCGIParams builds the CGI/1.1 meta-variables for a request.
+func (s *Server) fastCGIParams(r *http.Request, fullPath, scriptName, pathInfo string) map[string]string {
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "serve",
+		"SERVER_PROTOCOL":   r.Proto,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   fullPath,
+		"PATH_INFO":         pathInfo,
+		"DOCUMENT_ROOT":     s.rootDir,
+		"REDIRECT_STATUS":   "200",
+	}
+	if host, port, err := net.SplitHostPort(r.Host); err == nil {
+		params["SERVER_NAME"], params["SERVER_PORT"] = host, port
+	} else {
+		params["SERVER_NAME"] = r.Host
+	}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		params["REMOTE_ADDR"], params["REMOTE_PORT"] = host, port
+	}
+	if r.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+	if r.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		params["CONTENT_TYPE"] = contentType
+	}
+	for name, values := range r.Header {
+		upper := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		// HTTP_PROXY would be mistaken for proxy configuration (httpoxy).
+		if upper == "PROXY" || upper == "CONTENT_TYPE" || upper == "CONTENT_LENGTH" {
+			continue
+		}
+		params["HTTP_"+upper] = strings.Join(values, ", ")
+	}
+	return params
+}
+
+// serveFastCGI forwards the request to the FastCGI server of rule and writes
+// its response. The whole exchange is bounded by the script timeout.
+func (s *Server) serveFastCGI(w http.ResponseWriter, r *http.Request, rule scriptRule, fullPath, scriptName, pathInfo string) {
+	conn, err := net.DialTimeout(rule.fcgiNetwork, rule.fcgiAddress, 10*time.Second)
+	if err != nil {
+		log.Printf("Error connecting to FastCGI server %s: %v", rule.fcgiAddress, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(s.scriptTimeout)); err != nil {
+		log.Printf("Error setting FastCGI deadline: %v", err)
+	}
+
+	bw := bufio.NewWriter(conn)
+	begin := []byte{0, fcgiRoleResponder, 0, 0, 0, 0, 0, 0}
+	err = writeFCGIRecords(bw, fcgiBeginRequest, begin)
+	if err == nil {
+		if params := encodeFCGIParams(s.fastCGIParams(r, fullPath, scriptName, pathInfo)); len(params) > 0 {
+			err = writeFCGIRecords(bw, fcgiParams, params)
+		}
+	}
+	if err == nil {
+		err = writeFCGIRecords(bw, fcgiParams, nil)
+	}
+	if err == nil && r.Body != nil {
+		buf := make([]byte, fcgiMaxContent)
+		for err == nil {
+			n, readErr := r.Body.Read(buf)
+			if n > 0 {
+				err = writeFCGIRecords(bw, fcgiStdin, buf[:n])
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil && err == nil {
+				err = readErr
+			}
+		}
+	}
+	if err == nil {
+		err = writeFCGIRecords(bw, fcgiStdin, nil)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Printf("Error sending request to FastCGI server %s: %v", rule.fcgiAddress, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	body := bufio.NewReader(&fcgiStdoutReader{r: bufio.NewReader(conn), script: fullPath})
+	header, err := textproto.NewReader(body).ReadMIMEHeader()
+	if err != nil {
+		log.Printf("Error reading FastCGI response for %s: %v", fullPath, err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			return
+		}
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	status := http.StatusOK
+	if statusLine := header.Get("Status"); statusLine != "" {
+		code, _, _ := strings.Cut(statusLine, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			log.Printf("FastCGI %s: invalid Status header %q", fullPath, statusLine)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for name, values := range header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Error copying FastCGI response for %s: %v", fullPath, err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/xml"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// podcastFeedPrefix is the route of podcast feeds, /feed/podcast/<path>.
+	podcastFeedPrefix = "/feed/podcast"
+	maxEpisodeTags    = 50000 // episode tags kept in memory
+)
+
+// podcastCoverNames are the folder artwork files, in order of preference.
+var podcastCoverNames = []string{"cover.jpg", "cover.jpeg", "cover.png", "folder.jpg", "folder.png"}
+
+// audioMIMETypes are the enclosure types of audio files; the mime package
+// only knows a few of them without the system's tables.
+var audioMIMETypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
+	".wma":  "audio/x-ms-wma",
+	".opus": "audio/ogg",
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title          string       `xml:"title"`
+	Link           string       `xml:"link"`
+	Description    string       `xml:"description"`
+	Self           rssAtomLink  `xml:"atom:link"`
+	LastBuildDate  string       `xml:"lastBuildDate,omitempty"`
+	Generator      string       `xml:"generator"`
+	Image          *rssImage    `xml:"image,omitempty"`
+	ITunesImage    *itunesImage `xml:"itunes:image,omitempty"`
+	ITunesAuthor   string       `xml:"itunes:author,omitempty"`
+	ITunesType     string       `xml:"itunes:type"`
+	ITunesExplicit string       `xml:"itunes:explicit"`
+	Items          []rssItem    `xml:"item"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title          string       `xml:"title"`
+	Enclosure      rssEnclosure `xml:"enclosure"`
+	GUID           rssGUID      `xml:"guid"`
+	PubDate        string       `xml:"pubDate"`
+	ITunesAuthor   string       `xml:"itunes:author,omitempty"`
+	ITunesDuration int          `xml:"itunes:duration,omitempty"` // Seconds
+	ITunesEpisode  int          `xml:"itunes:episode,omitempty"`
+	date           time.Time
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// podcastCover returns the folder's artwork file, relative to rootDir.
+func podcastCover(rootDir, relativePath string) (string, bool) {
+	entries, err := os.ReadDir(resolveInRoot(rootDir, relativePath))
+	if err != nil {
+		return "", false
+	}
+	for _, name := range podcastCoverNames {
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), name) && entry.Type().IsRegular() {
+				return path.Join(relativePath, entry.Name()), true
+			}
+		}
+	}
+	return "", false
+}
+
+// episodeTags are the tags of an episode, cached by size and modification
+// time. tags is nil for files without any.
+type episodeTags struct {
+	size    int64
+	modTime time.Time
+	tags    *audioTags
+}
+
+// episodeTagsFor returns the tags of an audio file, reading them unless the
+// cached copy matches the file's size and modification time.
+func (s *Server) episodeTagsFor(fullPath string, size int64, modTime time.Time) *audioTags {
+	s.feedMu.Lock()
+	cached, ok := s.feedTags[fullPath]
+	s.feedMu.Unlock()
+	if ok && cached.size == size && cached.modTime.Equal(modTime) {
+		return cached.tags
+	}
+	tags, err := readAudioTags(fullPath, false)
+	if err != nil && err != errNoAudioTags {
+		log.Printf("Podcast feed: error reading tags of %s: %v", fullPath, err)
+	}
+	s.feedMu.Lock()
+	if len(s.feedTags) >= maxEpisodeTags {
+		clear(s.feedTags)
+	}
+	s.feedTags[fullPath] = episodeTags{size: size, modTime: modTime, tags: tags}
+	s.feedMu.Unlock()
+	return tags
+}
+
+// podcastEpisode describes an audio file as a feed item. Titles, authors
+// and dates come from the file's tags when it has them, otherwise from its
+// name and modification time.
+func (s *Server) podcastEpisode(rel, fileURL string) (rssItem, error) {
+	fullPath := resolveInRoot(s.rootDir, rel)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return rssItem{}, err
+	}
+	name := path.Base(rel)
+	ext := strings.ToLower(path.Ext(name))
+	item := rssItem{
+		Title: strings.TrimSuffix(name, path.Ext(name)),
+		Enclosure: rssEnclosure{
+			URL:    fileURL,
+			Length: info.Size(),
+			Type:   cmp.Or(audioMIMETypes[ext], mime.TypeByExtension(ext), "application/octet-stream"),
+		},
+		GUID: rssGUID{Value: rel},
+		date: info.ModTime(),
+	}
+	if tags := s.episodeTagsFor(fullPath, info.Size(), info.ModTime()); tags != nil {
+		item.Title = cmp.Or(tags.Title, item.Title)
+		item.ITunesAuthor = cmp.Or(tags.Artist, tags.AlbumArtist)
+		item.ITunesDuration = int(tags.Duration.Round(time.Second).Seconds())
+		item.ITunesEpisode = tags.Track
+		if !tags.Date.IsZero() {
+			item.date = tags.Date
+		}
+	}
+	item.PubDate = item.date.Format(time.RFC1123Z)
+	return item, nil
+}
+
+// handlePodcastFeed serves the audio files of a directory as an RSS 2.0
+// podcast feed with iTunes tags, newest first:
+//
+//	/feed/podcast/<path>?recursive=true
+//
+// When auth is enabled, opening the feed with the session cookie redirects
+// to its URL with a feed token, which podcast apps can subscribe to. The
+// enclosures and artwork carry the same token. Access tokens of playlists
+// don't open feeds, so they can't be traded for a token that never expires.
+func handlePodcastFeed(s *Server, w http.ResponseWriter, r *http.Request) {
+	relativePath := strings.Trim(path.Clean("/"+strings.TrimPrefix(r.URL.Path, podcastFeedPrefix)), "/")
+	info, err := os.Stat(resolveInRoot(s.rootDir, relativePath))
+	if err != nil || !info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	var token string
+	if s.authEnabled {
+		// Feed tokens are only minted for signed-in users. Other requests got
+		// here with a feed token for the path, which the feed passes on.
+		if !s.tokenAllows(podcastFeedPrefix, feedTokens, r.URL) {
+			if !s.hasSession(r) {
+				http.Redirect(w, r, s.basePath+"/login", http.StatusFound)
+				return
+			}
+			query.Set(accessTokenParam, s.feedToken(relativePath))
+			http.Redirect(w, r, s.basePath+(&url.URL{Path: r.URL.Path, RawQuery: query.Encode()}).String(), http.StatusFound)
+			return
+		}
+		token = "?" + accessTokenParam + "=" + url.QueryEscape(query.Get(accessTokenParam))
+	}
+	recursive, _ := strconv.ParseBool(query.Get("recursive"))
+	files, err := collectPlaylist(s.rootDir, relativePath, recursive, map[string]bool{"audio": true}, "name", "", maxPlaylistEntries)
+	if err != nil {
+		log.Printf("Error getting podcast feed for path '%s': %v", relativePath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	origin := requestOrigin(r) + s.basePath
+	title := path.Base("/" + relativePath)
+	if title == "/" {
+		title = "Serve"
+	}
+	channel := rssChannel{
+		Title:          title,
+		Link:           origin + (&url.URL{Path: "/browse/" + relativePath}).EscapedPath(),
+		Description:    "Audio files in " + title,
+		Self:           rssAtomLink{Href: origin + (&url.URL{Path: r.URL.Path, RawQuery: query.Encode()}).String(), Rel: "self", Type: "application/rss+xml"},
+		Generator:      "serve",
+		ITunesType:     "episodic",
+		ITunesExplicit: "false",
+		Items:          []rssItem{},
+	}
+	authors := make(map[string]int)
+	for _, file := range files {
+		item, err := s.podcastEpisode(file, origin+filesURL(file)+token)
+		if err != nil {
+			continue
+		}
+		if item.ITunesAuthor != "" {
+			authors[item.ITunesAuthor]++
+		}
+		channel.Items = append(channel.Items, item)
+	}
+	slices.SortStableFunc(channel.Items, func(a, b rssItem) int {
+		return b.date.Compare(a.date)
+	})
+	if len(channel.Items) > 0 {
+		channel.LastBuildDate = channel.Items[0].PubDate
+	}
+	// The channel is credited to the artist of most of its episodes.
+	for author, n := range authors {
+		if n > authors[channel.ITunesAuthor] || (n == authors[channel.ITunesAuthor] && author < channel.ITunesAuthor) {
+			channel.ITunesAuthor = author
+		}
+	}
+	if cover, ok := podcastCover(s.rootDir, relativePath); ok {
+		coverURL := origin + filesURL(cover) + token
+		channel.Image = &rssImage{URL: coverURL, Title: channel.Title, Link: channel.Link}
+		channel.ITunesImage = &itunesImage{Href: coverURL}
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		ITunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: channel,
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		log.Printf("Error encoding podcast feed for path '%s': %v", relativePath, err)
+		http.Error(w, "Error encoding feed", http.StatusInternalServerError)
+		return
+	}
+	buf.WriteString("\n")
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Error writing podcast feed for path '%s': %v", relativePath, err)
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"crypto/rand"
 	"errors"
-	"math/big"
+	"html/template"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -20,13 +19,30 @@ type FileInfo struct {
 	ModTime time.Time `json:"modTime"`
 	IsDir   bool      `json:"isDir"`
 	Path    string    `json:"path"`
+
+	Subtitles []subtitleTrack   `json:"subtitles,omitempty"` // For videos, filled in by the API
+	Progress  *playbackProgress `json:"progress,omitempty"`  // Playback position, filled in by the API
 }
 
 type DirectoryData struct {
-	Files       []FileInfo `json:"files"`
-	CurrentPath string     `json:"currentPath"`
-	ParentPath  string     `json:"parentPath"`
-	HasParent   bool       `json:"hasParent"`
+	Files       []FileInfo    `json:"files"`
+	CurrentPath string        `json:"currentPath"`
+	ParentPath  string        `json:"parentPath"`
+	HasParent   bool          `json:"hasParent"`
+	Readme      template.HTML `json:"readme,omitempty"` // Rendered README.md, filled in by the API
+}
+
+// resolveInRoot maps a slash separated path onto the filesystem below rootDir.
+// The path is cleaned as if rooted at "/", so it can never climb above rootDir.
+func resolveInRoot(rootDir string, relativePath string) string {
+	return filepath.Join(rootDir, filepath.FromSlash(path.Clean("/"+relativePath)))
+}
+
+// filesURL returns the escaped /files/ URL of a slash separated path below
+// rootDir.
+func filesURL(relativePath string) string {
+	u := url.URL{Path: "/files" + path.Clean("/"+relativePath)}
+	return u.EscapedPath()
 }
 
 func getDirectoryListing(rootDir string, relativePath string) (*DirectoryData, error) {
@@ -132,55 +148,40 @@ func sortFiles(files []FileInfo, sortBy, order string) {
 	}
 }
 
-func isMediaFile(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
-	mediaExts := []string{
-		".mp3",
-		".wav",
-		".flac",
-		".aac",
-		".ogg",
-		".m4a",
-		".wma",
-		".mp4",
-		".avi",
-		".mkv",
-		".mov",
-		".wmv",
-		".flv",
-		".webm",
-		".m4v",
-		".jpg",
-		".jpeg",
-		".png",
-		".gif",
-		".webp",
-		".svg",
-		".bmp",
-		".tiff",
-	}
-	return slices.Contains(mediaExts, ext)
+// mediaKinds maps the extensions of playable and viewable media to their kind.
+var mediaKinds = map[string]string{
+	".mp3":  "audio",
+	".wav":  "audio",
+	".flac": "audio",
+	".aac":  "audio",
+	".ogg":  "audio",
+	".m4a":  "audio",
+	".wma":  "audio",
+	".opus": "audio",
+	".m4b":  "audio",
+	".mp4":  "video",
+	".avi":  "video",
+	".mkv":  "video",
+	".mov":  "video",
+	".wmv":  "video",
+	".flv":  "video",
+	".webm": "video",
+	".m4v":  "video",
+	".jpg":  "image",
+	".jpeg": "image",
+	".png":  "image",
+	".gif":  "image",
+	".webp": "image",
+	".svg":  "image",
+	".bmp":  "image",
+	".tiff": "image",
 }
 
-func getRandomMediaFile(rootDir string, relativePath string) (string, error) {
-	data, err := getDirectoryListing(rootDir, relativePath)
-	if err != nil {
-		return "", err
-	}
-
-	var mediaFiles []string
-	for _, file := range data.Files {
-		if !file.IsDir && isMediaFile(file.Name) {
-			// file.Path from getDirectoryListing is already the correct /files/... path
-			mediaFiles = append(mediaFiles, file.Path)
-		}
-	}
-
-	if len(mediaFiles) == 0 {
-		return "", errors.New("no media files found")
-	}
+// mediaKind returns "audio", "video" or "image" for media files, or "".
+func mediaKind(filename string) string {
+	return mediaKinds[strings.ToLower(filepath.Ext(filename))]
+}
 
-	n := big.NewInt(int64(len(mediaFiles)))
-	i, _ := rand.Int(rand.Reader, n)
-	return mediaFiles[i.Int64()], nil
+func isMediaFile(filename string) bool {
+	return mediaKind(filename) != ""
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxGalleryImages = 5000  // images returned by one /api/gallery request
+	maxGalleryMeta   = 50000 // image metadata entries kept in memory
+	galleryWorkers   = 8     // files read concurrently for metadata
+)
+
+// galleryImage is one image of a /api/gallery response.
+type galleryImage struct {
+	Name    string       `json:"name"`
+	Path    string       `json:"path"`            // Relative to rootDir, for /api/thumb
+	URL     string       `json:"url"`             // The /files/ link from the listing
+	Thumb   string       `json:"thumb,omitempty"` // /api/thumb URL without a size, for decodable images
+	Size    int64        `json:"size"`
+	ModTime time.Time    `json:"modTime"`
+	Width   int          `json:"width,omitempty"`
+	Height  int          `json:"height,omitempty"` // As displayed, after EXIF orientation
+	Taken   *time.Time   `json:"taken,omitempty"`
+	Camera  string       `json:"camera,omitempty"`
+	GPS     *gpsPosition `json:"gps,omitempty"`
+}
+
+// galleryGroup is a run of consecutive images taken on the same day.
+type galleryGroup struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+type galleryResponse struct {
+	Path      string         `json:"path"`
+	Images    []galleryImage `json:"images"`
+	Groups    []galleryGroup `json:"groups,omitempty"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// imageMeta is the information read from an image file, cached by size and
+// modification time.
+type imageMeta struct {
+	size    int64
+	modTime time.Time
+	width   int
+	height  int
+	taken   time.Time
+	camera  string
+	gps     *gpsPosition
+}
+
+// readImageMeta reads the dimensions and EXIF data of an image. Formats Go
+// cannot decode are returned without dimensions.
+func readImageMeta(fullPath string) imageMeta {
+	var meta imageMeta
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return meta
+	}
+	defer file.Close()
+	head, err := readHead(file)
+	if err != nil {
+		return meta
+	}
+	orientation := 1
+	if info, err := exifFromHead(head); err == nil {
+		orientation = info.Orientation
+		meta.taken = info.Taken
+		meta.camera = info.Camera()
+		meta.gps = info.GPS
+	}
+	if isThumbnailable(fullPath) {
+		config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), file))
+		if err == nil {
+			meta.width, meta.height = config.Width, config.Height
+			if orientation >= 5 {
+				meta.width, meta.height = meta.height, meta.width
+			}
+		}
+	}
+	return meta
+}
+
+// imageMetaFor returns the metadata of an image, reading it unless the
+// cached copy matches the file's size and modification time.
+func (s *Server) imageMetaFor(fullPath string, size int64, modTime time.Time) imageMeta {
+	s.galleryMu.Lock()
+	meta, ok := s.galleryMeta[fullPath]
+	s.galleryMu.Unlock()
+	if ok && meta.size == size && meta.modTime.Equal(modTime) {
+		return meta
+	}
+	meta = readImageMeta(fullPath)
+	meta.size, meta.modTime = size, modTime
+	s.galleryMu.Lock()
+	if len(s.galleryMeta) >= maxGalleryMeta {
+		clear(s.galleryMeta)
+	}
+	s.galleryMeta[fullPath] = meta
+	s.galleryMu.Unlock()
+	return meta
+}
+
+// collectGalleryImages lists the images in relativePath, and below it when
+// recursive is set, skipping hidden directories. It stops after
+// maxGalleryImages and reports whether it did.
+func collectGalleryImages(rootDir, relativePath string, recursive bool) ([]galleryImage, bool, error) {
+	images := []galleryImage{}
+	var walk func(dir string) (bool, error)
+	walk = func(dir string) (bool, error) {
+		data, err := getDirectoryListing(rootDir, dir)
+		if err != nil {
+			return false, err
+		}
+		current := filepath.ToSlash(data.CurrentPath)
+		for _, file := range data.Files {
+			if file.IsDir {
+				if !recursive || strings.HasPrefix(file.Name, ".") {
+					continue
+				}
+				if truncated, err := walk(path.Join(current, file.Name)); err != nil {
+					log.Printf("Error listing '%s' for gallery: %v", path.Join(current, file.Name), err)
+				} else if truncated {
+					return true, nil
+				}
+				continue
+			}
+			if mediaKind(file.Name) != "image" {
+				continue
+			}
+			if len(images) >= maxGalleryImages {
+				return true, nil
+			}
+			images = append(images, galleryImage{
+				Name:    file.Name,
+				Path:    path.Join(current, file.Name),
+				URL:     file.Path,
+				Size:    file.Size,
+				ModTime: file.ModTime,
+			})
+		}
+		return false, nil
+	}
+	truncated, err := walk(relativePath)
+	return images, truncated, err
+}
+
+// fillGalleryMetadata adds dimensions, EXIF data and thumbnail URLs to images.
+func (s *Server) fillGalleryMetadata(images []galleryImage) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(galleryWorkers, len(images)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				img := &images[i]
+				fullPath := resolveInRoot(s.rootDir, img.Path)
+				meta := s.imageMetaFor(fullPath, img.Size, img.ModTime)
+				img.Width, img.Height = meta.width, meta.height
+				img.Camera, img.GPS = meta.camera, meta.gps
+				if !meta.taken.IsZero() {
+					img.Taken = &meta.taken
+				}
+				if isThumbnailable(fullPath) {
+					img.Thumb = "/api/thumb?" + url.Values{
+						"path": {img.Path},
+						"v":    {strconv.FormatInt(img.ModTime.UnixNano(), 36)},
+					}.Encode()
+				}
+			}
+		}()
+	}
+	for i := range images {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// galleryDate is when an image was taken, or last modified without EXIF.
+func (img *galleryImage) galleryDate() time.Time {
+	if img.Taken != nil {
+		return *img.Taken
+	}
+	return img.ModTime
+}
+
+// handleGallery lists the images of a directory with their metadata:
+//
+//	/api/gallery?path=photos&recursive=true&group=date&sort=date&order=desc
+//
+// Images are sorted by capture date (newest first) unless sort=name. With
+// group=date, groups gives the number of consecutive images per day.
+func handleGallery(s *Server, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	relativePath := query.Get("path")
+	recursive, _ := strconv.ParseBool(query.Get("recursive"))
+	images, truncated, err := collectGalleryImages(s.rootDir, relativePath, recursive)
+	if err != nil {
+		log.Printf("Error getting gallery for path '%s': %v", relativePath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.fillGalleryMetadata(images)
+
+	desc := query.Get("order") != "asc"
+	if query.Get("sort") == "name" {
+		desc = query.Get("order") == "desc"
+		sort.SliceStable(images, func(i, j int) bool {
+			if desc {
+				return images[i].Path > images[j].Path
+			}
+			return images[i].Path < images[j].Path
+		})
+	} else {
+		sort.SliceStable(images, func(i, j int) bool {
+			if desc {
+				return images[i].galleryDate().After(images[j].galleryDate())
+			}
+			return images[i].galleryDate().Before(images[j].galleryDate())
+		})
+	}
+
+	response := galleryResponse{
+		Path:      filepath.ToSlash(filepath.Clean("/" + relativePath))[1:],
+		Images:    images,
+		Truncated: truncated,
+	}
+	if query.Get("group") == "date" {
+		for i := range images {
+			date := images[i].galleryDate().Format(time.DateOnly)
+			if n := len(response.Groups); n > 0 && response.Groups[n-1].Date == date {
+				response.Groups[n-1].Count++
+			} else {
+				response.Groups = append(response.Groups, galleryGroup{Date: date, Count: 1})
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding gallery response for path '%s': %v", relativePath, err)
+	}
+}
@@ -3,9 +3,18 @@ module github.com/elliot40404/serve
 go 1.24.0
 
 require (
+	github.com/alecthomas/chroma/v2 v2.23.1
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
+	github.com/pkg/sftp v1.13.9
+	github.com/yuin/goldmark v1.7.13
 	golang.org/x/crypto v0.38.0
+	golang.org/x/image v0.30.0
 )
 
-require golang.org/x/sys v0.33.0 // indirect
+require (
+	github.com/dlclark/regexp2 v1.11.5 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+)
@@ -5,14 +5,20 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// hasSession reports whether r carries the cookie of a signed-in session.
+func (s *Server) hasSession(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookieName)
+	return err == nil && s.isValidSession(cookie.Value)
+}
+
 func authMiddleware(s *Server, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !s.authEnabled {
@@ -20,8 +26,7 @@ func authMiddleware(s *Server, next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		cookie, err := r.Cookie(sessionCookieName)
-		if err == nil && s.isValidSession(cookie.Value) {
+		if s.hasSession(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -40,7 +45,7 @@ func authMiddleware(s *Server, next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 		// For other requests (HTML pages, /static/ for main UI), redirect to login
-		http.Redirect(w, r, "/login", http.StatusFound)
+		http.Redirect(w, r, s.basePath+"/login", http.StatusFound)
 	}
 }
 
@@ -48,7 +53,7 @@ func handleLoginGet(s *Server, w http.ResponseWriter, r *http.Request) {
 	if s.authEnabled {
 		cookie, err := r.Cookie(sessionCookieName)
 		if err == nil && s.isValidSession(cookie.Value) {
-			http.Redirect(w, r, "/", http.StatusFound)
+			http.Redirect(w, r, s.basePath+"/", http.StatusFound)
 			return
 		}
 	}
@@ -62,7 +67,7 @@ func handleLoginGet(s *Server, w http.ResponseWriter, r *http.Request) {
 
 func handleLoginPost(s *Server, w http.ResponseWriter, r *http.Request) {
 	if !s.authEnabled { // Should not happen if routes are set up correctly
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, s.basePath+"/", http.StatusFound)
 		return
 	}
 
@@ -84,7 +89,7 @@ func handleLoginPost(s *Server, w http.ResponseWriter, r *http.Request) {
 			SameSite: http.SameSiteLaxMode,
 			// Secure: true, // Uncomment if serving over HTTPS
 		})
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, s.basePath+"/", http.StatusFound)
 		return
 	}
 
@@ -101,7 +106,7 @@ func handleLoginPost(s *Server, w http.ResponseWriter, r *http.Request) {
 
 func handleLogout(s *Server, w http.ResponseWriter, r *http.Request) {
 	if !s.authEnabled {
-		http.Redirect(w, r, "/", http.StatusFound)
+		http.Redirect(w, r, s.basePath+"/", http.StatusFound)
 		return
 	}
 	cookie, err := r.Cookie(sessionCookieName)
@@ -117,7 +122,7 @@ func handleLogout(s *Server, w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 		// Secure: true, // Uncomment if serving over HTTPS
 	})
-	http.Redirect(w, r, "/login", http.StatusFound)
+	http.Redirect(w, r, s.basePath+"/login", http.StatusFound)
 }
 
 // Existing handlers (handleIndex, handleBrowse, handleAPI, etc.)
@@ -136,11 +141,16 @@ func logRequest(next http.Handler) http.Handler {
 	})
 }
 
-func handleIndex(s *Server, w http.ResponseWriter, _ *http.Request) {
-	data := map[string]any{
+// indexData is the data of index.html, shared by / and /browse/.
+func (s *Server) indexData() map[string]any {
+	return map[string]any{
 		"RandomMediaEnabled": s.randomBtn,
+		"ProgressEnabled":    s.progress != nil,
 	}
-	err := s.template.Execute(w, data)
+}
+
+func handleIndex(s *Server, w http.ResponseWriter, _ *http.Request) {
+	err := s.template.Execute(w, s.indexData())
 	if err != nil {
 		log.Printf("Template error on /: %v", err)
 		http.Error(w, "Error rendering template", http.StatusInternalServerError)
@@ -148,7 +158,7 @@ func handleIndex(s *Server, w http.ResponseWriter, _ *http.Request) {
 }
 
 func handleBrowse(s *Server, w http.ResponseWriter, _ *http.Request) {
-	err := s.template.Execute(w, nil)
+	err := s.template.Execute(w, s.indexData())
 	if err != nil {
 		log.Printf("Template error on /browse/: %v", err)
 		http.Error(w, "Error rendering template", http.StatusInternalServerError)
@@ -157,6 +167,16 @@ func handleBrowse(s *Server, w http.ResponseWriter, _ *http.Request) {
 
 func handleAPI(s *Server, w http.ResponseWriter, r *http.Request) {
 	relativePath := r.URL.Query().Get("path")
+	// The watcher bumps the directory version on every change, so an
+	// unchanged version means the client's copy is still current. Removed
+	// directories lose their version and must not match.
+	etag := s.dirETag(relativePath)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) && isDirectory(resolveInRoot(s.rootDir, relativePath)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	data, err := getDirectoryListing(s.rootDir, relativePath)
 	if err != nil {
 		log.Printf("Error getting directory listing for API path '%s': %v", relativePath, err)
@@ -168,53 +188,17 @@ func handleAPI(s *Server, w http.ResponseWriter, r *http.Request) {
 	if sortBy != "" {
 		sortFiles(data.Files, sortBy, order)
 	}
+	data.Readme = s.renderReadme(data.CurrentPath)
+	attachSubtitles(s.rootDir, data)
+	if s.progress != nil {
+		s.attachProgress(r.URL.Query().Get("user"), data)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		log.Printf("Error encoding API response for path '%s': %v", relativePath, err)
 	}
 }
 
-func handleRandomMedia(s *Server, w http.ResponseWriter, r *http.Request) {
-	relativePath := r.URL.Query().Get("path")
-	mediaFile, err := getRandomMediaFile(s.rootDir, relativePath)
-	if err != nil {
-		log.Printf("Error getting random media for path '%s': %v", relativePath, err)
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-	w.Header().Set("Content-Type", "text/plain")
-	_, err = w.Write([]byte(mediaFile))
-	if err != nil {
-		log.Printf("Error writing response for path '%s': %v", relativePath, err)
-	}
-}
-
-func handleWebSocket(s *Server, w http.ResponseWriter, r *http.Request) {
-	conn, err := s.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket upgrade error:", err)
-		return
-	}
-	defer conn.Close()
-	s.clients[conn] = true
-	log.Printf("Client %s connected via WebSocket", conn.RemoteAddr())
-	defer func() {
-		delete(s.clients, conn)
-		log.Printf("Client %s disconnected from WebSocket", conn.RemoteAddr())
-	}()
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Unexpected WebSocket close error for client %s: %v", conn.RemoteAddr(), err)
-			} else {
-				log.Printf("WebSocket connection closed for client %s", conn.RemoteAddr())
-			}
-			break
-		}
-	}
-}
-
 func handleFiles(s *Server, w http.ResponseWriter, r *http.Request) {
 	relativePath := strings.TrimPrefix(r.URL.Path, "/files/")
 	unescapedPath, err := url.PathUnescape(relativePath)
@@ -235,5 +219,42 @@ func handleFiles(s *Server, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Forbidden: path outside root directory", http.StatusForbidden)
 		return
 	}
+	switch r.URL.Query().Get("view") {
+	case "1":
+		if s.serveFileView(w, r, fullPath) {
+			return
+		}
+	case "tail":
+		if s.serveTailPage(w, fullPath) {
+			return
+		}
+	case "player":
+		if s.servePlayerPage(w, fullPath) {
+			return
+		}
+	}
+	s.serveFile(w, r, fullPath)
+}
+
+// serveFile sends a file below rootDir, applying cache rules, content-hash
+// ETags and precompressed siblings.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, fullPath string) {
+	if s.templates && isPageTemplate(fullPath) {
+		s.servePageTemplate(w, r, fullPath)
+		return
+	}
+	s.applyCacheRules(w, r.URL.Path)
+	if s.fileETags != nil {
+		if info, err := os.Stat(fullPath); err == nil && info.Mode().IsRegular() {
+			if etag, err := s.fileETags.fileETag(fullPath, info); err == nil {
+				w.Header().Set("ETag", etag)
+			} else {
+				log.Printf("Error hashing '%s' for ETag: %v", fullPath, err)
+			}
+		}
+	}
+	if servePrecompressed(w, r, fullPath) {
+		return
+	}
 	http.ServeFile(w, r, fullPath)
 }
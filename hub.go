@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	hubSendQueue     = 32 // messages queued per client before it is dropped as stuck
+	hubWriteTimeout  = 10 * time.Second
+	hubMaxMessage    = 8 << 10
+	maxDeviceNameLen = 64
+	maxDeviceIDLen   = 64
+)
+
+// castPrefixes are the pages a browser may be told to open. Casts stay on
+// this server, so a device can't be sent to arbitrary sites.
+var castPrefixes = []string{"/files/", "/browse/", "/shuffle/"}
+
+// hubClient is one browser connected to /ws. Messages to it are queued and
+// written by its own goroutine, so a slow client doesn't hold up the others.
+type hubClient struct {
+	conn *websocket.Conn
+	send chan []byte
+	id   string // Chosen by the browser, stable across reconnects
+	name string // Friendly device name, empty until registered
+}
+
+// hub keeps the websocket clients and delivers messages to all of them or
+// to one device.
+type hub struct {
+	mu      sync.Mutex
+	clients map[*hubClient]bool
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[*hubClient]bool)}
+}
+
+func (h *hub) add(c *hubClient) {
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+}
+
+// remove forgets c and reports whether it was a registered device.
+func (h *hub) remove(c *hubClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.send)
+	}
+	return c.name != ""
+}
+
+// deliver queues data for c, dropping the client when its queue is full.
+// The caller holds h.mu.
+func (h *hub) deliver(c *hubClient, data []byte) {
+	if !h.clients[c] {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+		log.Printf("Dropping WebSocket client %s: send queue full", c.conn.RemoteAddr())
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// send sends data to c alone.
+func (h *hub) send(c *hubClient, data []byte) {
+	h.mu.Lock()
+	h.deliver(c, data)
+	h.mu.Unlock()
+}
+
+// broadcast sends data to every client.
+func (h *hub) broadcast(data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		h.deliver(c, data)
+	}
+}
+
+// sendTo sends data to the clients registered as device id and reports
+// whether there was one.
+func (h *hub) sendTo(id string, data []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sent := false
+	for c := range h.clients {
+		if c.id == id && c.name != "" {
+			h.deliver(c, data)
+			sent = true
+		}
+	}
+	return sent
+}
+
+// register names c's device and tells every client about the change.
+func (h *hub) register(c *hubClient, id, name string) {
+	h.mu.Lock()
+	c.id, c.name = id, name
+	h.mu.Unlock()
+	h.broadcastDevices()
+}
+
+type hubDevice struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// devices lists the registered devices by name. A device open in several
+// tabs is listed once.
+func (h *hub) devices() []hubDevice {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := make(map[string]bool)
+	devices := []hubDevice{}
+	for c := range h.clients {
+		if c.name != "" && !seen[c.id] {
+			seen[c.id] = true
+			devices = append(devices, hubDevice{ID: c.id, Name: c.name})
+		}
+	}
+	slices.SortFunc(devices, func(a, b hubDevice) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+	return devices
+}
+
+func (h *hub) broadcastDevices() {
+	data, err := json.Marshal(map[string]any{"type": "devices", "devices": h.devices()})
+	if err != nil {
+		log.Printf("Error marshalling devices message: %v", err)
+		return
+	}
+	h.broadcast(data)
+}
+
+// writePump writes c's queued messages until the hub closes its queue or a
+// write fails. Closing the connection ends the client's read loop as well.
+func (c *hubClient) writePump() {
+	defer c.conn.Close()
+	for data := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(hubWriteTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Printf("Error writing message to client %s: %v", c.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// hubMessage is a message from a browser:
+//
+//	{"type": "register", "id": "3f2a…", "name": "Living room TV"}
+//	{"type": "cast", "to": "3f2a…", "url": "/files/movies/movie.mp4?view=player"}
+//	{"type": "party-join", "room": "b71c…", "name": "Alice", "path": "movies/movie.mp4"}
+//	{"type": "party-control", "action": "play|pause|seek", "position": 12.5}
+//	{"type": "party-ping", "clientTime": 1760000000000}
+//	{"type": "party-leave"}
+type hubMessage struct {
+	Type       string  `json:"type"`
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	To         string  `json:"to"`
+	URL        string  `json:"url"`
+	Room       string  `json:"room"`
+	Path       string  `json:"path"`
+	Action     string  `json:"action"`
+	Position   float64 `json:"position"`
+	ClientTime float64 `json:"clientTime"`
+}
+
+// validDeviceID reports whether id is made of letters, digits and dashes,
+// like the ids browsers generate. Ids are passed on to every other client.
+func validDeviceID(id string) bool {
+	if id == "" || len(id) > maxDeviceIDLen {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleHubMessage(c *hubClient, msg hubMessage) {
+	switch msg.Type {
+	case "register":
+		id := strings.TrimSpace(msg.ID)
+		name := strings.TrimSpace(msg.Name)
+		if !validDeviceID(id) || len(name) > maxDeviceNameLen {
+			return
+		}
+		s.hub.register(c, id, name)
+	case "cast":
+		ok := slices.ContainsFunc(castPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(msg.URL, prefix)
+		}) && !strings.ContainsAny(msg.URL, "\\\r\n")
+		if ok {
+			s.hub.mu.Lock()
+			from := c.name
+			s.hub.mu.Unlock()
+			data, err := json.Marshal(map[string]any{"type": "open", "url": msg.URL, "from": from})
+			if err != nil {
+				log.Printf("Error marshalling open message: %v", err)
+				return
+			}
+			ok = s.hub.sendTo(msg.To, data)
+		}
+		if data, err := json.Marshal(map[string]any{"type": "cast-result", "to": msg.To, "ok": ok}); err == nil {
+			s.hub.send(c, data)
+		}
+	case "party-join":
+		s.joinParty(c, msg.Room, msg.Name, msg.Path)
+	case "party-leave":
+		s.leaveParty(c)
+	case "party-control":
+		s.controlParty(c, msg.Action, msg.Position)
+	case "party-ping":
+		s.partyPong(c, msg.ClientTime)
+	}
+}
+
+func handleWebSocket(s *Server, w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(hubMaxMessage)
+	client := &hubClient{conn: conn, send: make(chan []byte, hubSendQueue)}
+	go client.writePump()
+	s.hub.add(client)
+	log.Printf("Client %s connected via WebSocket", conn.RemoteAddr())
+	defer func() {
+		s.leaveParty(client)
+		if s.hub.remove(client) {
+			s.hub.broadcastDevices()
+		}
+		log.Printf("Client %s disconnected from WebSocket", conn.RemoteAddr())
+	}()
+	// Let the new client know the devices it can cast to.
+	if data, err := json.Marshal(map[string]any{"type": "devices", "devices": s.hub.devices()}); err == nil {
+		s.hub.send(client, data)
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Unexpected WebSocket close error for client %s: %v", conn.RemoteAddr(), err)
+			} else {
+				log.Printf("WebSocket connection closed for client %s", conn.RemoteAddr())
+			}
+			break
+		}
+		var msg hubMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		s.handleHubMessage(client, msg)
+	}
+}
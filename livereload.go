@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// liveReloadDebounce is how long the watcher must be quiet before a
+	// reload is sent, so a build touching many files triggers one reload.
+	liveReloadDebounce = 250 * time.Millisecond
+	// liveReloadMaxDelay bounds the wait for a quiet watcher, so a file
+	// written all the time, such as a log, doesn't hold reloads back.
+	liveReloadMaxDelay = 2 * time.Second
+	// liveReloadMaxPaths caps the paths listed in a reload message; beyond
+	// that clients simply reload.
+	liveReloadMaxPaths = 200
+	// liveReloadMaxBody is the largest HTML page the script is injected into.
+	liveReloadMaxBody = 10 << 20
+)
+
+// queueReload records a changed file for the next debounced reload message.
+func (s *Server) queueReload(fullPath string) {
+	rel, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil {
+		return
+	}
+	s.reloadChanges <- "/" + filepath.ToSlash(rel)
+}
+
+// debounceReloads collects changed paths and broadcasts a single "reload"
+// message once no change has arrived for liveReloadDebounce, or at the
+// latest liveReloadMaxDelay after the first change.
+func (s *Server) debounceReloads() {
+	pending := make(map[string]bool)
+	var flush <-chan time.Time
+	var deadline time.Time
+	for {
+		select {
+		case changed := <-s.reloadChanges:
+			if len(pending) == 0 {
+				deadline = time.Now().Add(liveReloadMaxDelay)
+			}
+			pending[changed] = true
+			flush = time.After(min(liveReloadDebounce, time.Until(deadline)))
+		case <-flush:
+			flush = nil
+			msg := map[string]any{"type": "reload"}
+			if len(pending) > liveReloadMaxPaths {
+				msg["all"] = true
+			} else {
+				paths := make([]string, 0, len(pending))
+				for changed := range pending {
+					paths = append(paths, changed)
+				}
+				sort.Strings(paths)
+				msg["paths"] = paths
+			}
+			pending = make(map[string]bool)
+			jsonData, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Error marshalling reload message: %v", err)
+				continue
+			}
+			s.hub.broadcast(jsonData)
+		}
+	}
+}
+
+// liveReloadHandler injects the live reload client into HTML responses of
+// next. prefix is the URL prefix under which rootDir is served, so the client
+// can map changed files onto the URLs of the page and its assets.
+func liveReloadHandler(s *Server, prefix string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.liveReload || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Precompressed HTML cannot be rewritten; the outer compressHandler
+		// has already negotiated the response encoding.
+		r = r.Clone(r.Context())
+		r.Header.Del("Accept-Encoding")
+
+		snippet := fmt.Sprintf(`<script src="%s" data-ws="%s" data-prefix="%s"></script>`,
+			html.EscapeString(s.basePath+assetURL(s.assetHashes, "livereload.js")),
+			html.EscapeString(s.basePath+"/ws"),
+			html.EscapeString(s.basePathFor(prefix)+prefix))
+		iw := &injectingWriter{ResponseWriter: w, snippet: []byte(snippet)}
+		next.ServeHTTP(iw, r)
+		iw.finish()
+	}
+}
+
+// injectingWriter buffers HTML responses and inserts snippet before </body>.
+// Other responses are passed through unchanged.
+type injectingWriter struct {
+	http.ResponseWriter
+	snippet     []byte
+	buf         bytes.Buffer
+	status      int
+	inject      bool
+	wroteHeader bool
+}
+
+func (iw *injectingWriter) WriteHeader(status int) {
+	if iw.wroteHeader {
+		return
+	}
+	iw.wroteHeader = true
+	h := iw.Header()
+	if status == http.StatusOK && strings.HasPrefix(h.Get("Content-Type"), "text/html") && h.Get("Content-Encoding") == "" {
+		iw.inject = true
+		iw.status = status
+		h.Del("Content-Length")
+		return
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *injectingWriter) Write(b []byte) (int, error) {
+	if !iw.wroteHeader {
+		if iw.Header().Get("Content-Type") == "" {
+			iw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		iw.WriteHeader(http.StatusOK)
+	}
+	if !iw.inject {
+		return iw.ResponseWriter.Write(b)
+	}
+	if iw.buf.Len()+len(b) > liveReloadMaxBody {
+		// Too large to rewrite; flush what we have and stream the rest.
+		iw.inject = false
+		iw.ResponseWriter.WriteHeader(iw.status)
+		if _, err := iw.ResponseWriter.Write(iw.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		iw.buf.Reset()
+		return iw.ResponseWriter.Write(b)
+	}
+	return iw.buf.Write(b)
+}
+
+func (iw *injectingWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+func (iw *injectingWriter) finish() {
+	if !iw.inject {
+		return
+	}
+	body := iw.buf.Bytes()
+	if i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>")); i >= 0 {
+		body = append(body[:i:i], append(iw.snippet, body[i:]...)...)
+	} else {
+		body = append(body, iw.snippet...)
+	}
+	iw.ResponseWriter.WriteHeader(iw.status)
+	if _, err := iw.ResponseWriter.Write(body); err != nil {
+		log.Printf("Error writing live reload response: %v", err)
+	}
+}
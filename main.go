@@ -1,21 +1,76 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// stringListFlag collects the values of a flag that may be repeated.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == cgiSupervisorArg {
+		os.Exit(runCGISupervisor(os.Args[2:]))
+	}
+
 	portFlag := flag.String("port", "8080", "Port to listen on")
 	dirFlag := flag.String("dir", "", "Directory to serve (default: current directory)")
 	passwordCmdFlag := flag.String("password", "", "Password to protect UI (takes precedence over SERVE_PASS env var)")
 	passFlag := flag.String("pass", "", "Alias for --password")
 	enableRandomMediaFlag := flag.Bool("enable-random-btn", false, "Enable the 'Play Random Media' feature (or set SERVE_ENABLE_RANDOM_BTN=true)")
+	allowUploadsFlag := flag.Bool("allow-uploads", false, "Allow clients to upload and modify files via SFTP or S3 (or set SERVE_ALLOW_UPLOADS=true)")
+	sftpPortFlag := flag.String("sftp-port", "", "Port for the built-in SFTP server (disabled when empty)")
+	sftpHostKeyFlag := flag.String("sftp-host-key", "", "Path to the SFTP host private key (generated there if missing, ephemeral when empty)")
+	var sftpUserFlags, sftpKeyFlags stringListFlag
+	flag.Var(&sftpUserFlags, "sftp-user", "SFTP user as NAME:BCRYPT_HASH, may be repeated; per-user credentials replace the shared password (or set SERVE_SFTP_USERS, comma separated)")
+	flag.Var(&sftpKeyFlags, "sftp-authorized-keys", "Public keys of an SFTP user as NAME:FILE in authorized_keys format, may be repeated")
+	s3PortFlag := flag.String("s3-port", "", "Port for the S3-compatible API (disabled when empty)")
+	var s3KeyFlags stringListFlag
+	flag.Var(&s3KeyFlags, "s3-key", "S3 credentials as ACCESS_KEY:SECRET_KEY, may be repeated (or set SERVE_S3_KEYS, comma separated)")
+	s3AllowUnsignedFlag := flag.Bool("s3-allow-unsigned-payload", false, "Accept S3 uploads sent as UNSIGNED-PAYLOAD, whose content the request signature doesn't cover")
+	var cacheControlFlags stringListFlag
+	flag.Var(&cacheControlFlags, "cache-control", "Cache-Control rule as PATTERN=VALUE for /files/ and /static/, may be repeated (e.g. '/files/assets/=public, max-age=31536000, immutable')")
+	fileETagsFlag := flag.Bool("file-etags", false, "Send strong content-hash ETags for served files (hashes are cached by size and mtime)")
+	siteFlag := flag.Bool("site", false, "Serve the directory as a website (index.html, clean URLs, 404.html) and move the browse UI under --ui-prefix")
+	spaFlag := flag.Bool("spa", false, "In --site mode, serve the root index.html for unknown routes")
+	uiPrefixFlag := flag.String("ui-prefix", "/_serve", "URL prefix of the browse UI and APIs in --site mode")
+	templatesFlag := flag.Bool("templates", false, "Execute .tmpl and .gohtml files with html/template before serving them")
+	devFlag := flag.Bool("dev", false, "Development mode: show template errors in the browser")
+	liveReloadFlag := flag.Bool("live-reload", false, "Inject a live reload script into HTML pages and reload them when files change")
+	var proxyFlags stringListFlag
+	flag.Var(&proxyFlags, "proxy", "Reverse proxy rule as /PREFIX=URL (e.g. /api=http://127.0.0.1:3000), may be repeated")
+	proxyTimeoutFlag := flag.Duration("proxy-timeout", 30*time.Second, "Timeout for proxied requests")
+	var cgiFlags, fastcgiFlags, cgiEnvFlags stringListFlag
+	flag.Var(&cgiFlags, "cgi", "Run files matching PATTERN as CGI scripts, as PATTERN=INTERPRETER (e.g. '*.py=python3', or '/cgi-bin/*=' to execute them directly), may be repeated")
+	flag.Var(&fastcgiFlags, "fastcgi", "Forward files matching PATTERN to a FastCGI server, as PATTERN=ADDRESS (e.g. '*.php=unix:/run/php/php-fpm.sock' or '*.php=127.0.0.1:9000'), may be repeated")
+	flag.Var(&cgiEnvFlags, "cgi-env", "Name of an environment variable passed on to CGI scripts, may be repeated (only PATH and a few system variables are passed by default)")
+	scriptTimeoutFlag := flag.Duration("cgi-timeout", 30*time.Second, "Timeout for CGI and FastCGI requests")
+	thumbCacheFlag := flag.String("thumb-cache", "", "Directory for cached thumbnails (default: serve/thumbs in the user cache directory)")
+	thumbCacheSizeFlag := flag.Int64("thumb-cache-size", 512, "Maximum size of the thumbnail cache in MB")
+	thumbWorkersFlag := flag.Int("thumb-workers", min(runtime.NumCPU(), 4), "Number of thumbnails rendered at once")
+	progressFileFlag := flag.String("progress-file", "", "JSON file remembering playback positions (default: serve/progress in the user config directory, one file per served directory; \"off\" to disable)")
+	musicLibraryFlag := flag.Bool("music-library", false, "Index the tags of audio files in the background and serve them at /api/music")
 	flag.Parse()
 
 	rootDir := *dirFlag
@@ -54,7 +109,66 @@ func main() {
 		}
 	}
 
-	appServer, err := NewServer(rootDir, effectivePassword, randomMediaEnabled)
+	allowUploads := *allowUploadsFlag
+	if !allowUploads {
+		if enabled, err := strconv.ParseBool(os.Getenv("SERVE_ALLOW_UPLOADS")); err == nil && enabled {
+			allowUploads = true
+		}
+	}
+
+	cacheRules, err := parseCacheRules(cacheControlFlags)
+	if err != nil {
+		log.Printf("Error parsing cache rules: %v", err)
+		return
+	}
+
+	scriptRules, err := parseScriptRules(cgiFlags, fastcgiFlags)
+	if err != nil {
+		log.Printf("Error parsing CGI rules: %v", err)
+		return
+	}
+	for _, rule := range scriptRules {
+		log.Printf("Executing %s", rule)
+	}
+
+	thumbCacheDir := *thumbCacheFlag
+	if thumbCacheDir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = os.TempDir()
+		}
+		thumbCacheDir = filepath.Join(cacheDir, "serve", "thumbs")
+	}
+
+	progressFile := *progressFileFlag
+	switch progressFile {
+	case "off":
+		progressFile = ""
+	case "":
+		progressFile = defaultProgressFile(rootDir)
+	}
+
+	appServer, err := NewServer(rootDir, ServerOptions{
+		Password:        effectivePassword,
+		EnableRandomBtn: randomMediaEnabled,
+		AllowUploads:    allowUploads,
+		CacheRules:      cacheRules,
+		FileETags:       *fileETagsFlag,
+		Site:            *siteFlag,
+		SPA:             *spaFlag,
+		UIPrefix:        *uiPrefixFlag,
+		LiveReload:      *liveReloadFlag,
+		Templates:       *templatesFlag,
+		Dev:             *devFlag,
+		ScriptRules:     scriptRules,
+		ScriptTimeout:   *scriptTimeoutFlag,
+		CGIEnv:          cgiEnvFlags,
+		ThumbCacheDir:   thumbCacheDir,
+		ThumbCacheSize:  *thumbCacheSizeFlag << 20,
+		ThumbWorkers:    *thumbWorkersFlag,
+		MusicLibrary:    *musicLibraryFlag,
+		ProgressFile:    progressFile,
+	})
 	if err != nil {
 		log.Printf("Error creating server: %v", err)
 		return
@@ -65,6 +179,61 @@ func main() {
 		}
 	}()
 
+	if *sftpPortFlag != "" {
+		if len(sftpUserFlags) == 0 && os.Getenv("SERVE_SFTP_USERS") != "" {
+			sftpUserFlags = strings.Split(os.Getenv("SERVE_SFTP_USERS"), ",")
+		}
+		sftpUsers, err := parseSFTPUsers(sftpUserFlags, sftpKeyFlags)
+		if err != nil {
+			log.Printf("Error parsing SFTP users: %v", err)
+			return
+		}
+		sftpServer, err := NewSFTPServer(appServer, *sftpHostKeyFlag, sftpUsers)
+		if err != nil {
+			log.Printf("Error creating SFTP server: %v", err)
+			return
+		}
+		go func() {
+			log.Printf("Starting SFTP server on port %s (uploads allowed: %t)", *sftpPortFlag, allowUploads)
+			if err := sftpServer.ListenAndServe("0.0.0.0:" + *sftpPortFlag); err != nil {
+				log.Printf("SFTP server stopped: %v", err)
+			}
+		}()
+	}
+
+	if *s3PortFlag != "" {
+		if len(s3KeyFlags) == 0 && os.Getenv("SERVE_S3_KEYS") != "" {
+			s3KeyFlags = strings.Split(os.Getenv("SERVE_S3_KEYS"), ",")
+		}
+		s3Keys, err := parseS3Keys(s3KeyFlags)
+		if err != nil {
+			log.Printf("Error parsing S3 keys: %v", err)
+			return
+		}
+		s3Server, err := NewS3Server(appServer, s3Keys, *s3AllowUnsignedFlag)
+		if err != nil {
+			log.Printf("Error creating S3 server: %v", err)
+			return
+		}
+		defer func() {
+			if err := s3Server.Close(); err != nil {
+				log.Printf("Error removing S3 multipart staging directory: %v", err)
+			}
+		}()
+		go func() {
+			log.Printf("Starting S3 API on port %s (uploads allowed: %t)", *s3PortFlag, allowUploads)
+			s3Srv := &http.Server{
+				Addr:              "0.0.0.0:" + *s3PortFlag,
+				Handler:           logRequest(s3Server),
+				ReadHeaderTimeout: 10 * time.Second,
+				IdleTimeout:       120 * time.Second,
+			}
+			if err := s3Srv.ListenAndServe(); err != nil {
+				log.Printf("S3 API stopped: %v", err)
+			}
+		}()
+	}
+
 	mux := http.NewServeMux()
 
 	// Static file handler for UI assets (CSS, JS) from embedded filesystem.
@@ -75,7 +244,7 @@ func main() {
 		return
 	}
 	staticHandler := http.StripPrefix("/static/", http.FileServer(http.FS(staticContentFS)))
-	mux.Handle("/static/", authMiddleware(appServer, staticHandler.ServeHTTP))
+	mux.Handle("/static/", authMiddleware(appServer, compressHandler(staticAssetHandler(appServer, staticHandler))))
 
 	// Login and Logout handlers are NOT wrapped by the main authMiddleware directly here,
 	// as they need to be accessible to unauthenticated users.
@@ -98,8 +267,38 @@ func main() {
 	mux.HandleFunc("/browse/", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
 		handleBrowse(appServer, w, r)
 	}))
-	mux.HandleFunc("/api/files", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/shuffle/", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
+		handleShufflePage(appServer, w, r)
+	}))
+	mux.HandleFunc("/api/files", authMiddleware(appServer, compressHandler(func(w http.ResponseWriter, r *http.Request) {
 		handleAPI(appServer, w, r)
+	})))
+	mux.HandleFunc("/api/table", authMiddleware(appServer, compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		handleTable(appServer, w, r)
+	})))
+	mux.HandleFunc("/api/gallery", authMiddleware(appServer, compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		handleGallery(appServer, w, r)
+	})))
+	mux.HandleFunc("/api/music", authMiddleware(appServer, compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		handleMusic(appServer, w, r)
+	})))
+	mux.HandleFunc("/api/music/cover", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
+		handleMusicCover(appServer, w, r)
+	}))
+	mux.HandleFunc("/api/subtitle", authMiddleware(appServer, compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		handleSubtitle(appServer, w, r)
+	})))
+	mux.HandleFunc("/api/playlist", authMiddleware(appServer, compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		handlePlaylist(appServer, w, r)
+	})))
+	mux.HandleFunc("/api/progress", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
+		handleProgress(appServer, w, r)
+	}))
+	mux.HandleFunc("/api/progress/continue", authMiddleware(appServer, compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		handleContinue(appServer, w, r)
+	})))
+	mux.HandleFunc("/api/thumb", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
+		handleThumb(appServer, w, r)
 	}))
 	mux.HandleFunc("/api/random-media", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
 		handleRandomMedia(appServer, w, r)
@@ -107,11 +306,45 @@ func main() {
 	mux.HandleFunc("/ws", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
 		handleWebSocket(appServer, w, r)
 	}))
-	mux.HandleFunc("/files/", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
-		handleFiles(appServer, w, r)
+	mux.HandleFunc("/ws/tail", authMiddleware(appServer, func(w http.ResponseWriter, r *http.Request) {
+		handleTail(appServer, w, r)
 	}))
+	mux.HandleFunc(podcastFeedPrefix+"/", tokenMiddleware(appServer, podcastFeedPrefix, feedTokens, compressHandler(func(w http.ResponseWriter, r *http.Request) {
+		handlePodcastFeed(appServer, w, r)
+	})))
+	mux.HandleFunc("/files/", tokenMiddleware(appServer, "/files", accessTokens|feedTokens, compressHandler(liveReloadHandler(appServer, "/files", siteRulesHandler(appServer, "/files", scriptHandler(appServer, "/files", func(w http.ResponseWriter, r *http.Request) {
+		handleFiles(appServer, w, r)
+	}))))))
 
-	loggedMux := logRequest(mux)
+	proxyRules, err := parseProxyRules(proxyFlags)
+	if err != nil {
+		log.Printf("Error parsing proxy rules: %v", err)
+		return
+	}
+
+	rootMux := mux
+	if *siteFlag {
+		if appServer.basePath == "" {
+			log.Printf("--ui-prefix must not be empty in --site mode")
+			return
+		}
+		siteMux := http.NewServeMux()
+		siteMux.Handle(appServer.basePath+"/", http.StripPrefix(appServer.basePath, mux))
+		siteMux.HandleFunc("/", authMiddleware(appServer, compressHandler(liveReloadHandler(appServer, "", siteRulesHandler(appServer, "", scriptHandler(appServer, "", func(w http.ResponseWriter, r *http.Request) {
+			handleSite(appServer, w, r)
+		}))))))
+		rootMux = siteMux
+		log.Printf("Site mode enabled, browse UI available under %s/", appServer.basePath)
+	}
+
+	// Proxies are mounted on the top-level mux, ahead of the catch-all file
+	// handlers but behind serve's own, more specific routes.
+	if err := registerProxies(appServer, rootMux, proxyRules, *proxyTimeoutFlag); err != nil {
+		log.Printf("Error registering proxies: %v", err)
+		return
+	}
+
+	loggedMux := logRequest(rootMux)
 
 	log.Printf("Starting server on port %s", *portFlag)
 	log.Printf("Access the server at: http://localhost:%s", *portFlag)
@@ -124,7 +357,31 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	// On SIGINT or SIGTERM, stop serving and return, so the deferred
+	// cleanups run.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+		// Positions reported in the last moments are still waiting for
+		// the batched save.
+		if appServer.progress != nil {
+			appServer.progress.close()
+		}
+	}()
 	err = srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdownDone
+		return
+	}
 	if err != nil {
 		log.Printf("Server failed to start: %v", err)
 		return
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// markdownRenderer converts CommonMark with GitHub extensions to HTML. Raw
+// HTML in the source is omitted and dangerous link schemes are dropped, so the
+// output is safe to embed.
+var markdownRenderer = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+)
+
+func renderMarkdown(source []byte) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := markdownRenderer.Convert(source, &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// renderMarkdownAt renders markdown that lives at the URL directory base
+// (ending in "/"), so relative links and images resolve there regardless of
+// the page the HTML is embedded in. Links to other markdown files open in
+// the rendered view.
+func renderMarkdownAt(source []byte, base string) (template.HTML, error) {
+	doc := markdownRenderer.Parser().Parse(text.NewReader(source))
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := n.(type) {
+		case *ast.Link:
+			node.Destination = []byte(resolveMarkdownURL(string(node.Destination), base, true))
+		case *ast.Image:
+			node.Destination = []byte(resolveMarkdownURL(string(node.Destination), base, false))
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := markdownRenderer.Renderer().Render(&buf, source, doc); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// resolveMarkdownURL joins a relative link destination onto base. Absolute
+// URLs, root relative paths and fragments are left alone.
+func resolveMarkdownURL(dest, base string, link bool) string {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return dest
+	}
+	resolved, err := url.Parse(base)
+	if err != nil {
+		return dest
+	}
+	resolved = resolved.ResolveReference(u)
+	if link && isMarkdownFile(resolved.Path) && !resolved.Query().Has("view") {
+		query := resolved.Query()
+		query.Set("view", "1")
+		resolved.RawQuery = query.Encode()
+	}
+	return resolved.String()
+}
+
+// markdownBaseURL returns the /files/ URL of the directory containing the
+// file at the slash separated relPath.
+func (s *Server) markdownBaseURL(relPath string) string {
+	dir := path.Dir(path.Clean("/" + relPath))
+	u := url.URL{Path: s.basePath + "/files" + strings.TrimSuffix(dir, "/") + "/"}
+	return u.EscapedPath()
+}
+
+func isMarkdownFile(fullPath string) bool {
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// renderMarkdownFile renders a markdown file without its front matter.
+func renderMarkdownFile(fullPath string) (template.HTML, error) {
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+	_, body := splitFrontMatter(content)
+	return renderMarkdown(body)
+}
+
+// splitFrontMatter separates a leading "---" delimited front matter block
+// from content. Only flat "key: value" pairs are understood; values are
+// parsed as booleans, numbers, [a, b] lists or (optionally quoted) strings.
+func splitFrontMatter(content []byte) (map[string]any, []byte) {
+	meta := make(map[string]any)
+	rest := bytes.TrimPrefix(content, []byte("\ufeff"))
+	line, rest, ok := cutLine(rest)
+	if !ok || strings.TrimRight(string(line), "\r") != "---" {
+		return meta, content
+	}
+	for {
+		line, rest, ok = cutLine(rest)
+		text := strings.TrimRight(string(line), "\r")
+		if text == "---" {
+			return meta, rest
+		}
+		if !ok {
+			// No closing delimiter: treat everything as content.
+			return make(map[string]any), content
+		}
+		if key, value, found := strings.Cut(text, ":"); found && !strings.HasPrefix(strings.TrimSpace(text), "#") {
+			meta[strings.TrimSpace(key)] = parseFrontMatterValue(strings.TrimSpace(value))
+		}
+	}
+}
+
+// cutLine splits off the first line of b. ok is false once b has no newline.
+func cutLine(b []byte) (line, rest []byte, ok bool) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return b, nil, false
+	}
+	return b[:i], b[i+1:], true
+}
+
+func parseFrontMatterValue(value string) any {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		var items []any
+		for _, item := range strings.Split(value[1:len(value)-1], ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, parseFrontMatterValue(item))
+			}
+		}
+		return items
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	return value
+}
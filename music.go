@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// musicUpdateDebounce is how long the library waits for a file to stop
+	// changing before reading its tags again.
+	musicUpdateDebounce = 2 * time.Second
+	// musicUpdateMaxDelay bounds the wait, so a file that never stops
+	// changing cannot hold back the other pending updates.
+	musicUpdateMaxDelay = 10 * time.Second
+	defaultMusicLimit   = 1000
+	maxMusicLimit       = 10000
+	unknownArtist       = "Unknown Artist"
+	unknownAlbum        = "Unknown Album"
+)
+
+// musicTrack is an indexed audio file.
+type musicTrack struct {
+	Path        string  `json:"path"`
+	URL         string  `json:"url"`
+	Title       string  `json:"title"`
+	Artist      string  `json:"artist,omitempty"`
+	Album       string  `json:"album,omitempty"`
+	AlbumArtist string  `json:"albumArtist,omitempty"`
+	Genre       string  `json:"genre,omitempty"`
+	Year        int     `json:"year,omitempty"`
+	Track       int     `json:"track,omitempty"`
+	Disc        int     `json:"disc,omitempty"`
+	Duration    float64 `json:"duration,omitempty"` // Seconds
+	Cover       string  `json:"cover,omitempty"`    // /api/music/cover URL when the file embeds art
+
+	size    int64
+	modTime time.Time
+}
+
+// artistKey is the artist a track is filed under.
+func (t *musicTrack) artistKey() string {
+	switch {
+	case t.AlbumArtist != "":
+		return t.AlbumArtist
+	case t.Artist != "":
+		return t.Artist
+	}
+	return unknownArtist
+}
+
+func (t *musicTrack) albumKey() string {
+	if t.Album == "" {
+		return unknownAlbum
+	}
+	return t.Album
+}
+
+// matches reports whether every word of the lowercased query appears in
+// one of the track's text fields.
+func (t *musicTrack) matches(words []string) bool {
+	text := strings.ToLower(strings.Join([]string{t.Title, t.Artist, t.AlbumArtist, t.Album, t.Genre, t.Path}, "\x00"))
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// musicLibrary indexes the tags of every audio file below rootDir. The
+// initial scan runs in the background; afterwards the watcher queues
+// changed paths, which are re-read once they settle.
+type musicLibrary struct {
+	rootDir   string
+	mu        sync.RWMutex
+	tracks    map[string]*musicTrack // slash separated path -> track
+	indexing  atomic.Bool
+	pendingMu sync.Mutex
+	pending   map[string]bool // changed paths awaiting update
+	wake      chan struct{}
+}
+
+func newMusicLibrary(rootDir string) *musicLibrary {
+	l := &musicLibrary{
+		rootDir: rootDir,
+		tracks:  make(map[string]*musicTrack),
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	l.indexing.Store(true)
+	go l.run()
+	return l
+}
+
+// queue records a changed path reported by the watcher. It never blocks,
+// so a long scan cannot stall the watcher. Only audio files, directories
+// and removed paths the library holds tracks under are queued.
+func (l *musicLibrary) queue(fullPath string) {
+	if mediaKind(fullPath) != "audio" {
+		if info, err := os.Stat(fullPath); err == nil {
+			if !info.IsDir() {
+				return
+			}
+		} else if !l.holds(fullPath) {
+			return
+		}
+	}
+	l.pendingMu.Lock()
+	l.pending[fullPath] = true
+	l.pendingMu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *musicLibrary) run() {
+	start := time.Now()
+	l.scan(l.rootDir)
+	l.indexing.Store(false)
+	l.mu.RLock()
+	log.Printf("Music library: indexed %d tracks in %s", len(l.tracks), time.Since(start).Round(time.Millisecond))
+	l.mu.RUnlock()
+
+	for range l.wake {
+		// Wait until no change has arrived for musicUpdateDebounce, but no
+		// longer than musicUpdateMaxDelay in all.
+		deadline := time.Now().Add(musicUpdateMaxDelay)
+		for settled := false; !settled; {
+			select {
+			case <-l.wake:
+			case <-time.After(min(musicUpdateDebounce, time.Until(deadline))):
+				settled = true
+			}
+		}
+		l.pendingMu.Lock()
+		pending := l.pending
+		l.pending = make(map[string]bool)
+		l.pendingMu.Unlock()
+		for changed := range pending {
+			l.update(changed)
+		}
+	}
+}
+
+// holds reports whether fullPath is an indexed track or a directory
+// containing one.
+func (l *musicLibrary) holds(fullPath string) bool {
+	rel, err := filepath.Rel(l.rootDir, fullPath)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.tracks[rel] != nil {
+		return true
+	}
+	for key := range l.tracks {
+		if strings.HasPrefix(key, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// update re-reads a changed file or directory, or drops it when removed.
+func (l *musicLibrary) update(fullPath string) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		rel, relErr := filepath.Rel(l.rootDir, fullPath)
+		if relErr != nil {
+			return
+		}
+		rel = filepath.ToSlash(rel)
+		l.mu.Lock()
+		delete(l.tracks, rel)
+		for key := range l.tracks {
+			if strings.HasPrefix(key, rel+"/") {
+				delete(l.tracks, key)
+			}
+		}
+		l.mu.Unlock()
+		return
+	}
+	if info.IsDir() {
+		l.scan(fullPath)
+		return
+	}
+	l.index(fullPath, info)
+}
+
+// scan indexes the audio files below dir, skipping hidden directories.
+func (l *musicLibrary) scan(dir string) {
+	err := filepath.WalkDir(dir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if fullPath != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			l.index(fullPath, info)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Music library: error scanning %s: %v", dir, err)
+	}
+}
+
+// index reads the tags of one file unless the indexed copy is current.
+func (l *musicLibrary) index(fullPath string, info os.FileInfo) {
+	if mediaKind(fullPath) != "audio" {
+		return
+	}
+	rel, err := filepath.Rel(l.rootDir, fullPath)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	l.mu.RLock()
+	existing := l.tracks[rel]
+	l.mu.RUnlock()
+	if existing != nil && existing.size == info.Size() && existing.modTime.Equal(info.ModTime()) {
+		return
+	}
+
+	tags, err := readAudioTags(fullPath, false)
+	if err != nil && err != errNoAudioTags {
+		log.Printf("Music library: error reading tags of %s: %v", fullPath, err)
+	}
+	track := &musicTrack{
+		Path:    rel,
+		URL:     filesURL(rel),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}
+	if tags != nil {
+		track.Title = tags.Title
+		track.Artist = tags.Artist
+		track.Album = tags.Album
+		track.AlbumArtist = tags.AlbumArtist
+		track.Genre = tags.Genre
+		track.Year = tags.Year
+		track.Track = tags.Track
+		track.Disc = tags.Disc
+		track.Duration = tags.Duration.Round(time.Millisecond).Seconds()
+		if tags.HasCover {
+			track.Cover = "/api/music/cover?" + url.Values{
+				"path": {rel},
+				"v":    {strconv.FormatInt(info.ModTime().UnixNano(), 36)},
+			}.Encode()
+		}
+	}
+	if track.Title == "" {
+		name := path.Base(rel)
+		track.Title = strings.TrimSuffix(name, path.Ext(name))
+	}
+	l.mu.Lock()
+	l.tracks[rel] = track
+	l.mu.Unlock()
+}
+
+// musicArtist, musicAlbum and musicGenre are the browse entries of
+// /api/music.
+type musicArtist struct {
+	Name   string `json:"name"`
+	Albums int    `json:"albums"`
+	Tracks int    `json:"tracks"`
+}
+
+type musicAlbum struct {
+	Name   string `json:"name"`
+	Artist string `json:"artist"`
+	Year   int    `json:"year,omitempty"`
+	Tracks int    `json:"tracks"`
+	Cover  string `json:"cover,omitempty"`
+}
+
+type musicGenre struct {
+	Name   string `json:"name"`
+	Tracks int    `json:"tracks"`
+}
+
+type musicResponse struct {
+	Indexing bool          `json:"indexing"` // The initial scan is still running
+	Total    int           `json:"total"`    // Matching entries before limit and offset
+	Artists  []musicArtist `json:"artists,omitempty"`
+	Albums   []musicAlbum  `json:"albums,omitempty"`
+	Genres   []musicGenre  `json:"genres,omitempty"`
+	Tracks   []*musicTrack `json:"tracks,omitempty"`
+}
+
+// track returns the indexed track at rel, relative to rootDir.
+func (l *musicLibrary) track(rel string) (musicTrack, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if track := l.tracks[rel]; track != nil {
+		return *track, true
+	}
+	return musicTrack{}, false
+}
+
+// filter returns the tracks matching the artist, album, genre and q
+// parameters, in artist, album, disc and track order.
+func (l *musicLibrary) filter(query url.Values) []*musicTrack {
+	artist, album, genre := query.Get("artist"), query.Get("album"), query.Get("genre")
+	words := strings.Fields(strings.ToLower(query.Get("q")))
+	l.mu.RLock()
+	tracks := make([]*musicTrack, 0, len(l.tracks))
+	for _, track := range l.tracks {
+		if artist != "" && !strings.EqualFold(track.artistKey(), artist) && !strings.EqualFold(track.Artist, artist) {
+			continue
+		}
+		if album != "" && !strings.EqualFold(track.albumKey(), album) {
+			continue
+		}
+		if genre != "" && !strings.EqualFold(track.Genre, genre) {
+			continue
+		}
+		if len(words) > 0 && !track.matches(words) {
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	l.mu.RUnlock()
+	sort.Slice(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if x, y := strings.ToLower(a.artistKey()), strings.ToLower(b.artistKey()); x != y {
+			return x < y
+		}
+		if x, y := strings.ToLower(a.albumKey()), strings.ToLower(b.albumKey()); x != y {
+			return x < y
+		}
+		if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return a.Path < b.Path
+	})
+	return tracks
+}
+
+// musicPage applies the limit and offset parameters to n entries.
+func musicPage(query url.Values, n int) (int, int) {
+	limit := defaultMusicLimit
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 {
+		limit = min(value, maxMusicLimit)
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	offset = min(max(offset, 0), n)
+	return offset, min(offset+limit, n)
+}
+
+// handleMusic browses and searches the music library:
+//
+//	/api/music?view=artists
+//	/api/music?view=albums&artist=Name
+//	/api/music?view=genres
+//	/api/music?view=tracks&artist=&album=&genre=&q=words&limit=&offset=
+//
+// The filters apply to every view, so albums can be narrowed by genre and
+// artists by a search.
+func handleMusic(s *Server, w http.ResponseWriter, r *http.Request) {
+	if s.music == nil {
+		http.Error(w, "Music library is disabled (start serve with --music-library)", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	tracks := s.music.filter(query)
+	response := musicResponse{Indexing: s.music.indexing.Load()}
+
+	switch query.Get("view") {
+	case "artists":
+		// Tracks are sorted by artist, so each artist is one run.
+		var albums map[string]bool
+		for _, track := range tracks {
+			name := track.artistKey()
+			if n := len(response.Artists); n == 0 || !strings.EqualFold(response.Artists[n-1].Name, name) {
+				response.Artists = append(response.Artists, musicArtist{Name: name})
+				albums = make(map[string]bool)
+			}
+			artist := &response.Artists[len(response.Artists)-1]
+			artist.Tracks++
+			if !albums[track.albumKey()] {
+				albums[track.albumKey()] = true
+				artist.Albums++
+			}
+		}
+		response.Total = len(response.Artists)
+		start, end := musicPage(query, response.Total)
+		response.Artists = response.Artists[start:end]
+	case "albums":
+		index := make(map[[2]string]int)
+		for _, track := range tracks {
+			key := [2]string{track.artistKey(), track.albumKey()}
+			i, ok := index[key]
+			if !ok {
+				i = len(response.Albums)
+				index[key] = i
+				response.Albums = append(response.Albums, musicAlbum{Name: key[1], Artist: key[0]})
+			}
+			album := &response.Albums[i]
+			album.Tracks++
+			album.Year = max(album.Year, track.Year)
+			if album.Cover == "" {
+				album.Cover = track.Cover
+			}
+		}
+		response.Total = len(response.Albums)
+		start, end := musicPage(query, response.Total)
+		response.Albums = response.Albums[start:end]
+	case "genres":
+		counts := make(map[string]int)
+		for _, track := range tracks {
+			if track.Genre != "" {
+				counts[track.Genre]++
+			}
+		}
+		for name, count := range counts {
+			response.Genres = append(response.Genres, musicGenre{Name: name, Tracks: count})
+		}
+		sort.Slice(response.Genres, func(i, j int) bool {
+			return strings.ToLower(response.Genres[i].Name) < strings.ToLower(response.Genres[j].Name)
+		})
+		response.Total = len(response.Genres)
+		start, end := musicPage(query, response.Total)
+		response.Genres = response.Genres[start:end]
+	default:
+		response.Total = len(tracks)
+		start, end := musicPage(query, response.Total)
+		response.Tracks = tracks[start:end]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding music response: %v", err)
+	}
+}
+
+// handleMusicCover serves the cover art embedded in an audio file.
+func handleMusicCover(s *Server, w http.ResponseWriter, r *http.Request) {
+	fullPath := resolveInRoot(s.rootDir, r.URL.Query().Get("path"))
+	info, err := os.Stat(fullPath)
+	if err != nil || !info.Mode().IsRegular() || mediaKind(fullPath) != "audio" {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	tags, err := readAudioTags(fullPath, true)
+	if err != nil && err != errNoAudioTags {
+		log.Printf("Error reading cover of '%s': %v", fullPath, err)
+	}
+	if tags == nil || len(tags.Cover) == 0 {
+		http.Error(w, "No cover art", http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("v") != "" {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if strings.HasPrefix(tags.CoverType, "image/") {
+		w.Header().Set("Content-Type", tags.CoverType)
+	}
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(tags.Cover))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPartyRoomLen = 64
+	maxPartyNameLen = 64
+)
+
+// partyRoom is a watch party: browsers playing one media file in sync. The
+// server's copy of the playback state is authoritative; members correct
+// their drift against it.
+type partyRoom struct {
+	id       string
+	path     string // Relative to rootDir
+	playing  bool
+	position float64   // Seconds, as of updated
+	updated  time.Time // Server time of the last play, pause or seek
+	by       string    // Member who made the last change
+	members  map[*hubClient]string
+}
+
+// now is the room's playback position at t.
+func (room *partyRoom) now(t time.Time) float64 {
+	if !room.playing {
+		return room.position
+	}
+	return room.position + t.Sub(room.updated).Seconds()
+}
+
+// parties keeps the watch-party rooms. Rooms exist while they have members.
+type parties struct {
+	mu       sync.Mutex
+	rooms    map[string]*partyRoom
+	byClient map[*hubClient]*partyRoom
+}
+
+func newParties() *parties {
+	return &parties{rooms: make(map[string]*partyRoom), byClient: make(map[*hubClient]*partyRoom)}
+}
+
+// serverTime is t in fractional Unix milliseconds, the unit of Date.now().
+func serverTime(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1000
+}
+
+// stateMessage is the room's playback state as of t. The caller holds
+// parties.mu.
+func (room *partyRoom) stateMessage(t time.Time) []byte {
+	data, err := json.Marshal(map[string]any{
+		"type":       "party-state",
+		"room":       room.id,
+		"path":       room.path,
+		"url":        filesURL(room.path),
+		"playing":    room.playing,
+		"position":   room.now(t),
+		"serverTime": serverTime(t),
+		"by":         room.by,
+	})
+	if err != nil {
+		log.Printf("Error marshalling party state: %v", err)
+	}
+	return data
+}
+
+// membersMessage lists who is in the room. The caller holds parties.mu.
+func (room *partyRoom) membersMessage() []byte {
+	names := make([]string, 0, len(room.members))
+	for _, name := range room.members {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	data, err := json.Marshal(map[string]any{"type": "party-members", "room": room.id, "members": names})
+	if err != nil {
+		log.Printf("Error marshalling party members: %v", err)
+	}
+	return data
+}
+
+// sendRoom sends data to every member. The caller holds parties.mu.
+func (s *Server) sendRoom(room *partyRoom, data []byte) {
+	for member := range room.members {
+		s.hub.send(member, data)
+	}
+}
+
+// joinParty adds c to a room, creating it for relPath if it doesn't exist
+// yet. Joining an existing room plays its file, whatever relPath says.
+func (s *Server) joinParty(c *hubClient, roomID, name, relPath string) {
+	roomID = strings.TrimSpace(roomID)
+	name = strings.TrimSpace(name)
+	if roomID == "" || len(roomID) > maxPartyRoomLen {
+		s.partyError(c, "Invalid room")
+		return
+	}
+	if name == "" {
+		name = "Guest"
+	}
+	if len(name) > maxPartyNameLen {
+		name = strings.ToValidUTF8(name[:maxPartyNameLen], "")
+	}
+	s.leaveParty(c)
+
+	p := s.parties
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	room := p.rooms[roomID]
+	if room == nil {
+		relPath = strings.Trim(path.Clean("/"+relPath), "/")
+		kind := mediaKind(relPath)
+		if (kind != "audio" && kind != "video") || !isRegularFile(resolveInRoot(s.rootDir, relPath)) {
+			s.partyError(c, "Not an audio or video file")
+			return
+		}
+		room = &partyRoom{id: roomID, path: filepath.ToSlash(relPath), updated: time.Now(), members: make(map[*hubClient]string)}
+		p.rooms[roomID] = room
+	}
+	room.members[c] = name
+	p.byClient[c] = room
+	s.hub.send(c, room.stateMessage(time.Now()))
+	s.sendRoom(room, room.membersMessage())
+}
+
+// leaveParty removes c from its room, closing the room when it empties.
+func (s *Server) leaveParty(c *hubClient) {
+	p := s.parties
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	room := p.byClient[c]
+	if room == nil {
+		return
+	}
+	delete(p.byClient, c)
+	delete(room.members, c)
+	if len(room.members) == 0 {
+		delete(p.rooms, room.id)
+		return
+	}
+	s.sendRoom(room, room.membersMessage())
+}
+
+// controlParty applies a member's play, pause or seek and sends the new
+// state to everyone in the room, the sender included, so that all members
+// follow the same server timestamps.
+func (s *Server) controlParty(c *hubClient, action string, position float64) {
+	p := s.parties
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	room := p.byClient[c]
+	if room == nil {
+		return
+	}
+	switch action {
+	case "play":
+		room.playing = true
+	case "pause":
+		room.playing = false
+	case "seek":
+	default:
+		return
+	}
+	now := time.Now()
+	room.position = max(position, 0)
+	room.updated = now
+	room.by = room.members[c]
+	s.sendRoom(room, room.stateMessage(now))
+}
+
+// partyPong answers a member's clock sync request with the server time.
+func (s *Server) partyPong(c *hubClient, clientTime float64) {
+	data, err := json.Marshal(map[string]any{"type": "party-pong", "clientTime": clientTime, "serverTime": serverTime(time.Now())})
+	if err != nil {
+		log.Printf("Error marshalling party pong: %v", err)
+		return
+	}
+	s.hub.send(c, data)
+}
+
+func (s *Server) partyError(c *hubClient, message string) {
+	data, err := json.Marshal(map[string]any{"type": "party-error", "error": message})
+	if err != nil {
+		return
+	}
+	s.hub.send(c, data)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// playerPage is the data of player.html.
+type playerPage struct {
+	Name      string
+	Path      string // Relative to rootDir, for /api/progress
+	RawURL    string
+	BrowseURL string
+	CastURL   string // This page relative to the UI, sent to other devices
+	Video     bool   // <video> rather than <audio>
+	Subtitles []subtitleTrack
+	Progress  bool // Whether positions are remembered
+}
+
+// servePlayerPage serves the media player page for an audio or video file
+// (?view=player). Videos get their subtitles attached as WebVTT tracks.
+func (s *Server) servePlayerPage(w http.ResponseWriter, fullPath string) bool {
+	kind := mediaKind(fullPath)
+	if !isRegularFile(fullPath) || (kind != "audio" && kind != "video") {
+		return false
+	}
+	rel, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil {
+		return false
+	}
+	relPath := filepath.ToSlash(rel)
+	dir := strings.TrimPrefix(path.Dir("/"+relPath), "/")
+	page := playerPage{
+		Name:      path.Base(relPath),
+		Path:      relPath,
+		RawURL:    (&url.URL{Path: s.basePath + "/files/" + relPath}).EscapedPath(),
+		BrowseURL: (&url.URL{Path: s.basePath + "/browse/" + dir}).EscapedPath(),
+		CastURL:   filesURL(relPath) + "?view=player",
+		Video:     kind == "video",
+		Progress:  s.progress != nil,
+	}
+	if page.Video {
+		page.Subtitles = newSubtitleFinder(s.rootDir, dir).find(page.Name)
+		for i := range page.Subtitles {
+			page.Subtitles[i].URL = s.basePath + page.Subtitles[i].URL
+		}
+	}
+	var buf bytes.Buffer
+	if err := s.playerTemplate.Execute(&buf, page); err != nil {
+		log.Printf("Error executing player template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Error writing player page: %v", err)
+	}
+	return true
+}
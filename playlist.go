@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxPlaylistEntries caps the files in one generated playlist.
+const maxPlaylistEntries = 10000
+
+// playlistEntry is one file of a generated playlist.
+type playlistEntry struct {
+	URL      string // Absolute, with an access token when auth is enabled
+	Title    string
+	Artist   string
+	Album    string
+	Duration float64 // Seconds, 0 when unknown
+}
+
+// collectPlaylist lists up to limit media files of kinds under relativePath
+// in the listing's sort order; in recursive playlists each directory's files
+// come before its subdirectories.
+func collectPlaylist(rootDir, relativePath string, recursive bool, kinds map[string]bool, sortBy, order string, limit int) ([]string, error) {
+	var files []string
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		data, err := getDirectoryListing(rootDir, dir)
+		if err != nil {
+			return err
+		}
+		sortFiles(data.Files, sortBy, order)
+		current := filepath.ToSlash(data.CurrentPath)
+		var subdirs []string
+		for _, file := range data.Files {
+			switch {
+			case file.IsDir:
+				if recursive && !strings.HasPrefix(file.Name, ".") {
+					subdirs = append(subdirs, path.Join(current, file.Name))
+				}
+			case kinds[mediaKind(file.Name)] && len(files) < limit:
+				files = append(files, path.Join(current, file.Name))
+			}
+		}
+		for _, subdir := range subdirs {
+			if len(files) >= limit {
+				break
+			}
+			if err := walk(subdir); err != nil {
+				log.Printf("Error listing '%s' for playlist: %v", subdir, err)
+			}
+		}
+		return nil
+	}
+	return files, walk(relativePath)
+}
+
+// playlistKinds reads the type parameter: audio, video, image or all.
+// Playlists hold audio and video by default, leaving out cover art.
+func playlistKinds(value string) (map[string]bool, bool) {
+	switch value {
+	case "":
+		return map[string]bool{"audio": true, "video": true}, true
+	case "all":
+		return map[string]bool{"audio": true, "video": true, "image": true}, true
+	case "audio", "video", "image":
+		return map[string]bool{value: true}, true
+	}
+	return nil, false
+}
+
+// requestOrigin is the scheme and host the client reached the server at.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeM3U8(buf *bytes.Buffer, title string, entries []playlistEntry) {
+	buf.WriteString("#EXTM3U\n")
+	fmt.Fprintf(buf, "#PLAYLIST:%s\n", title)
+	for _, entry := range entries {
+		duration := -1
+		if entry.Duration > 0 {
+			duration = int(math.Round(entry.Duration))
+		}
+		name := entry.Title
+		if entry.Artist != "" {
+			name = entry.Artist + " - " + entry.Title
+		}
+		// Titles are single line by definition of the format.
+		name = strings.NewReplacer("\r", " ", "\n", " ").Replace(name)
+		fmt.Fprintf(buf, "#EXTINF:%d,%s\n%s\n", duration, name, entry.URL)
+	}
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // Milliseconds
+}
+
+func writeXSPF(buf *bytes.Buffer, title string, entries []playlistEntry) error {
+	playlist := xspfPlaylist{Version: "1", XMLNS: "http://xspf.org/ns/0/", Title: title}
+	for _, entry := range entries {
+		playlist.Tracks = append(playlist.Tracks, xspfTrack{
+			Location: entry.URL,
+			Title:    entry.Title,
+			Creator:  entry.Artist,
+			Album:    entry.Album,
+			Duration: int64(entry.Duration * 1000),
+		})
+	}
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(playlist); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	return nil
+}
+
+// handlePlaylist serves the media files of a directory as a playlist for
+// external players, with absolute /files/ URLs:
+//
+//	/api/playlist?path=music&recursive=true&format=m3u8|xspf&type=audio&sort=name&order=asc
+//
+// When auth is enabled the URLs carry an access token scoped to the
+// directory, as players don't have the session cookie.
+func handlePlaylist(s *Server, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	relativePath := strings.Trim(path.Clean("/"+query.Get("path")), "/")
+	recursive, _ := strconv.ParseBool(query.Get("recursive"))
+	format := query.Get("format")
+	if format == "" {
+		format = "m3u8"
+	}
+	if format != "m3u8" && format != "xspf" {
+		http.Error(w, "Unknown playlist format", http.StatusBadRequest)
+		return
+	}
+	kinds, ok := playlistKinds(query.Get("type"))
+	if !ok {
+		http.Error(w, "Unknown media type", http.StatusBadRequest)
+		return
+	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	files, err := collectPlaylist(s.rootDir, relativePath, recursive, kinds, sortBy, query.Get("order"), maxPlaylistEntries)
+	if err != nil {
+		log.Printf("Error getting playlist for path '%s': %v", relativePath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	origin := requestOrigin(r) + s.basePath
+	var token string
+	if s.authEnabled {
+		token = "?" + accessTokenParam + "=" + s.accessToken(relativePath)
+	}
+	entries := make([]playlistEntry, 0, len(files))
+	for _, file := range files {
+		name := path.Base(file)
+		entry := playlistEntry{
+			URL:   origin + filesURL(file) + token,
+			Title: strings.TrimSuffix(name, path.Ext(name)),
+		}
+		if s.music != nil {
+			if track, ok := s.music.track(file); ok {
+				entry.Title, entry.Artist, entry.Album, entry.Duration = track.Title, track.Artist, track.Album, track.Duration
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	title := path.Base("/" + relativePath)
+	if title == "/" {
+		title = "Serve"
+	}
+	var buf bytes.Buffer
+	contentType := "audio/x-mpegurl"
+	if format == "xspf" {
+		contentType = "application/xspf+xml"
+		if err := writeXSPF(&buf, title, entries); err != nil {
+			log.Printf("Error encoding playlist for path '%s': %v", relativePath, err)
+			http.Error(w, "Error encoding playlist", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		writeM3U8(&buf, title, entries)
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": title + "." + format}))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Error writing playlist for path '%s': %v", relativePath, err)
+	}
+}
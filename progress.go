@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressSaveDelay   = 2 * time.Second // changes are written to disk at most this often
+	maxProgressEntries  = 5000            // per user; the oldest are dropped beyond this
+	maxContinueEntries  = 50
+	progressMinPosition = 5  // seconds played before a position is remembered
+	progressEndMargin   = 30 // seconds from the end at which a file counts as watched
+	progressEndFraction = 0.95
+)
+
+// playbackProgress is how far a user got in a media file.
+type playbackProgress struct {
+	Position float64   `json:"position"` // Seconds
+	Duration float64   `json:"duration,omitempty"`
+	Watched  bool      `json:"watched"`
+	Updated  time.Time `json:"updated"`
+}
+
+// progressStore remembers playback positions per user and file in a JSON
+// file. Users are free-form profile names; the empty name is shared by
+// everyone, so positions carry over between devices by default.
+type progressStore struct {
+	file  string
+	mu    sync.Mutex
+	users map[string]map[string]*playbackProgress // user -> file relative to rootDir -> progress
+	dirty bool
+	save  *time.Timer
+	// writeMu keeps a slow write from overlapping the next one.
+	writeMu sync.Mutex
+}
+
+// defaultProgressFile is the progress file of rootDir in the user config
+// directory, named after a hash of its absolute path so that each served
+// directory keeps its own positions.
+func defaultProgressFile(rootDir string) string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(absRoot))
+	return filepath.Join(configDir, "serve", "progress", hex.EncodeToString(sum[:8])+".json")
+}
+
+func newProgressStore(file string) (*progressStore, error) {
+	p := &progressStore{file: file, users: make(map[string]map[string]*playbackProgress)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.users); err != nil {
+		log.Printf("Ignoring unreadable progress file %s: %v", file, err)
+		p.users = make(map[string]map[string]*playbackProgress)
+	}
+	return p, nil
+}
+
+// get returns a copy of the user's progress in rel.
+func (p *progressStore) get(user, rel string) (playbackProgress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if entry := p.users[user][rel]; entry != nil {
+		return *entry, true
+	}
+	return playbackProgress{}, false
+}
+
+// update records a position reported by a player. A file counts as watched
+// near its end; positions in the first seconds of unwatched files are not
+// worth remembering and clear the entry.
+func (p *progressStore) update(user, rel string, position, duration float64, watched *bool) (playbackProgress, bool) {
+	entry := playbackProgress{Position: max(position, 0), Duration: max(duration, 0), Updated: time.Now()}
+	if entry.Duration > 0 {
+		entry.Watched = entry.Position >= entry.Duration*progressEndFraction || entry.Duration-entry.Position <= progressEndMargin
+	}
+	if watched != nil {
+		entry.Watched = *watched
+	}
+	keep := entry.Watched || entry.Position >= progressMinPosition
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	files := p.users[user]
+	if !keep {
+		if files[rel] == nil {
+			return entry, false
+		}
+		delete(files, rel)
+		if len(files) == 0 {
+			delete(p.users, user)
+		}
+	} else {
+		if files == nil {
+			files = make(map[string]*playbackProgress)
+			p.users[user] = files
+		}
+		files[rel] = &entry
+		if len(files) > maxProgressEntries {
+			var oldest string
+			for name, e := range files {
+				if oldest == "" || e.Updated.Before(files[oldest].Updated) {
+					oldest = name
+				}
+			}
+			delete(files, oldest)
+		}
+	}
+	p.scheduleSave()
+	return entry, keep
+}
+
+func (p *progressStore) remove(user, rel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.users[user][rel] != nil {
+		delete(p.users[user], rel)
+		if len(p.users[user]) == 0 {
+			delete(p.users, user)
+		}
+		p.scheduleSave()
+	}
+}
+
+// inDirectory returns the user's progress in the files directly in dir.
+func (p *progressStore) inDirectory(user, dir string) map[string]playbackProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := make(map[string]playbackProgress)
+	for rel, entry := range p.users[user] {
+		if path.Dir("/"+rel) == path.Clean("/"+dir) {
+			entries[path.Base(rel)] = *entry
+		}
+	}
+	return entries
+}
+
+// unfinished returns the user's partially played files, most recent first.
+func (p *progressStore) unfinished(user string) ([]string, []playbackProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var files []string
+	for rel, entry := range p.users[user] {
+		if !entry.Watched {
+			files = append(files, rel)
+		}
+	}
+	entries := make([]playbackProgress, len(files))
+	slices.SortFunc(files, func(a, b string) int {
+		return p.users[user][b].Updated.Compare(p.users[user][a].Updated)
+	})
+	for i, rel := range files {
+		entries[i] = *p.users[user][rel]
+	}
+	return files, entries
+}
+
+// scheduleSave writes the store after progressSaveDelay, batching the
+// frequent reports of playing media. The caller holds p.mu.
+func (p *progressStore) scheduleSave() {
+	p.dirty = true
+	if p.save == nil {
+		p.save = time.AfterFunc(progressSaveDelay, p.flush)
+	}
+}
+
+// close writes pending changes straight away, for shutdown.
+func (p *progressStore) close() {
+	p.mu.Lock()
+	if p.save != nil {
+		p.save.Stop()
+		p.save = nil
+	}
+	p.mu.Unlock()
+	p.flush()
+}
+
+func (p *progressStore) flush() {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.mu.Lock()
+	p.save = nil
+	if !p.dirty {
+		p.mu.Unlock()
+		return
+	}
+	p.dirty = false
+	data, err := json.Marshal(p.users)
+	p.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(p.file, data)
+	}
+	if err != nil {
+		log.Printf("Error saving playback progress to %s: %v", p.file, err)
+	}
+}
+
+// writeFileAtomic replaces file with data, so a crash never leaves it half
+// written.
+func writeFileAtomic(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// attachProgress fills in the user's progress in the media of a listing.
+func (s *Server) attachProgress(user string, data *DirectoryData) {
+	entries := s.progress.inDirectory(user, filepath.ToSlash(data.CurrentPath))
+	if len(entries) == 0 {
+		return
+	}
+	for i := range data.Files {
+		file := &data.Files[i]
+		if entry, ok := entries[file.Name]; ok && !file.IsDir {
+			file.Progress = &entry
+		}
+	}
+}
+
+// progressReport is the body of POST /api/progress.
+type progressReport struct {
+	Path     string  `json:"path"`
+	User     string  `json:"user"`
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+	Watched  *bool   `json:"watched"` // Overrides the watched state derived from the position
+}
+
+// handleProgress reads, records and forgets playback positions:
+//
+//	GET    /api/progress?path=movies/movie.mp4&user=alice
+//	POST   /api/progress {"path": "movies/movie.mp4", "user": "alice", "position": 1312.5, "duration": 5400}
+//	DELETE /api/progress?path=movies/movie.mp4&user=alice
+//
+// Players report with navigator.sendBeacon when a page is closed, so the
+// body is read as JSON whatever its content type.
+func handleProgress(s *Server, w http.ResponseWriter, r *http.Request) {
+	if s.progress == nil {
+		http.Error(w, "Playback progress is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	user, relPath := query.Get("user"), query.Get("path")
+	var report progressReport
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&report); err != nil {
+			http.Error(w, "Invalid progress report", http.StatusBadRequest)
+			return
+		}
+		user, relPath = report.User, report.Path
+	}
+	relPath = strings.Trim(path.Clean("/"+relPath), "/")
+	fullPath := resolveInRoot(s.rootDir, relPath)
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := s.progress.get(user, relPath)
+		if !ok {
+			http.Error(w, "No progress recorded", http.StatusNotFound)
+			return
+		}
+		writeProgressJSON(w, entry)
+	case http.MethodPost:
+		kind := mediaKind(relPath)
+		if (kind != "audio" && kind != "video") || !isRegularFile(fullPath) {
+			http.Error(w, "Not an audio or video file", http.StatusBadRequest)
+			return
+		}
+		entry, _ := s.progress.update(user, relPath, report.Position, report.Duration, report.Watched)
+		s.bumpDirVersion(filepath.Dir(fullPath))
+		writeProgressJSON(w, entry)
+	case http.MethodDelete:
+		s.progress.remove(user, relPath)
+		s.bumpDirVersion(filepath.Dir(fullPath))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeProgressJSON(w http.ResponseWriter, entry playbackProgress) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		log.Printf("Error writing progress response: %v", err)
+	}
+}
+
+// continueItem is a partially played file in /api/progress/continue.
+type continueItem struct {
+	playbackProgress
+	Name string `json:"name"`
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	Kind string `json:"kind"`
+}
+
+// handleContinue lists the user's partially played files, most recently
+// played first: /api/progress/continue?user=alice&limit=20
+func handleContinue(s *Server, w http.ResponseWriter, r *http.Request) {
+	if s.progress == nil {
+		http.Error(w, "Playback progress is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = maxContinueEntries
+	}
+	limit = min(limit, maxContinueEntries)
+	files, entries := s.progress.unfinished(query.Get("user"))
+	items := []continueItem{}
+	for i, rel := range files {
+		if len(items) >= limit {
+			break
+		}
+		// Files deleted or moved since are left out.
+		if !isRegularFile(resolveInRoot(s.rootDir, rel)) {
+			continue
+		}
+		items = append(items, continueItem{
+			playbackProgress: entries[i],
+			Name:             path.Base(rel),
+			Path:             rel,
+			URL:              filesURL(rel),
+			Kind:             mediaKind(rel),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		log.Printf("Error writing continue watching response: %v", err)
+	}
+}
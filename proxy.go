@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyRule forwards every request below prefix to target.
+type proxyRule struct {
+	prefix string
+	target *url.URL
+}
+
+// parseProxyRules parses PREFIX=URL specifications such as
+// "/api=http://127.0.0.1:3000".
+func parseProxyRules(specs []string) ([]proxyRule, error) {
+	rules := make([]proxyRule, 0, len(specs))
+	for _, spec := range specs {
+		prefix, rawTarget, ok := strings.Cut(spec, "=")
+		prefix = strings.TrimSuffix(prefix, "/")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid proxy rule %q, expected /PREFIX=URL", spec)
+		}
+		target, err := url.Parse(rawTarget)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid proxy target %q, expected an http(s) URL", rawTarget)
+		}
+		rules = append(rules, proxyRule{prefix: prefix, target: target})
+	}
+	return rules, nil
+}
+
+// newProxyHandler builds a reverse proxy for rule. Websocket upgrades are
+// passed through by httputil.ReverseProxy; timeout bounds both the wait for
+// response headers and the whole response for ordinary requests.
+func newProxyHandler(rule proxyRule, timeout time.Duration) http.HandlerFunc {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = timeout
+
+	targetOrigin := rule.target.Scheme + "://" + rule.target.Host
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(rule.target)
+			pr.SetXForwarded()
+			// serve's session cookie is of no use to the backend.
+			stripCookie(pr.Out, sessionCookieName)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// Keep redirects issued by the backend on serve's origin.
+			if location := resp.Header.Get("Location"); strings.HasPrefix(location, targetOrigin) {
+				resp.Header.Set("Location", strings.TrimPrefix(location, targetOrigin))
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy error for %s -> %s: %v", r.URL.Path, rule.target, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The server-wide write timeout is sized for file listings, not
+		// for upstream calls or long lived websocket connections.
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(timeout)
+		if r.Header.Get("Upgrade") != "" {
+			deadline = time.Time{}
+			if err := rc.SetReadDeadline(deadline); err != nil {
+				log.Printf("Error clearing read deadline for proxied upgrade: %v", err)
+			}
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			log.Printf("Error setting write deadline for proxied request: %v", err)
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+func stripCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// registerProxies mounts the proxy rules on mux. Routes registered earlier
+// on mux (such as /api/files) keep precedence over a broader proxy prefix;
+// an identical route is rejected rather than shadowed.
+func registerProxies(s *Server, mux *http.ServeMux, rules []proxyRule, timeout time.Duration) error {
+	for _, rule := range rules {
+		handler := authMiddleware(s, newProxyHandler(rule, timeout))
+		for _, pattern := range []string{rule.prefix + "/", rule.prefix} {
+			probe := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: pattern}}
+			if _, existing := mux.Handler(probe); existing == pattern {
+				return fmt.Errorf("proxy prefix %s collides with a built-in route", rule.prefix)
+			}
+			mux.Handle(pattern, handler)
+		}
+		log.Printf("Proxying %s/* to %s", rule.prefix, rule.target)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shuffleCookieName = "serve_shuffle"
+	maxShuffleQueues  = 256 // least recently used queues are dropped beyond this
+	// maxShufflePool caps the files of one shuffle, far above playlists as
+	// the pool only holds paths. Larger libraries are reported as truncated.
+	maxShufflePool = 200000
+	// maxShufflePaths caps the paths held by all queues together; least
+	// recently used queues are dropped beyond it.
+	maxShufflePaths = 1000000
+
+	defaultSlideInterval = 8 // seconds an image is shown by the shuffle player
+)
+
+var errNoMediaFiles = errors.New("no media files found")
+
+// shuffleQueue deals the media files of one pool in random order without
+// repeats, and reshuffles once every file has been played.
+type shuffleQueue struct {
+	mu        sync.Mutex
+	rootDir   string
+	path      string
+	recursive bool
+	kinds     map[string]bool
+	rng       *rand.Rand
+	order     []string // Shuffled pool, relative to rootDir
+	next      int
+	last      string
+	truncated bool      // The pool stopped at maxShufflePool
+	used      time.Time // Guarded by Server.shuffleMu
+	size      int       // Paths held after the last deal, guarded by Server.shuffleMu
+}
+
+// collect lists the pool, noting whether it had to stop at maxShufflePool.
+func (q *shuffleQueue) collect() ([]string, error) {
+	files, err := collectPlaylist(q.rootDir, q.path, q.recursive, q.kinds, "name", "", maxShufflePool+1)
+	if err != nil {
+		return nil, err
+	}
+	q.truncated = len(files) > maxShufflePool
+	return files[:min(len(files), maxShufflePool)], nil
+}
+
+// refill collects and shuffles the pool again. The file played last is not
+// dealt first, so a new round never repeats it straight away.
+func (q *shuffleQueue) refill() error {
+	files, err := q.collect()
+	if err != nil {
+		return err
+	}
+	q.rng.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	if len(files) > 1 && files[0] == q.last {
+		files[0], files[len(files)-1] = files[len(files)-1], files[0]
+	}
+	q.order, q.next = files, 0
+	return nil
+}
+
+// refresh collects the pool again after the folder changed, shuffling new
+// files into the rest of the round and dropping removed ones.
+func (q *shuffleQueue) refresh() error {
+	files, err := q.collect()
+	if err != nil {
+		return err
+	}
+	played := make(map[string]bool, q.next)
+	for _, rel := range q.order[:q.next] {
+		played[rel] = true
+	}
+	rest := files[:0]
+	for _, rel := range files {
+		if !played[rel] {
+			rest = append(rest, rel)
+		}
+	}
+	q.rng.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	q.order = append(q.order[:q.next:q.next], rest...)
+	return nil
+}
+
+// pop deals the next file, skipping files removed since the shuffle.
+func (q *shuffleQueue) pop() (string, os.FileInfo, error) {
+	for refilled := false; ; {
+		for q.next < len(q.order) {
+			rel := q.order[q.next]
+			q.next++
+			info, err := os.Stat(resolveInRoot(q.rootDir, rel))
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			q.last = rel
+			return rel, info, nil
+		}
+		if refilled {
+			return "", nil, errNoMediaFiles
+		}
+		if err := q.refill(); err != nil {
+			return "", nil, err
+		}
+		refilled = true
+	}
+}
+
+// shuffleSeed turns the seed parameter, a number or any string, into the
+// seed of the queue's generator. Without one the order is random.
+func shuffleSeed(seed string) (uint64, uint64) {
+	if seed == "" {
+		return rand.Uint64(), rand.Uint64()
+	}
+	if n, err := strconv.ParseUint(seed, 10, 64); err == nil {
+		return n, 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return h.Sum64(), 0
+}
+
+// shuffleSession identifies the browser for its shuffle queues, setting a
+// cookie on first use.
+func (s *Server) shuffleSession(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(shuffleCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	id, err := s.generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     shuffleCookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
+
+// shuffleQueueFor returns the session's queue for a pool and seed, creating
+// it if needed.
+func (s *Server) shuffleQueueFor(key, relativePath string, recursive bool, kinds map[string]bool, seed string) *shuffleQueue {
+	s.shuffleMu.Lock()
+	defer s.shuffleMu.Unlock()
+	if q := s.shuffles[key]; q != nil {
+		q.used = time.Now()
+		return q
+	}
+	if len(s.shuffles) >= maxShuffleQueues {
+		delete(s.shuffles, s.oldestShuffleLocked(""))
+	}
+	q := &shuffleQueue{
+		rootDir:   s.rootDir,
+		path:      relativePath,
+		recursive: recursive,
+		kinds:     kinds,
+		rng:       rand.New(rand.NewPCG(shuffleSeed(seed))),
+		used:      time.Now(),
+	}
+	s.shuffles[key] = q
+	return q
+}
+
+// oldestShuffleLocked returns the key of the least recently used queue other
+// than except, or "" when there is none. s.shuffleMu must be held.
+func (s *Server) oldestShuffleLocked(except string) string {
+	var oldest string
+	for k, q := range s.shuffles {
+		if k != except && (oldest == "" || q.used.Before(s.shuffles[oldest].used)) {
+			oldest = k
+		}
+	}
+	return oldest
+}
+
+// sizeShuffleQueue records the paths a queue holds and drops the least
+// recently used other queues while all of them hold more than
+// maxShufflePaths.
+func (s *Server) sizeShuffleQueue(key string, q *shuffleQueue, size int) {
+	s.shuffleMu.Lock()
+	defer s.shuffleMu.Unlock()
+	q.size = size
+	total := 0
+	for _, other := range s.shuffles {
+		total += other.size
+	}
+	for total > maxShufflePaths {
+		oldest := s.oldestShuffleLocked(key)
+		if oldest == "" {
+			break
+		}
+		total -= s.shuffles[oldest].size
+		delete(s.shuffles, oldest)
+	}
+}
+
+// randomMedia is the JSON response of /api/random-media.
+type randomMedia struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	URL       string    `json:"url"`
+	Kind      string    `json:"kind"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Title     string    `json:"title,omitempty"`
+	Artist    string    `json:"artist,omitempty"`
+	Album     string    `json:"album,omitempty"`
+	Duration  float64   `json:"duration,omitempty"`
+	Remaining int       `json:"remaining"` // Files left before the pool is reshuffled
+	Total     int       `json:"total"`
+	Truncated bool      `json:"truncated,omitempty"` // The pool holds only the first maxShufflePool files
+}
+
+// handleRandomMedia deals the next file of the session's shuffle queue:
+//
+//	/api/random-media?path=photos&recursive=true&type=audio|video|image&seed=42
+//
+// Every file of the pool is played once before any repeats. The same seed
+// gives the same order. refresh=true picks up files added to the folder
+// since the round started. Pools beyond maxShufflePool files are cut short
+// and marked truncated.
+func handleRandomMedia(s *Server, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	relativePath := strings.Trim(path.Clean("/"+query.Get("path")), "/")
+	recursive, _ := strconv.ParseBool(query.Get("recursive"))
+	kinds, ok := playlistKinds(cmp.Or(query.Get("type"), "all"))
+	if !ok {
+		http.Error(w, "Unknown media type", http.StatusBadRequest)
+		return
+	}
+	session, err := s.shuffleSession(w, r)
+	if err != nil {
+		log.Printf("Error generating shuffle session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	seed := query.Get("seed")
+	key := strings.Join([]string{session, relativePath, strconv.FormatBool(recursive), cmp.Or(query.Get("type"), "all"), seed}, "\x00")
+
+	q := s.shuffleQueueFor(key, relativePath, recursive, kinds, seed)
+	q.mu.Lock()
+	if refresh, _ := strconv.ParseBool(query.Get("refresh")); refresh && q.order != nil {
+		if err := q.refresh(); err != nil {
+			log.Printf("Error refreshing shuffle queue for path '%s': %v", relativePath, err)
+		}
+	}
+	rel, info, err := q.pop()
+	remaining, total, truncated := len(q.order)-q.next, len(q.order), q.truncated
+	q.mu.Unlock()
+	s.sizeShuffleQueue(key, q, total)
+	if err != nil {
+		log.Printf("Error getting random media for path '%s': %v", relativePath, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	media := randomMedia{
+		Name:      path.Base(rel),
+		Path:      rel,
+		URL:       filesURL(rel),
+		Kind:      mediaKind(rel),
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		Remaining: remaining,
+		Total:     total,
+		Truncated: truncated,
+	}
+	if s.music != nil {
+		if track, ok := s.music.track(rel); ok {
+			media.Title, media.Artist, media.Album, media.Duration = track.Title, track.Artist, track.Album, track.Duration
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(media); err != nil {
+		log.Printf("Error writing response for path '%s': %v", relativePath, err)
+	}
+}
+
+// shufflePage is the data of shuffle.html.
+type shufflePage struct {
+	Name      string
+	Path      string
+	BrowseURL string
+	Interval  int // Seconds each image is shown
+}
+
+// handleShufflePage serves the continuous shuffle player of a folder,
+// /shuffle/<path>?recursive=true&type=image&interval=8. It keeps drawing
+// from /api/random-media.
+func handleShufflePage(s *Server, w http.ResponseWriter, r *http.Request) {
+	relativePath := strings.Trim(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/shuffle")), "/")
+	info, err := os.Stat(resolveInRoot(s.rootDir, relativePath))
+	if err != nil || !info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	page := shufflePage{
+		Name:      path.Base("/" + relativePath),
+		Path:      relativePath,
+		BrowseURL: (&url.URL{Path: s.basePath + "/browse/" + relativePath}).EscapedPath(),
+		Interval:  defaultSlideInterval,
+	}
+	if page.Name == "/" {
+		page.Name = "Home"
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("interval")); err == nil {
+		page.Interval = min(max(n, 1), 3600)
+	}
+	var buf bytes.Buffer
+	if err := s.shuffleTemplate.Execute(&buf, page); err != nil {
+		log.Printf("Error executing shuffle template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Error writing shuffle page: %v", err)
+	}
+}
@@ -0,0 +1,929 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3XMLNamespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat       = "2006-01-02T15:04:05.000Z"
+	s3DefaultMaxKeys   = 1000
+	s3MaxPartNumber    = 10000
+	s3UploadIDBytes    = 16
+	s3TempUploadPrefix = ".serve-s3-upload-"
+	// Multipart uploads neither completed nor aborted within s3UploadExpiry
+	// are discarded, checked every s3UploadSweepInterval.
+	s3UploadExpiry        = 24 * time.Hour
+	s3UploadSweepInterval = time.Hour
+)
+
+// S3Server implements a subset of the S3 REST API (path-style addressing
+// only) over rootDir. First-level directories are buckets and the paths
+// below them are object keys.
+type S3Server struct {
+	server  *Server
+	keys    map[string]string // access key -> secret key
+	partDir string            // staging area for multipart upload parts
+	// allowUnsigned accepts bodies the request signature doesn't cover.
+	allowUnsigned bool
+
+	mu      sync.Mutex
+	uploads map[string]*s3Upload // upload id -> pending multipart upload
+	closed  chan struct{}
+}
+
+type s3Upload struct {
+	bucket  string
+	key     string
+	parts   map[int]string // part number -> hex MD5 of the uploaded part
+	created time.Time
+}
+
+func NewS3Server(s *Server, keys map[string]string, allowUnsigned bool) (*S3Server, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one access key is required")
+	}
+	partDir, err := os.MkdirTemp("", "serve-s3-parts-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart staging directory: %w", err)
+	}
+	s3 := &S3Server{
+		server:        s,
+		keys:          keys,
+		partDir:       partDir,
+		allowUnsigned: allowUnsigned,
+		uploads:       make(map[string]*s3Upload),
+		closed:        make(chan struct{}),
+	}
+	go s3.expireUploads()
+	return s3, nil
+}
+
+// Close discards all pending multipart uploads along with the staging
+// directory.
+func (s3 *S3Server) Close() error {
+	close(s3.closed)
+	s3.mu.Lock()
+	clear(s3.uploads)
+	s3.mu.Unlock()
+	return os.RemoveAll(s3.partDir)
+}
+
+// expireUploads periodically discards abandoned multipart uploads, whose
+// parts would otherwise stay in the staging directory until shutdown.
+func (s3 *S3Server) expireUploads() {
+	ticker := time.NewTicker(s3UploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s3.closed:
+			return
+		case now := <-ticker.C:
+			var expired []string
+			s3.mu.Lock()
+			for uploadID, upload := range s3.uploads {
+				if now.Sub(upload.created) > s3UploadExpiry {
+					expired = append(expired, uploadID)
+				}
+			}
+			s3.mu.Unlock()
+			for _, uploadID := range expired {
+				log.Printf("Discarding abandoned multipart upload %s", uploadID)
+				s3.discardUpload(uploadID)
+			}
+		}
+	}
+}
+
+// parseS3Keys parses ACCESS_KEY:SECRET_KEY pairs.
+func parseS3Keys(pairs []string) (map[string]string, error) {
+	keys := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		accessKey, secretKey, ok := strings.Cut(pair, ":")
+		if !ok || accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("invalid S3 key %q, expected ACCESS_KEY:SECRET_KEY", pair)
+		}
+		keys[accessKey] = secretKey
+	}
+	return keys, nil
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+	status   int
+}
+
+var (
+	errS3AccessDenied     = &s3Error{Code: "AccessDenied", Message: "Access Denied", status: http.StatusForbidden}
+	errS3NoSuchBucket     = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", status: http.StatusNotFound}
+	errS3NoSuchKey        = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist", status: http.StatusNotFound}
+	errS3NoSuchUpload     = &s3Error{Code: "NoSuchUpload", Message: "The specified multipart upload does not exist", status: http.StatusNotFound}
+	errS3InvalidPart      = &s3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found", status: http.StatusBadRequest}
+	errS3InvalidPartOrder = &s3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order", status: http.StatusBadRequest}
+	errS3InvalidArgument  = &s3Error{Code: "InvalidArgument", Message: "Invalid argument", status: http.StatusBadRequest}
+	errS3MalformedXML     = &s3Error{Code: "MalformedXML", Message: "The XML you provided was not well-formed", status: http.StatusBadRequest}
+	errS3NotImplemented   = &s3Error{Code: "NotImplemented", Message: "This operation is not supported by serve", status: http.StatusNotImplemented}
+	errS3BucketNotEmpty   = &s3Error{Code: "BucketNotEmpty", Message: "The bucket you tried to delete is not empty", status: http.StatusConflict}
+	errS3InternalError    = &s3Error{Code: "InternalError", Message: "We encountered an internal error. Please try again.", status: http.StatusInternalServerError}
+)
+
+// maxS3XMLBody caps the XML request bodies of multi-object deletes and
+// multipart completions.
+const maxS3XMLBody = 4 << 20
+
+var errS3XMLTooLarge = errors.New("XML body too large")
+
+// decodeS3XML reads an XML request body to the end, so that its payload
+// signature is checked, before decoding it into v.
+func decodeS3XML(body io.Reader, v any) error {
+	data, err := io.ReadAll(io.LimitReader(body, maxS3XMLBody+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxS3XMLBody {
+		return errS3XMLTooLarge
+	}
+	return xml.Unmarshal(data, v)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	resp := *e
+	resp.Resource = r.URL.Path
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding S3 error response: %v", err)
+	}
+}
+
+func writeS3XML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding S3 response: %v", err)
+	}
+}
+
+// s3ErrorFromFS maps filesystem errors onto S3 error codes.
+func s3ErrorFromFS(err error, notFound *s3Error) *s3Error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return notFound
+	case errors.Is(err, fs.ErrPermission):
+		return errS3AccessDenied
+	case errors.Is(err, errS3PayloadHashMismatch):
+		return &s3Error{Code: "XAmzContentSHA256Mismatch", Message: err.Error(), status: http.StatusBadRequest}
+	case errors.Is(err, errS3ChunkSignatureInvalid):
+		return &s3Error{Code: "SignatureDoesNotMatch", Message: err.Error(), status: http.StatusForbidden}
+	case errors.Is(err, errS3UnsignedPayload):
+		return &s3Error{Code: "AccessDenied", Message: err.Error(), status: http.StatusForbidden}
+	case errors.Is(err, errS3InvalidPayloadHash):
+		return &s3Error{Code: "InvalidArgument", Message: err.Error(), status: http.StatusBadRequest}
+	case errors.Is(err, errS3XMLTooLarge):
+		return errS3MalformedXML
+	}
+	log.Printf("S3 filesystem error: %v", err)
+	return errS3InternalError
+}
+
+func (s3 *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth, err := verifySigV4(r, s3.keys)
+	if err != nil {
+		log.Printf("S3 authentication failed for %s: %v", r.RemoteAddr, err)
+		code := "SignatureDoesNotMatch"
+		switch {
+		case errors.Is(err, errS3InvalidAccessKey):
+			code = "InvalidAccessKeyId"
+		case errors.Is(err, errS3RequestExpired):
+			code = "RequestTimeTooSkewed"
+		case errors.Is(err, errS3MissingAuth):
+			code = "AccessDenied"
+		}
+		writeS3Error(w, r, &s3Error{Code: code, Message: err.Error(), status: http.StatusForbidden})
+		return
+	}
+	// Handlers read the body through the signature checks.
+	if r.ContentLength != 0 {
+		body, err := s3RequestBody(r, auth, s3.allowUnsigned)
+		if err != nil {
+			log.Printf("S3 request body rejected for %s: %v", r.RemoteAddr, err)
+			writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeS3Error(w, r, errS3NotImplemented)
+			return
+		}
+		s3.listBuckets(w, r)
+		return
+	}
+	if bucket == "." || bucket == ".." {
+		writeS3Error(w, r, errS3NoSuchBucket)
+		return
+	}
+	bucketDir := filepath.Join(s3.server.rootDir, bucket)
+
+	isWrite := r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodDelete
+	if isWrite && !s3.server.allowUploads {
+		writeS3Error(w, r, errS3AccessDenied)
+		return
+	}
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodPut:
+			s3.createBucket(w, r, bucketDir)
+			return
+		case http.MethodDelete:
+			s3.deleteBucket(w, r, bucketDir)
+			return
+		}
+	}
+
+	if info, err := os.Stat(bucketDir); err != nil || !info.IsDir() {
+		writeS3Error(w, r, errS3NoSuchBucket)
+		return
+	}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && query.Has("location"):
+			writeS3XML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3XMLNamespace})
+		case r.Method == http.MethodGet:
+			s3.listObjects(w, r, bucket, bucketDir)
+		case r.Method == http.MethodPost && query.Has("delete"):
+			s3.deleteObjects(w, r, bucketDir)
+		default:
+			writeS3Error(w, r, errS3NotImplemented)
+		}
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s3.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s3.uploadPart(w, r, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s3.completeMultipartUpload(w, r, bucket, key, bucketDir)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s3.abortMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s3.getObject(w, r, bucketDir, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s3.copyObject(w, r, bucketDir, key)
+	case r.Method == http.MethodPut:
+		s3.putObject(w, r, bucketDir, key)
+	case r.Method == http.MethodDelete:
+		s3.deleteObject(w, r, bucketDir, key)
+	default:
+		writeS3Error(w, r, errS3NotImplemented)
+	}
+}
+
+// s3ETag derives a cheap entity tag from size and modification time. It
+// deliberately contains a dash so clients do not mistake it for an MD5 sum.
+func s3ETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (s3 *S3Server) listBuckets(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(s3.server.rootDir)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	var buckets []s3Bucket
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		buckets = append(buckets, s3Bucket{Name: entry.Name(), CreationDate: info.ModTime().UTC().Format(s3TimeFormat)})
+	}
+	writeS3XML(w, struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Owner   s3Owner    `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3XMLNamespace, Owner: s3Owner{ID: "serve", DisplayName: "serve"}, Buckets: buckets})
+}
+
+func (s3 *S3Server) createBucket(w http.ResponseWriter, r *http.Request, bucketDir string) {
+	if err := os.Mkdir(bucketDir, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	w.Header().Set("Location", r.URL.Path)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s3 *S3Server) deleteBucket(w http.ResponseWriter, r *http.Request, bucketDir string) {
+	entries, err := os.ReadDir(bucketDir)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3NoSuchBucket))
+		return
+	}
+	if len(entries) > 0 {
+		writeS3Error(w, r, errS3BucketNotEmpty)
+		return
+	}
+	if err := os.Remove(bucketDir); err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3NoSuchBucket))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// listEntry is either an object or a common prefix in a bucket listing.
+type listEntry struct {
+	key    string
+	info   fs.FileInfo
+	prefix bool
+}
+
+// collectKeys walks bucketDir and returns the objects and common prefixes
+// under prefix, sorted by key as S3 does.
+func collectKeys(bucketDir, prefix, delimiter string) ([]listEntry, error) {
+	walkRoot := bucketDir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkRoot = resolveInRoot(bucketDir, prefix[:i])
+	}
+
+	var entries []listEntry
+	seenPrefixes := make(map[string]bool)
+	err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			if p == walkRoot {
+				return walkErr
+			}
+			return nil
+		}
+		if p == walkRoot {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			key += "/"
+		}
+		if !strings.HasPrefix(key, prefix) {
+			if d.IsDir() && !strings.HasPrefix(prefix, key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if !seenPrefixes[commonPrefix] {
+					seenPrefixes[commonPrefix] = true
+					entries = append(entries, listEntry{key: commonPrefix, prefix: true})
+				}
+				if d.IsDir() && commonPrefix == key {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), s3TempUploadPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, listEntry{key: key, info: info})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries, nil
+}
+
+// listObjects serves both ListObjects (v1) and ListObjectsV2.
+func (s3 *S3Server) listObjects(w http.ResponseWriter, r *http.Request, bucket, bucketDir string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	isV2 := query.Get("list-type") == "2"
+	urlEncode := query.Get("encoding-type") == "url"
+
+	maxKeys := s3DefaultMaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, errS3InvalidArgument)
+			return
+		}
+		maxKeys = min(n, s3DefaultMaxKeys)
+	}
+
+	var after string
+	if isV2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.URLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, r, errS3InvalidArgument)
+				return
+			}
+			after = string(decoded)
+		}
+	} else {
+		after = query.Get("marker")
+	}
+
+	entries, err := collectKeys(bucketDir, prefix, delimiter)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3NoSuchBucket))
+		return
+	}
+	start := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key > after
+	})
+	entries = entries[start:]
+	truncated := len(entries) > maxKeys
+	if truncated {
+		entries = entries[:maxKeys]
+	}
+
+	encode := func(s string) string {
+		if !urlEncode {
+			return s
+		}
+		return strings.ReplaceAll(url.QueryEscape(s), "%2F", "/")
+	}
+
+	result := listBucketResult{
+		Xmlns:     s3XMLNamespace,
+		Name:      bucket,
+		Prefix:    encode(prefix),
+		Delimiter: encode(delimiter),
+		MaxKeys:   maxKeys,
+	}
+	if urlEncode {
+		result.EncodingType = "url"
+	}
+	for _, entry := range entries {
+		if entry.prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry.key)})
+			continue
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(entry.key),
+			LastModified: entry.info.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         s3ETag(entry.info),
+			Size:         entry.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.IsTruncated = truncated
+	if isV2 {
+		keyCount := len(entries)
+		result.KeyCount = &keyCount
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = encode(query.Get("start-after"))
+		if truncated {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(entries[len(entries)-1].key))
+		}
+	} else {
+		marker := encode(after)
+		result.Marker = &marker
+		if truncated {
+			result.NextMarker = encode(entries[len(entries)-1].key)
+		}
+	}
+	writeS3XML(w, result)
+}
+
+func (s3 *S3Server) getObject(w http.ResponseWriter, r *http.Request, bucketDir, key string) {
+	fullPath := resolveInRoot(bucketDir, key)
+	file, err := os.Open(fullPath)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3NoSuchKey))
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		writeS3Error(w, r, errS3NoSuchKey)
+		return
+	}
+	w.Header().Set("ETag", s3ETag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
+	// ServeContent takes care of Range, HEAD and conditional requests.
+	http.ServeContent(w, r, filepath.Base(fullPath), info.ModTime(), file)
+}
+
+// writeObject streams body into a temporary file next to fullPath and renames
+// it into place, so readers and the watcher never observe partial objects.
+// It returns the hex MD5 of the written data.
+func writeObject(fullPath string, body io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), s3TempUploadPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s3 *S3Server) putObject(w http.ResponseWriter, r *http.Request, bucketDir, key string) {
+	fullPath := resolveInRoot(bucketDir, key)
+	// Keys ending in a slash are "folder" markers; map them to directories.
+	if strings.HasSuffix(key, "/") {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+			return
+		}
+		if err := os.MkdirAll(fullPath, 0o755); err != nil {
+			writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+			return
+		}
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	sum, err := writeObject(fullPath, r.Body)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s3 *S3Server) copyObject(w http.ResponseWriter, r *http.Request, bucketDir, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeS3Error(w, r, errS3InvalidArgument)
+		return
+	}
+	source, _, _ = strings.Cut(source, "?")
+	srcBucket, srcKey, ok := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	if !ok || srcBucket == "" || srcBucket == "." || srcBucket == ".." || srcKey == "" {
+		writeS3Error(w, r, errS3InvalidArgument)
+		return
+	}
+	src, err := os.Open(resolveInRoot(filepath.Join(s3.server.rootDir, srcBucket), srcKey))
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3NoSuchKey))
+		return
+	}
+	defer src.Close()
+
+	fullPath := resolveInRoot(bucketDir, key)
+	sum, err := writeObject(fullPath, src)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	lastModified := time.Now()
+	if info, err := os.Stat(fullPath); err == nil {
+		lastModified = info.ModTime()
+	}
+	writeS3XML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{Xmlns: s3XMLNamespace, LastModified: lastModified.UTC().Format(s3TimeFormat), ETag: `"` + sum + `"`})
+}
+
+// removeObject deletes the file behind key and prunes directories that became
+// empty, since S3 has no notion of empty folders.
+func removeObject(bucketDir, key string) error {
+	fullPath := resolveInRoot(bucketDir, key)
+	if err := os.Remove(fullPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(fullPath); dir != bucketDir && strings.HasPrefix(dir, bucketDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s3 *S3Server) deleteObject(w http.ResponseWriter, r *http.Request, bucketDir, key string) {
+	// Deleting a missing key succeeds in S3.
+	if err := removeObject(bucketDir, key); err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s3 *S3Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucketDir string) {
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := decodeS3XML(r.Body, &req); err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3MalformedXML))
+		return
+	}
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	type deleteError struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	result := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{Xmlns: s3XMLNamespace}
+	for _, object := range req.Objects {
+		if err := removeObject(bucketDir, object.Key); err != nil {
+			e := s3ErrorFromFS(err, errS3InternalError)
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: e.Code, Message: e.Message})
+			continue
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: object.Key})
+		}
+	}
+	writeS3XML(w, result)
+}
+
+func (s3 *S3Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	b := make([]byte, s3UploadIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		writeS3Error(w, r, errS3InternalError)
+		return
+	}
+	uploadID := hex.EncodeToString(b)
+	if err := os.Mkdir(filepath.Join(s3.partDir, uploadID), 0o700); err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	s3.mu.Lock()
+	s3.uploads[uploadID] = &s3Upload{bucket: bucket, key: key, parts: make(map[int]string), created: time.Now()}
+	s3.mu.Unlock()
+
+	writeS3XML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: s3XMLNamespace, Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+// lookupUpload returns the staging directory of a pending upload for
+// bucket/key, or an empty string if there is none.
+func (s3 *S3Server) lookupUpload(uploadID, bucket, key string) string {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	upload, ok := s3.uploads[uploadID]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return ""
+	}
+	return filepath.Join(s3.partDir, uploadID)
+}
+
+// recordPart remembers the MD5 of an uploaded part, replacing the one of an
+// earlier upload of the same part number.
+func (s3 *S3Server) recordPart(uploadID string, partNumber int, sum string) {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	if upload, ok := s3.uploads[uploadID]; ok {
+		upload.parts[partNumber] = sum
+	}
+}
+
+// uploadedParts returns a copy of the part MD5s of a pending upload.
+func (s3 *S3Server) uploadedParts(uploadID string) map[int]string {
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	if upload, ok := s3.uploads[uploadID]; ok {
+		return maps.Clone(upload.parts)
+	}
+	return nil
+}
+
+func partFileName(partNumber int) string {
+	return fmt.Sprintf("%05d", partNumber)
+}
+
+func (s3 *S3Server) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	query := r.URL.Query()
+	uploadDir := s3.lookupUpload(query.Get("uploadId"), bucket, key)
+	if uploadDir == "" {
+		writeS3Error(w, r, errS3NoSuchUpload)
+		return
+	}
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		writeS3Error(w, r, errS3InvalidArgument)
+		return
+	}
+	sum, err := writeObject(filepath.Join(uploadDir, partFileName(partNumber)), r.Body)
+	if err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	s3.recordPart(query.Get("uploadId"), partNumber, sum)
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s3 *S3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, bucketDir string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	uploadDir := s3.lookupUpload(uploadID, bucket, key)
+	if uploadDir == "" {
+		writeS3Error(w, r, errS3NoSuchUpload)
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := decodeS3XML(r.Body, &req); err != nil || len(req.Parts) == 0 {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3MalformedXML))
+		return
+	}
+
+	// Parts must be listed in ascending order, each with the ETag its upload
+	// returned, so a part replaced in the meantime isn't assembled unnoticed.
+	// The multipart ETag is the MD5 of the concatenated part MD5s plus the
+	// part count, matching what S3 clients expect.
+	uploaded := s3.uploadedParts(uploadID)
+	var readers []io.Reader
+	partHashes := md5.New()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			writeS3Error(w, r, errS3InvalidPartOrder)
+			return
+		}
+		sum, ok := uploaded[part.PartNumber]
+		if !ok || !strings.EqualFold(strings.Trim(strings.TrimSpace(part.ETag), `"`), sum) {
+			writeS3Error(w, r, errS3InvalidPart)
+			return
+		}
+		file, err := os.Open(filepath.Join(uploadDir, partFileName(part.PartNumber)))
+		if err != nil {
+			writeS3Error(w, r, errS3InvalidPart)
+			return
+		}
+		defer file.Close()
+		readers = append(readers, file)
+		partSum, _ := hex.DecodeString(sum)
+		partHashes.Write(partSum)
+	}
+	if _, err := writeObject(resolveInRoot(bucketDir, key), io.MultiReader(readers...)); err != nil {
+		writeS3Error(w, r, s3ErrorFromFS(err, errS3InternalError))
+		return
+	}
+	s3.discardUpload(uploadID)
+
+	writeS3XML(w, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{
+		Xmlns:    s3XMLNamespace,
+		Location: r.URL.Path,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(partHashes.Sum(nil)), len(req.Parts)),
+	})
+}
+
+func (s3 *S3Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	if s3.lookupUpload(uploadID, bucket, key) == "" {
+		writeS3Error(w, r, errS3NoSuchUpload)
+		return
+	}
+	s3.discardUpload(uploadID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s3 *S3Server) discardUpload(uploadID string) {
+	s3.mu.Lock()
+	delete(s3.uploads, uploadID)
+	s3.mu.Unlock()
+	if err := os.RemoveAll(filepath.Join(s3.partDir, uploadID)); err != nil {
+		log.Printf("Error removing multipart upload %s: %v", uploadID, err)
+	}
+}
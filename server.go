@@ -9,9 +9,11 @@ import (
 	"html/template"
 	"io/fs"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -24,66 +26,222 @@ const (
 	sessionCookieName = "filebrowser_session_token"
 )
 
+// ServerOptions holds the optional features configured from the command line.
+type ServerOptions struct {
+	Password        string
+	EnableRandomBtn bool
+	AllowUploads    bool          // Whether write-capable front-ends (SFTP, S3) may modify rootDir
+	CacheRules      []cacheRule   // Cache-Control rules for /files/ and /static/
+	FileETags       bool          // Send content-hash ETags for files under rootDir
+	Site            bool          // Serve rootDir as a website and move the browse UI under UIPrefix
+	SPA             bool          // In site mode, fall back to the root index.html for unknown routes
+	UIPrefix        string        // Mount point of the browse UI and APIs in site mode
+	LiveReload      bool          // Inject a reload client into HTML pages and notify it of changes
+	Templates       bool          // Execute .tmpl and .gohtml files with html/template before serving
+	Dev             bool          // Show template errors in the browser instead of a generic 500
+	ScriptRules     []scriptRule  // CGI and FastCGI rules, executed instead of served
+	ScriptTimeout   time.Duration // Per-request limit for CGI and FastCGI scripts
+	CGIEnv          []string      // Environment variables passed on to CGI scripts
+	ThumbCacheDir   string        // Directory for rendered thumbnails
+	ThumbCacheSize  int64         // Maximum size of ThumbCacheDir in bytes
+	ThumbWorkers    int           // Number of thumbnails rendered at once
+	MusicLibrary    bool          // Index audio tags in the background for /api/music
+	ProgressFile    string        // JSON file remembering playback positions, empty to disable
+}
+
 type Server struct {
-	rootDir        string
-	upgrader       websocket.Upgrader
-	clients        map[*websocket.Conn]bool
-	watcher        *fsnotify.Watcher
-	broadcast      chan []byte
-	template       *template.Template // For index.html
-	loginTemplate  *template.Template // For login.html
-	authEnabled    bool
-	randomBtn      bool
-	hashedPassword []byte
-	sessions       map[string]time.Time // session token -> creation time
+	rootDir         string
+	upgrader        websocket.Upgrader
+	hub             *hub     // Websocket clients of /ws
+	parties         *parties // Watch-party rooms, run over the hub
+	watcher         *fsnotify.Watcher
+	template        *template.Template // For index.html
+	loginTemplate   *template.Template // For login.html
+	viewTemplate    *template.Template // For view.html, the ?view=1 page
+	tailTemplate    *template.Template // For tail.html, the ?view=tail page
+	playerTemplate  *template.Template // For player.html, the ?view=player page
+	shuffleTemplate *template.Template // For shuffle.html, the /shuffle/ page
+	authEnabled     bool
+	randomBtn       bool
+	allowUploads    bool
+	hashedPassword  []byte
+	sessions        map[string]time.Time // session token -> creation time
+	tokenKey        []byte               // Signs scoped access tokens, see token.go
+	feedKey         []byte               // Signs podcast feed tokens, derived from the password
+	cacheRules      []cacheRule
+	assetHashes     map[string]string // embedded static asset -> content hash
+	fileETags       *etagCache        // nil unless content-hash ETags are enabled
+	versionSeed     string
+	versionMu       sync.Mutex
+	dirVersions     map[string]uint64 // directory -> listing version, bumped by the watcher
+	versionCounter  uint64            // Last version handed out, guarded by versionMu
+	basePath        string            // URL prefix of the browse UI, empty unless in site mode
+	spa             bool
+	siteRules       atomic.Pointer[siteRules] // _redirects and _headers, reloaded by the watcher
+	liveReload      bool
+	reloadChanges   chan string // changed paths awaiting a debounced reload message
+	templates       bool
+	devMode         bool
+	scriptRules     []scriptRule
+	scriptTimeout   time.Duration
+	cgiEnv          []string
+	tailMu          sync.Mutex
+	tails           map[string]map[chan struct{}]bool // followed file -> tail subscribers
+	tableMu         sync.Mutex
+	tableIndexes    map[string]*tableIndex // table file -> row offsets, for /api/table
+	thumbs          *thumbCache
+	galleryMu       sync.Mutex
+	galleryMeta     map[string]imageMeta // image file -> dimensions and EXIF, for /api/gallery
+	feedMu          sync.Mutex
+	feedTags        map[string]episodeTags // audio file -> tags, for podcast feeds
+	music           *musicLibrary          // nil unless the music library is enabled
+	progress        *progressStore         // nil unless playback positions are remembered
+	shuffleMu       sync.Mutex
+	shuffles        map[string]*shuffleQueue // session and pool -> /api/random-media queue
 }
 
-func NewServer(rootDir string, password string, enableRandomBtn bool) (*Server, error) {
-	watcher, err := fsnotify.NewWatcher()
+func NewServer(rootDir string, opts ServerOptions) (*Server, error) {
+	staticContentFS, err := fs.Sub(staticFilesystem, "static")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create watcher: %w", err)
+		return nil, fmt.Errorf("failed to open embedded static assets: %w", err)
+	}
+	assetHashes, err := hashAssets(staticContentFS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash embedded static assets: %w", err)
+	}
+	var basePath string
+	if opts.Site {
+		basePath = normalizeUIPrefix(opts.UIPrefix)
+	}
+	funcs := template.FuncMap{
+		"asset": func(name string) string {
+			return basePath + assetURL(assetHashes, name)
+		},
+		"base": func() string {
+			return basePath
+		},
 	}
 
 	// Parse index.html
-	indexTmpl, err := template.ParseFS(templateFS, "templates/index.html")
+	indexTmpl, err := template.New("index.html").Funcs(funcs).ParseFS(templateFS, "templates/index.html")
 	if err != nil {
 		return nil, fmt.Errorf("failed to load embedded index.html template: %w", err)
 	}
 
 	// Parse login.html
-	loginTmpl, err := template.ParseFS(templateFS, "templates/login.html")
+	loginTmpl, err := template.New("login.html").Funcs(funcs).ParseFS(templateFS, "templates/login.html")
 	if err != nil {
 		return nil, fmt.Errorf("failed to load embedded login.html template: %w", err)
 	}
 
+	// Parse view.html
+	viewTmpl, err := template.New("view.html").Funcs(funcs).ParseFS(templateFS, "templates/view.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embedded view.html template: %w", err)
+	}
+
+	// Parse tail.html
+	tailTmpl, err := template.New("tail.html").Funcs(funcs).ParseFS(templateFS, "templates/tail.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embedded tail.html template: %w", err)
+	}
+
+	// Parse player.html
+	playerTmpl, err := template.New("player.html").Funcs(funcs).ParseFS(templateFS, "templates/player.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embedded player.html template: %w", err)
+	}
+
+	// Parse shuffle.html
+	shuffleTmpl, err := template.New("shuffle.html").Funcs(funcs).ParseFS(templateFS, "templates/shuffle.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embedded shuffle.html template: %w", err)
+	}
+
+	thumbs, err := newThumbCache(opts.ThumbCacheDir, opts.ThumbCacheSize, opts.ThumbWorkers)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+
 	server := &Server{
-		rootDir:       rootDir,
-		template:      indexTmpl,
-		loginTemplate: loginTmpl,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(_ *http.Request) bool {
-				return true
-			},
-		},
-		clients:   make(map[*websocket.Conn]bool),
-		watcher:   watcher,
-		broadcast: make(chan []byte),
-		randomBtn: enableRandomBtn,
+		rootDir:         rootDir,
+		template:        indexTmpl,
+		loginTemplate:   loginTmpl,
+		viewTemplate:    viewTmpl,
+		tailTemplate:    tailTmpl,
+		playerTemplate:  playerTmpl,
+		shuffleTemplate: shuffleTmpl,
+		// The default CheckOrigin refuses browsers on other sites, whose
+		// websockets the same-origin policy doesn't stop: /ws/tail streams
+		// files and /ws takes cast and party commands.
+		upgrader:      websocket.Upgrader{},
+		hub:           newHub(),
+		parties:       newParties(),
+		watcher:       watcher,
+		randomBtn:     opts.EnableRandomBtn,
+		allowUploads:  opts.AllowUploads,
+		cacheRules:    opts.CacheRules,
+		assetHashes:   assetHashes,
+		versionSeed:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		dirVersions:   make(map[string]uint64),
+		tails:         make(map[string]map[chan struct{}]bool),
+		tableIndexes:  make(map[string]*tableIndex),
+		galleryMeta:   make(map[string]imageMeta),
+		feedTags:      make(map[string]episodeTags),
+		shuffles:      make(map[string]*shuffleQueue),
+		basePath:      basePath,
+		spa:           opts.SPA,
+		liveReload:    opts.LiveReload,
+		templates:     opts.Templates,
+		devMode:       opts.Dev,
+		scriptRules:   opts.ScriptRules,
+		scriptTimeout: opts.ScriptTimeout,
+		cgiEnv:        opts.CGIEnv,
+		thumbs:        thumbs,
+	}
+	if opts.FileETags {
+		server.fileETags = newETagCache()
 	}
+	if opts.MusicLibrary {
+		server.music = newMusicLibrary(rootDir)
+	}
+	if opts.ProgressFile != "" {
+		if server.progress, err = newProgressStore(opts.ProgressFile); err != nil {
+			return nil, fmt.Errorf("failed to load playback progress: %w", err)
+		}
+	}
+	server.siteRules.Store(loadSiteRules(rootDir))
 
-	if password != "" {
-		hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if opts.Password != "" {
+		hashedPass, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
 		if err != nil {
 			return nil, fmt.Errorf("failed to hash password: %w", err)
 		}
 		server.authEnabled = true
 		server.hashedPassword = hashedPass
 		server.sessions = make(map[string]time.Time)
+		if server.tokenKey, err = newTokenKey(); err != nil {
+			return nil, fmt.Errorf("failed to generate token key: %w", err)
+		}
+		if server.feedKey, err = newFeedKey(opts.Password, rootDir); err != nil {
+			return nil, fmt.Errorf("failed to derive feed token key: %w", err)
+		}
 		log.Println("Password protection enabled.")
 	} else {
 		log.Println("Password protection disabled.")
 	}
 
+	// The watcher queues reloads from its first event on.
+	if server.liveReload {
+		server.reloadChanges = make(chan string, 64)
+		go server.debounceReloads()
+	}
+
 	err = server.watchDirectory()
 	if err != nil {
 		if watcherErr := watcher.Close(); watcherErr != nil {
@@ -92,8 +250,6 @@ func NewServer(rootDir string, password string, enableRandomBtn bool) (*Server,
 		return nil, fmt.Errorf("failed to start watching directory: %w", err)
 	}
 
-	go server.handleBroadcast()
-
 	return server, nil
 }
 
@@ -118,7 +274,6 @@ func (s *Server) removeSession(token string) {
 	delete(s.sessions, token)
 }
 
-// watchDirectory and handleBroadcast methods remain the same as your provided code.
 func (s *Server) watchDirectory() error {
 	err := s.watcher.Add(s.rootDir)
 	if err != nil {
@@ -148,6 +303,28 @@ func (s *Server) watchDirectory() error {
 				if !ok {
 					return
 				}
+				// Only directories have listings of their own; keeping
+				// versions of files would grow the map with every log line.
+				s.bumpDirVersion(filepath.Dir(event.Name))
+				if info, statErr := os.Stat(event.Name); statErr == nil && info.IsDir() {
+					s.bumpDirVersion(event.Name)
+				} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					s.forgetDirVersion(event.Name)
+				}
+				// Listings also show the subtitles in their Subs folders.
+				if dir, ok := subtitleListingDir(event.Name); ok {
+					s.bumpDirVersion(dir)
+				}
+				if isSiteRulesFile(s.rootDir, event.Name) {
+					s.siteRules.Store(loadSiteRules(s.rootDir))
+				}
+				if s.liveReload {
+					s.queueReload(event.Name)
+				}
+				s.notifyTails(event.Name)
+				if s.music != nil {
+					s.music.queue(event.Name)
+				}
 				if event.Op&fsnotify.Create == fsnotify.Create {
 					if info, statErr := os.Stat(event.Name); statErr == nil && info.IsDir() {
 						if addErr := s.watcher.Add(event.Name); addErr != nil {
@@ -161,7 +338,7 @@ func (s *Server) watchDirectory() error {
 					log.Printf("Error marshalling update message: %v", marshalErr)
 					continue
 				}
-				s.broadcast <- jsonData
+				s.hub.broadcast(jsonData)
 			case err, ok := <-s.watcher.Errors:
 				if !ok {
 					return
@@ -172,16 +349,3 @@ func (s *Server) watchDirectory() error {
 	}()
 	return nil
 }
-
-func (s *Server) handleBroadcast() {
-	for data := range s.broadcast {
-		for client := range s.clients {
-			err := client.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				log.Printf("Error writing message to client %s: %v", client.RemoteAddr(), err)
-				client.Close()
-				delete(s.clients, client)
-			}
-		}
-	}
-}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPServer exposes the served directory over SFTP, chrooted to rootDir and
+// guarded by the same password and upload policy as the HTTP server, or by
+// per-user credentials when any are configured.
+type SFTPServer struct {
+	server *Server
+	config *ssh.ServerConfig
+}
+
+// sftpUsers are per-user SFTP credentials: bcrypt password hashes and
+// authorized public keys, by user name.
+type sftpUsers struct {
+	passwords map[string][]byte
+	keys      map[string]map[string]bool // user -> marshalled public keys
+}
+
+func (u *sftpUsers) empty() bool {
+	return len(u.passwords) == 0 && len(u.keys) == 0
+}
+
+// parseSFTPUsers reads --sftp-user values, NAME:BCRYPT_HASH, and
+// --sftp-authorized-keys values, NAME:FILE with keys in authorized_keys
+// format. Hashes rather than passwords keep secrets out of the process list;
+// make one with `htpasswd -nbB name password`.
+func parseSFTPUsers(passwords, keyFiles []string) (*sftpUsers, error) {
+	users := &sftpUsers{passwords: make(map[string][]byte), keys: make(map[string]map[string]bool)}
+	for _, value := range passwords {
+		name, hash, ok := strings.Cut(value, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid SFTP user %q, expected NAME:BCRYPT_HASH", value)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for SFTP user %q: %w", name, err)
+		}
+		users.passwords[name] = []byte(hash)
+	}
+	for _, value := range keyFiles {
+		name, file, ok := strings.Cut(value, ":")
+		if !ok || name == "" || file == "" {
+			return nil, fmt.Errorf("invalid SFTP authorized keys %q, expected NAME:FILE", value)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SFTP authorized keys of %q: %w", name, err)
+		}
+		if users.keys[name] == nil {
+			users.keys[name] = make(map[string]bool)
+		}
+		for len(bytes.TrimSpace(data)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse SFTP authorized keys %s: %w", file, err)
+			}
+			users.keys[name][string(key.Marshal())] = true
+			data = rest
+		}
+	}
+	return users, nil
+}
+
+// sftpDummyHash is compared against for unknown users, so that a login
+// takes as long whether or not the user exists.
+var sftpDummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("serve"), bcrypt.DefaultCost)
+	return hash
+})
+
+func NewSFTPServer(s *Server, hostKeyPath string, users *sftpUsers) (*SFTPServer, error) {
+	hostKey, err := loadOrGenerateHostKey(hostKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SFTP host key: %w", err)
+	}
+
+	config := &ssh.ServerConfig{}
+	switch {
+	case !users.empty():
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			hash, ok := users.passwords[conn.User()]
+			if !ok {
+				hash = sftpDummyHash()
+			}
+			if err := bcrypt.CompareHashAndPassword(hash, password); err != nil || !ok {
+				log.Printf("Failed SFTP login attempt for user %q from %s", conn.User(), conn.RemoteAddr())
+				return nil, errors.New("invalid password")
+			}
+			return nil, nil
+		}
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !users.keys[conn.User()][string(key.Marshal())] {
+				return nil, errors.New("unknown public key")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)}}, nil
+		}
+	case s.authEnabled:
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if err := bcrypt.CompareHashAndPassword(s.hashedPassword, password); err != nil {
+				log.Printf("Failed SFTP login attempt for user %q from %s", conn.User(), conn.RemoteAddr())
+				return nil, errors.New("invalid password")
+			}
+			return nil, nil
+		}
+	default:
+		config.NoClientAuth = true
+	}
+	config.AddHostKey(hostKey)
+	log.Printf("SFTP host key fingerprint: %s", ssh.FingerprintSHA256(hostKey.PublicKey()))
+
+	return &SFTPServer{server: s, config: config}, nil
+}
+
+// loadOrGenerateHostKey reads a PEM encoded private key from path. If path is
+// empty an ephemeral key is generated; if the file does not exist yet a new
+// key is generated and written there so the fingerprint survives restarts.
+func loadOrGenerateHostKey(path string) (ssh.Signer, error) {
+	if path != "" {
+		keyBytes, err := os.ReadFile(path)
+		if err == nil {
+			return ssh.ParsePrivateKey(keyBytes)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		block, err := ssh.MarshalPrivateKey(privateKey, "serve host key")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated new SFTP host key at %s", path)
+	}
+	return ssh.NewSignerFromKey(privateKey)
+}
+
+func (fs *SFTPServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go fs.handleConn(conn)
+	}
+}
+
+func (fs *SFTPServer) handleConn(nConn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(nConn, fs.config)
+	if err != nil {
+		log.Printf("SFTP handshake with %s failed: %v", nConn.RemoteAddr(), err)
+		return
+	}
+	defer sshConn.Close()
+	log.Printf("SFTP client %s connected as %q", sshConn.RemoteAddr(), sshConn.User())
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			if err := newChannel.Reject(ssh.UnknownChannelType, "unknown channel type"); err != nil {
+				log.Printf("Error rejecting SFTP channel: %v", err)
+			}
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Error accepting SFTP channel: %v", err)
+			continue
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				// Only the sftp subsystem is offered; no shells or exec.
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				if err := req.Reply(ok, nil); err != nil {
+					log.Printf("Error replying to SFTP channel request: %v", err)
+				}
+			}
+		}(requests)
+
+		handler := &sftpHandler{rootDir: fs.server.rootDir, allowUploads: fs.server.allowUploads}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  handler,
+			FilePut:  handler,
+			FileCmd:  handler,
+			FileList: handler,
+		})
+		go func() {
+			if err := server.Serve(); err != nil && err != io.EOF {
+				log.Printf("SFTP session for %s ended with error: %v", sshConn.RemoteAddr(), err)
+			}
+			server.Close()
+		}()
+	}
+	log.Printf("SFTP client %s disconnected", sshConn.RemoteAddr())
+}
+
+// sftpHandler implements the pkg/sftp request server handlers on top of the
+// local filesystem. Every request path is resolved inside rootDir.
+type sftpHandler struct {
+	rootDir      string
+	allowUploads bool
+}
+
+func (h *sftpHandler) resolve(requestPath string) string {
+	return resolveInRoot(h.rootDir, requestPath)
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return os.Open(h.resolve(r.Filepath))
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if !h.allowUploads {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	// O_APPEND is deliberately not mapped: WriteAt is not allowed on files
+	// opened in append mode, and clients send explicit offsets anyway.
+	return os.OpenFile(h.resolve(r.Filepath), flags, 0o644)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if !h.allowUploads {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	target := h.resolve(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		attrFlags := r.AttrFlags()
+		attrs := r.Attributes()
+		if attrFlags.Size {
+			if err := os.Truncate(target, int64(attrs.Size)); err != nil {
+				return err
+			}
+		}
+		if attrFlags.Permissions {
+			if err := os.Chmod(target, attrs.FileMode()); err != nil {
+				return err
+			}
+		}
+		if attrFlags.Acmodtime {
+			if err := os.Chtimes(target, attrs.AccessTime(), attrs.ModTime()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Rename":
+		return os.Rename(target, h.resolve(r.Target))
+	case "Rmdir", "Remove":
+		return os.Remove(target)
+	case "Mkdir":
+		return os.Mkdir(target, 0o755)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	target := h.resolve(r.Filepath)
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+	case "Stat", "Lstat":
+		info, err := os.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	// Readlink is not offered since link targets may point outside rootDir.
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm     = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat    = "20060102T150405Z"
+	sigV4MaxClockSkew  = 15 * time.Minute
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	streamingPayloadID = "STREAMING-"
+)
+
+// sigV4Now is the clock request times are checked against.
+var sigV4Now = time.Now
+
+var (
+	errS3MissingAuth      = errors.New("missing or unsupported authorization header")
+	errS3InvalidAccessKey = errors.New("unknown access key")
+	errS3SignatureInvalid = errors.New("signature does not match")
+	errS3RequestExpired   = errors.New("request time too skewed")
+)
+
+// sigV4Auth is a verified request signature. Streaming uploads chain their
+// chunk signatures from it.
+type sigV4Auth struct {
+	accessKey  string
+	signingKey []byte
+	amzDate    string
+	scope      string
+	signature  string
+}
+
+// verifySigV4 checks the AWS Signature Version 4 Authorization header of r
+// against the configured access keys. Only header based authentication is
+// supported, not presigned URLs.
+func verifySigV4(r *http.Request, keys map[string]string) (*sigV4Auth, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return nil, errS3MissingAuth
+	}
+
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	// Credential is <access key>/<date>/<region>/<service>/aws4_request.
+	credParts := strings.Split(credential, "/")
+	if len(credParts) != 5 || credParts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return nil, errS3MissingAuth
+	}
+	accessKey := credParts[0]
+	secretKey, ok := keys[accessKey]
+	if !ok {
+		return nil, errS3InvalidAccessKey
+	}
+
+	// The string to sign carries the date as sent: X-Amz-Date in the
+	// basic ISO 8601 format or, without it, the HTTP Date header.
+	amzDate := r.Header.Get("X-Amz-Date")
+	requestTime, err := time.Parse(sigV4TimeFormat, amzDate)
+	if amzDate == "" {
+		amzDate = r.Header.Get("Date")
+		requestTime, err = http.ParseTime(amzDate)
+	}
+	if err != nil {
+		return nil, errS3MissingAuth
+	}
+	if skew := sigV4Now().Sub(requestTime); skew > sigV4MaxClockSkew || skew < -sigV4MaxClockSkew {
+		return nil, errS3RequestExpired
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		canonicalQueryString(r.URL.Query()),
+		canonicalHeaders(r, signedHeaders),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join(credParts[1:], "/")
+	requestDigest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hex.EncodeToString(requestDigest[:])}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), credParts[1])
+	for _, part := range credParts[2:] {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errS3SignatureInvalid
+	}
+	return &sigV4Auth{accessKey: accessKey, signingKey: signingKey, amzDate: amzDate, scope: scope, signature: signature}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders string) string {
+	var b strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			values := r.Header.Values(name)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	return b.String()
+}
+
+// awsURIEncode percent-encodes everything except the RFC 3986 unreserved
+// characters, as required for canonical requests.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Payload hashes of streaming uploads in aws-chunked framing.
+const (
+	streamingSignedPayload        = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedPayloadTrailer = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer      = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// emptySHA256 is the hex SHA-256 of no data.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var (
+	errS3PayloadHashMismatch   = errors.New("payload hash does not match x-amz-content-sha256")
+	errS3ChunkSignatureInvalid = errors.New("chunk signature does not match")
+	errS3UnsignedPayload       = errors.New("unsigned payloads are not accepted")
+	errS3InvalidPayloadHash    = errors.New("unsupported x-amz-content-sha256")
+)
+
+// s3RequestBody returns the payload of r, checked against the signature
+// while it is read: a hex payload hash is compared once the body is fully
+// read, and the chunks of streaming uploads must continue auth's signature
+// chain. Readers return an error instead of io.EOF when the check fails, so
+// consumers must read to the end before using the data. Payloads the
+// signature doesn't cover, UNSIGNED-PAYLOAD or no hash at all, are refused
+// unless allowUnsigned is set.
+func s3RequestBody(r *http.Request, auth *sigV4Auth, allowUnsigned bool) (io.Reader, error) {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case payloadHash == streamingSignedPayload, payloadHash == streamingSignedPayloadTrailer:
+		return &awsChunkedReader{
+			r:             bufio.NewReader(r.Body),
+			auth:          auth,
+			trailer:       payloadHash == streamingSignedPayloadTrailer,
+			prevSignature: auth.signature,
+			hash:          sha256.New(),
+		}, nil
+	case payloadHash == streamingUnsignedTrailer:
+		if !allowUnsigned {
+			return nil, errS3UnsignedPayload
+		}
+		return &awsChunkedReader{r: bufio.NewReader(r.Body), trailer: true}, nil
+	case strings.HasPrefix(payloadHash, streamingPayloadID):
+		return nil, errS3InvalidPayloadHash
+	case strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked"):
+		// aws-chunked framing always comes with a STREAMING- payload hash.
+		return nil, errS3InvalidPayloadHash
+	case len(payloadHash) == sha256.Size*2:
+		return &hashVerifyingReader{r: r.Body, expected: strings.ToLower(payloadHash), hash: sha256.New()}, nil
+	case payloadHash == unsignedPayload, payloadHash == "":
+		if !allowUnsigned {
+			return nil, errS3UnsignedPayload
+		}
+		return r.Body, nil
+	}
+	return nil, errS3InvalidPayloadHash
+}
+
+type hashVerifyingReader struct {
+	r        io.Reader
+	expected string
+	hash     hash.Hash
+}
+
+func (h *hashVerifyingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		return n, errS3PayloadHashMismatch
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes the aws-chunked framing:
+//
+//	<hex size>;chunk-signature=<signature>\r\n<data>\r\n ... 0;chunk-signature=<signature>\r\n[trailers]\r\n
+//
+// With auth set every chunk must be signed, each signature chaining from
+// the previous one, starting at the request's seed signature; so must the
+// trailers, if any.
+type awsChunkedReader struct {
+	r             *bufio.Reader
+	auth          *sigV4Auth // nil for unsigned chunks
+	trailer       bool       // Trailing headers follow the last chunk
+	prevSignature string
+	signature     string    // Of the current chunk
+	hash          hash.Hash // Of the current chunk's data
+	remaining     int64
+	done          bool
+}
+
+// maxChunkLine caps the chunk header and trailer lines.
+const maxChunkLine = 4096
+
+// readLine reads a CRLF terminated line; a line cut off by the end of the
+// body is an unexpected EOF.
+func (c *awsChunkedReader) readLine() (string, error) {
+	var line []byte
+	for {
+		part, err := c.r.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > maxChunkLine {
+			return "", errors.New("aws-chunked line too long")
+		}
+		switch err {
+		case nil:
+			return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			return "", io.ErrUnexpectedEOF
+		default:
+			return "", err
+		}
+	}
+}
+
+// chunkStringToSign is what the signature of a chunk with the given data
+// hash signs.
+func (c *awsChunkedReader) chunkStringToSign(dataHash string) string {
+	return strings.Join([]string{sigV4Algorithm + "-PAYLOAD", c.auth.amzDate, c.auth.scope, c.prevSignature, emptySHA256, dataHash}, "\n")
+}
+
+// verify checks a signature over stringToSign and moves the chain on.
+func (c *awsChunkedReader) verify(signature, stringToSign string) error {
+	expected := hex.EncodeToString(hmacSHA256(c.auth.signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errS3ChunkSignatureInvalid
+	}
+	c.prevSignature = signature
+	return nil
+}
+
+// startChunk reads a chunk header. The last, empty chunk is verified and
+// followed by the trailers straight away.
+func (c *awsChunkedReader) startChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeField, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid aws-chunked size %q", sizeField)
+	}
+	c.signature = ""
+	if name, value, ok := strings.Cut(extension, "="); ok && strings.TrimSpace(name) == "chunk-signature" {
+		c.signature = strings.TrimSpace(value)
+	}
+	if c.auth != nil && c.signature == "" {
+		return errS3ChunkSignatureInvalid
+	}
+	if size > 0 {
+		c.remaining = size
+		if c.hash != nil {
+			c.hash.Reset()
+		}
+		return nil
+	}
+
+	c.done = true
+	if c.auth != nil {
+		if err := c.verify(c.signature, c.chunkStringToSign(emptySHA256)); err != nil {
+			return err
+		}
+	}
+	// Trailing headers, such as checksums, up to the final empty line.
+	var trailers strings.Builder
+	var trailerSignature string
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-amz-trailer-signature" {
+			trailerSignature = strings.TrimSpace(value)
+			continue
+		}
+		trailers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	if c.auth != nil && c.trailer {
+		digest := sha256.Sum256([]byte(trailers.String()))
+		stringToSign := strings.Join([]string{sigV4Algorithm + "-TRAILER", c.auth.amzDate, c.auth.scope, c.prevSignature, hex.EncodeToString(digest[:])}, "\n")
+		if err := c.verify(trailerSignature, stringToSign); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endChunk checks the framing after a chunk's data and its signature.
+func (c *awsChunkedReader) endChunk() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(c.r, crlf[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if string(crlf[:]) != "\r\n" {
+		return errors.New("invalid aws-chunked framing")
+	}
+	if c.auth == nil {
+		return nil
+	}
+	return c.verify(c.signature, c.chunkStringToSign(hex.EncodeToString(c.hash.Sum(nil))))
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		if err := c.startChunk(); err != nil {
+			return 0, err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	if c.remaining == 0 {
+		if err := c.endChunk(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	siteIndexPage    = "index.html"
+	siteNotFoundPage = "404.html"
+)
+
+// normalizeUIPrefix turns a user supplied prefix into the "/name" form used
+// for mounting the browse UI in site mode.
+func normalizeUIPrefix(prefix string) string {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+// handleSite serves rootDir as a website: directories resolve to their
+// index.html, "/about" falls back to "about.html", unknown routes fall back
+// to the root index.html in SPA mode and everything else gets 404.html.
+func handleSite(s *Server, w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	fullPath := resolveInRoot(s.rootDir, urlPath)
+	// Rule files configure the site and are not part of it.
+	if isSiteRulesFile(s.rootDir, fullPath) {
+		serveSiteNotFound(s, w, r)
+		return
+	}
+
+	if info, err := os.Stat(fullPath); err == nil {
+		if !info.IsDir() {
+			s.serveFile(w, r, fullPath)
+			return
+		}
+		// Relative links in an index page only work with a trailing slash.
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		if index, ok := s.sitePage(filepath.Join(fullPath, "index")); ok {
+			s.serveFile(w, r, index)
+			return
+		}
+	} else if path.Ext(urlPath) != ".html" {
+		if page, ok := s.sitePage(fullPath); ok {
+			s.serveFile(w, r, page)
+			return
+		}
+	}
+
+	// Only route-like requests fall back to the app shell; a missing script
+	// or image should still be a 404 rather than HTML.
+	if s.spa && (path.Ext(urlPath) == "" || strings.Contains(r.Header.Get("Accept"), "text/html")) {
+		if index, ok := s.sitePage(filepath.Join(s.rootDir, "index")); ok {
+			s.serveFile(w, r, index)
+			return
+		}
+	}
+	serveSiteNotFound(s, w, r)
+}
+
+func serveSiteNotFound(s *Server, w http.ResponseWriter, r *http.Request) {
+	serveFileWithStatus(w, r, filepath.Join(s.rootDir, siteNotFoundPage), http.StatusNotFound)
+}
+
+func isRegularFile(fullPath string) bool {
+	info, err := os.Stat(fullPath)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func isDirectory(fullPath string) bool {
+	info, err := os.Stat(fullPath)
+	return err == nil && info.IsDir()
+}
+
+// sitePage finds the page for base, a path without extension: base.html or,
+// with --templates, a page template such as base.gohtml.
+func (s *Server) sitePage(base string) (string, bool) {
+	if isRegularFile(base + ".html") {
+		return base + ".html", true
+	}
+	if s.templates {
+		for _, ext := range pageTemplateExts {
+			if isRegularFile(base + ext) {
+				return base + ext, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	redirectsFile = "_redirects"
+	headersFile   = "_headers"
+)
+
+// redirectRule is one line of a Netlify style _redirects file:
+//
+//	/from [key=:value ...] /to [status][!]
+//
+// A status of 200 rewrites internally, 404 serves the target with a 404 and
+// 3xx redirect. Without "!" a rule does not shadow existing files.
+type redirectRule struct {
+	from   string
+	to     string
+	status int
+	force  bool
+	query  map[string]string // query parameter -> placeholder or literal value
+}
+
+// headerRule is one block of a Netlify style _headers file.
+type headerRule struct {
+	pattern string
+	headers http.Header
+}
+
+type siteRules struct {
+	redirects []redirectRule
+	headers   []headerRule
+}
+
+// loadSiteRules reads _redirects and _headers from the root of rootDir.
+// Missing files simply yield no rules.
+func loadSiteRules(rootDir string) *siteRules {
+	rules := &siteRules{}
+	if data, err := os.ReadFile(filepath.Join(rootDir, redirectsFile)); err == nil {
+		rules.redirects = parseRedirects(string(data))
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading %s: %v", redirectsFile, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(rootDir, headersFile)); err == nil {
+		rules.headers = parseHeaders(string(data))
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading %s: %v", headersFile, err)
+	}
+	if len(rules.redirects) > 0 || len(rules.headers) > 0 {
+		log.Printf("Loaded %d redirect and %d header rules", len(rules.redirects), len(rules.headers))
+	}
+	return rules
+}
+
+func isSiteRulesFile(rootDir, fullPath string) bool {
+	if filepath.Dir(fullPath) != filepath.Clean(rootDir) {
+		return false
+	}
+	name := filepath.Base(fullPath)
+	return name == redirectsFile || name == headersFile
+}
+
+func parseRedirects(data string) []redirectRule {
+	var rules []redirectRule
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		rule := redirectRule{from: fields[0], status: http.StatusMovedPermanently}
+		rest := fields[1:]
+		for len(rest) > 0 && strings.Contains(rest[0], "=") && !strings.HasPrefix(rest[0], "/") {
+			key, value, _ := strings.Cut(rest[0], "=")
+			if rule.query == nil {
+				rule.query = make(map[string]string)
+			}
+			rule.query[key] = value
+			rest = rest[1:]
+		}
+		if len(rest) == 0 {
+			log.Printf("%s:%d: missing redirect target", redirectsFile, lineNo)
+			continue
+		}
+		rule.to = rest[0]
+		if len(rest) > 1 {
+			statusField := rest[1]
+			if strings.HasSuffix(statusField, "!") {
+				rule.force = true
+				statusField = strings.TrimSuffix(statusField, "!")
+			}
+			status, err := strconv.Atoi(statusField)
+			if err != nil || (status != http.StatusOK && status != http.StatusNotFound && (status < 300 || status > 399)) {
+				log.Printf("%s:%d: unsupported status %q", redirectsFile, lineNo, rest[1])
+				continue
+			}
+			rule.status = status
+		}
+		if rule.status == http.StatusOK && !strings.HasPrefix(rule.to, "/") {
+			log.Printf("%s:%d: rewrites to external URLs are not supported", redirectsFile, lineNo)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func parseHeaders(data string) []headerRule {
+	var rules []headerRule
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Unindented lines start a new path block, indented lines add headers.
+		if raw[0] != ' ' && raw[0] != '\t' {
+			rules = append(rules, headerRule{pattern: line, headers: make(http.Header)})
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || len(rules) == 0 {
+			log.Printf("%s:%d: expected \"Name: value\" below a path", headersFile, lineNo)
+			continue
+		}
+		rules[len(rules)-1].headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return rules
+}
+
+// matchRulePattern matches urlPath against a pattern made of literal
+// segments, ":name" placeholders and a trailing "*" splat. It returns the
+// captured values, with the splat stored under "splat".
+func matchRulePattern(pattern, urlPath string) (map[string]string, bool) {
+	patternSegs := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegs := strings.Split(strings.Trim(urlPath, "/"), "/")
+	params := make(map[string]string)
+	for i, seg := range patternSegs {
+		if seg == "*" && i == len(patternSegs)-1 {
+			if i < len(pathSegs) {
+				params["splat"] = strings.Join(pathSegs[i:], "/")
+			} else {
+				params["splat"] = ""
+			}
+			return params, true
+		}
+		if i >= len(pathSegs) {
+			return nil, false
+		}
+		switch {
+		case strings.HasPrefix(seg, ":"):
+			if pathSegs[i] == "" {
+				return nil, false
+			}
+			params[seg[1:]] = pathSegs[i]
+		case seg != pathSegs[i]:
+			return nil, false
+		}
+	}
+	return params, len(patternSegs) == len(pathSegs)
+}
+
+// expandRuleTarget substitutes ":name" placeholders in target. Each
+// placeholder is replaced as a whole word, so ":id" leaves ":identity"
+// alone, and substituted values are not expanded again.
+func expandRuleTarget(target string, params map[string]string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(target, ':')
+		if i < 0 {
+			b.WriteString(target)
+			return b.String()
+		}
+		b.WriteString(target[:i])
+		end := i + 1
+		for end < len(target) && isRuleNameByte(target[end]) {
+			end++
+		}
+		if value, ok := params[target[i+1:end]]; ok && end > i+1 {
+			b.WriteString(value)
+		} else {
+			b.WriteString(target[i:end])
+		}
+		target = target[end:]
+	}
+}
+
+func isRuleNameByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (rule redirectRule) match(r *http.Request, sitePath string) (map[string]string, bool) {
+	params, ok := matchRulePattern(rule.from, sitePath)
+	if !ok {
+		return nil, false
+	}
+	query := r.URL.Query()
+	for key, value := range rule.query {
+		actual := query.Get(key)
+		if !query.Has(key) {
+			return nil, false
+		}
+		if strings.HasPrefix(value, ":") {
+			params[value[1:]] = actual
+		} else if actual != value {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// siteFileExists reports whether sitePath maps to something the file
+// handlers would serve, which shadows non-forced redirect rules.
+func siteFileExists(rootDir, sitePath string) bool {
+	fullPath := resolveInRoot(rootDir, sitePath)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return false
+	}
+	return info.Mode().IsRegular() || (info.IsDir() && isRegularFile(filepath.Join(fullPath, siteIndexPage)))
+}
+
+// siteRulesHandler applies _headers and _redirects before next serves the
+// request. prefix is the URL prefix under which rootDir is mounted ("/files"
+// for the file handler, "" in site mode); rule paths are relative to it.
+func siteRulesHandler(s *Server, prefix string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules := s.siteRules.Load()
+		sitePath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, prefix))
+
+		for _, rule := range rules.headers {
+			if _, ok := matchRulePattern(rule.pattern, sitePath); ok {
+				for name, values := range rule.headers {
+					for _, value := range values {
+						w.Header().Add(name, value)
+					}
+				}
+			}
+		}
+
+		for _, rule := range rules.redirects {
+			params, ok := rule.match(r, sitePath)
+			if !ok || (!rule.force && siteFileExists(s.rootDir, sitePath)) {
+				continue
+			}
+			target := expandRuleTarget(rule.to, params)
+			switch {
+			case rule.status == http.StatusOK:
+				rewritten := new(http.Request)
+				*rewritten = *r
+				rewritten.URL = new(url.URL)
+				*rewritten.URL = *r.URL
+				targetPath, targetQuery, _ := strings.Cut(target, "?")
+				rewritten.URL.Path = prefix + targetPath
+				rewritten.URL.RawPath = ""
+				if targetQuery != "" {
+					rewritten.URL.RawQuery = targetQuery
+				}
+				next.ServeHTTP(w, rewritten)
+			case rule.status == http.StatusNotFound:
+				targetPath, _, _ := strings.Cut(target, "?")
+				serveFileWithStatus(w, r, resolveInRoot(s.rootDir, targetPath), http.StatusNotFound)
+			default:
+				if strings.HasPrefix(target, "/") {
+					target = s.basePathFor(prefix) + prefix + target
+				}
+				if !strings.Contains(target, "?") && r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, rule.status)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// basePathFor returns the UI prefix for redirects issued below prefix. The
+// file handler lives under the UI prefix; the site itself is at the root.
+func (s *Server) basePathFor(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return s.basePath
+}
+
+// serveFileWithStatus writes a file's contents with the given status code,
+// for error pages that http.ServeContent would answer with 200.
+func serveFileWithStatus(w http.ResponseWriter, r *http.Request, fullPath string, status int) {
+	page, err := os.ReadFile(fullPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	contentType := http.DetectContentType(page)
+	if ext := filepath.Ext(fullPath); ext == ".html" || ext == ".htm" {
+		contentType = "text/html; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if _, err := w.Write(page); err != nil {
+		log.Printf("Error writing %s: %v", fullPath, err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandRuleTarget(t *testing.T) {
+	params := map[string]string{"id": "7", "identity": "alice", "splat": "a/b"}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/users/:id", "/users/7"},
+		{"/users/:identity/:id", "/users/alice/7"},
+		{"/:identity-:id.html", "/alice-7.html"},
+		{"/files/:splat", "/files/a/b"},
+		{"https://example.com:8080/:id", "https://example.com:8080/7"},
+		{"/:unknown/:", "/:unknown/:"},
+		{"/plain", "/plain"},
+	}
+	for _, tt := range tests {
+		if got := expandRuleTarget(tt.target, params); got != tt.want {
+			t.Errorf("expandRuleTarget(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+	// Substituted values are not expanded again.
+	if got := expandRuleTarget("/:a", map[string]string{"a": ":b", "b": "x"}); got != "/:b" {
+		t.Errorf("expandRuleTarget expanded a substituted value: %q", got)
+	}
+}
+
+func TestLoadSiteRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		redirects string
+		headers   string
+		want      siteRules
+	}{
+		{
+			name: "no files",
+		},
+		{
+			name: "redirects",
+			redirects: "# Comments and blank lines are skipped\n\n" +
+				"/old /new\n" +
+				"/temp   /elsewhere   302\n" +
+				"/blog/:year/:slug /posts/:year-:slug.html 301!\n" +
+				"/app/* /index.html 200\n" +
+				"/gone /404.html 404\n" +
+				"/search q=:term sort=new /find/:term 302\n" +
+				"/ext https://example.com/ 307\n",
+			want: siteRules{redirects: []redirectRule{
+				{from: "/old", to: "/new", status: 301},
+				{from: "/temp", to: "/elsewhere", status: 302},
+				{from: "/blog/:year/:slug", to: "/posts/:year-:slug.html", status: 301, force: true},
+				{from: "/app/*", to: "/index.html", status: 200},
+				{from: "/gone", to: "/404.html", status: 404},
+				{from: "/search", to: "/find/:term", status: 302, query: map[string]string{"q": ":term", "sort": "new"}},
+				{from: "/ext", to: "https://example.com/", status: 307},
+			}},
+		},
+		{
+			name: "invalid redirects",
+			redirects: "/no-target\n" +
+				"/q q=:term\n" +
+				"/bad-status /x abc\n" +
+				"/server-error /x 500\n" +
+				"/external-rewrite https://example.com/ 200\n" +
+				"/ok /x 302!\n",
+			want: siteRules{redirects: []redirectRule{
+				{from: "/ok", to: "/x", status: 302, force: true},
+			}},
+		},
+		{
+			name: "headers",
+			headers: "  X-Orphan: dropped\n" +
+				"# Comment\n" +
+				"/*\n" +
+				"  X-Frame-Options: DENY\n" +
+				"  Link: </a.css>; rel=preload\n" +
+				"  Link: </b.js>; rel=preload\n" +
+				"\n" +
+				"/assets/*\n" +
+				"\tCache-Control:  max-age=31536000 \n" +
+				"\tnot a header\n",
+			want: siteRules{headers: []headerRule{
+				{pattern: "/*", headers: http.Header{
+					"X-Frame-Options": {"DENY"},
+					"Link":            {"</a.css>; rel=preload", "</b.js>; rel=preload"},
+				}},
+				{pattern: "/assets/*", headers: http.Header{"Cache-Control": {"max-age=31536000"}}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.redirects != "" {
+				writeSiteFile(t, dir, redirectsFile, tt.redirects)
+			}
+			if tt.headers != "" {
+				writeSiteFile(t, dir, headersFile, tt.headers)
+			}
+			if got := loadSiteRules(dir); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("loadSiteRules() =\n%+v\nwant\n%+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSiteRulesHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeSiteFile(t, dir, redirectsFile,
+		"/old /new\n"+
+			"/temp /elsewhere 302\n"+
+			"/blog/:year/:slug /posts/:year-:slug.html\n"+
+			"/docs/* /guide/:splat\n"+
+			"/app/* /index.html 200\n"+
+			"/show/:id /item?id=:id 200\n"+
+			"/existing.html /shadowed\n"+
+			"/forced.html /target 302!\n"+
+			"/search q=:term /find/:term 302\n"+
+			"/gone /404.html 404\n"+
+			"/ext https://example.com/ 308\n")
+	writeSiteFile(t, dir, headersFile,
+		"/*\n"+
+			"  X-Frame-Options: DENY\n"+
+			"/assets/*\n"+
+			"  Cache-Control: max-age=31536000\n"+
+			"/blog/:year/:slug\n"+
+			"  X-Blog: yes\n")
+	writeSiteFile(t, dir, "existing.html", "existing")
+	writeSiteFile(t, dir, "forced.html", "forced")
+	writeSiteFile(t, dir, "404.html", "<p>Not here</p>")
+
+	s := &Server{rootDir: dir, basePath: "/ui"}
+	s.siteRules.Store(loadSiteRules(dir))
+	next := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "next %s?%s", r.URL.Path, r.URL.RawQuery)
+	}
+
+	tests := []struct {
+		name         string
+		prefix       string
+		target       string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+		wantHeaders  map[string]string
+	}{
+		{name: "default status", target: "/old", wantStatus: 301, wantLocation: "/new",
+			wantHeaders: map[string]string{"X-Frame-Options": "DENY"}},
+		{name: "status and query kept", target: "/temp?a=1", wantStatus: 302, wantLocation: "/elsewhere?a=1"},
+		{name: "placeholders", target: "/blog/2024/hello", wantStatus: 301, wantLocation: "/posts/2024-hello.html",
+			wantHeaders: map[string]string{"X-Blog": "yes", "X-Frame-Options": "DENY"}},
+		{name: "too many segments", target: "/blog/2024/hello/more", wantStatus: 200, wantBody: "next /blog/2024/hello/more?",
+			wantHeaders: map[string]string{"X-Blog": ""}},
+		{name: "splat", target: "/docs/a/b", wantStatus: 301, wantLocation: "/guide/a/b"},
+		{name: "empty splat", target: "/docs/", wantStatus: 301, wantLocation: "/guide/"},
+		{name: "rewrite", target: "/app/settings/profile?tab=2", wantStatus: 200, wantBody: "next /index.html?tab=2"},
+		{name: "rewrite with query", target: "/show/7?x=1", wantStatus: 200, wantBody: "next /item?id=7"},
+		{name: "shadowed by a file", target: "/existing.html", wantStatus: 200, wantBody: "next /existing.html?"},
+		{name: "forced over a file", target: "/forced.html", wantStatus: 302, wantLocation: "/target"},
+		{name: "query placeholder", target: "/search?q=cats", wantStatus: 302, wantLocation: "/find/cats?q=cats"},
+		{name: "missing query parameter", target: "/search", wantStatus: 200, wantBody: "next /search?"},
+		{name: "not found page", target: "/gone", wantStatus: 404, wantBody: "<p>Not here</p>",
+			wantHeaders: map[string]string{"Content-Type": "text/html; charset=utf-8"}},
+		{name: "external", target: "/ext", wantStatus: 308, wantLocation: "https://example.com/"},
+		{name: "no rule", target: "/assets/app.css", wantStatus: 200, wantBody: "next /assets/app.css?",
+			wantHeaders: map[string]string{"Cache-Control": "max-age=31536000", "X-Frame-Options": "DENY"}},
+		{name: "prefixed redirect", prefix: "/files", target: "/files/old", wantStatus: 301, wantLocation: "/ui/files/new"},
+		{name: "prefixed rewrite", prefix: "/files", target: "/files/app/x", wantStatus: 200, wantBody: "next /files/index.html?"},
+		{name: "prefixed headers", prefix: "/files", target: "/files/assets/a.js", wantStatus: 200, wantBody: "next /files/assets/a.js?",
+			wantHeaders: map[string]string{"Cache-Control": "max-age=31536000"}},
+		{name: "prefixed external", prefix: "/files", target: "/files/ext", wantStatus: 308, wantLocation: "https://example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			siteRulesHandler(s, tt.prefix, next)(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func writeSiteFile(t *testing.T, dir, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+const (
+	// maxHighlightSize is the largest file shown highlighted in one page.
+	// Larger files are shown as plain text in pages of sourcePageLines.
+	maxHighlightSize = 1 << 20
+	sourcePageLines  = 2000
+	// encodingSniffSize is how much of a file is inspected to tell text
+	// from binary and to guess its encoding.
+	encodingSniffSize = 8 << 10
+)
+
+// Text encodings recognised by detectTextEncoding.
+const (
+	encodingUTF8    = "UTF-8"
+	encodingUTF16LE = "UTF-16LE"
+	encodingUTF16BE = "UTF-16BE"
+	encodingLatin1  = "ISO-8859-1"
+)
+
+var (
+	sourceStyle     = styles.Get("catppuccin-mocha")
+	sourceFormatter = chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.WithLinkableLineNumbers(true, "L"),
+	)
+	sourceCSS = func() template.CSS {
+		var buf bytes.Buffer
+		if err := sourceFormatter.WriteCSS(&buf, sourceStyle); err != nil {
+			log.Printf("Error generating syntax highlighting CSS: %v", err)
+		}
+		return template.CSS(buf.String())
+	}()
+)
+
+// detectTextEncoding guesses the encoding of a file from its first bytes.
+// It returns the encoding and the length of its byte order mark, or ok false
+// when the sample looks binary.
+func detectTextEncoding(sample []byte) (encoding string, bomLen int, ok bool) {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		return encodingUTF8, 3, true
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return encodingUTF16LE, 2, true
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return encodingUTF16BE, 2, true
+	}
+	if len(sample) == 0 {
+		return encodingUTF8, 0, true
+	}
+
+	// Without a BOM, UTF-16 text in a Latin script shows up as every other
+	// byte being zero.
+	var evenZeros, oddZeros int
+	for i, b := range sample {
+		if b == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	half := len(sample) / 2
+	switch {
+	case half > 0 && oddZeros > half*2/5 && evenZeros < half/20:
+		return encodingUTF16LE, 0, true
+	case half > 0 && evenZeros > half*2/5 && oddZeros < half/20:
+		return encodingUTF16BE, 0, true
+	case evenZeros+oddZeros > 0:
+		return "", 0, false
+	}
+
+	var control int
+	for _, b := range sample {
+		if (b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != '\b' && b != 0x1b) || b == 0x7f {
+			control++
+		}
+	}
+	if control > len(sample)/10 {
+		return "", 0, false
+	}
+	// The sample may end in the middle of a multi-byte sequence.
+	trimmed := sample
+	for i := len(trimmed) - 1; i >= 0 && i >= len(trimmed)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(trimmed[i]) {
+			if !utf8.FullRune(trimmed[i:]) {
+				trimmed = trimmed[:i]
+			}
+			break
+		}
+	}
+	if utf8.Valid(trimmed) {
+		return encodingUTF8, 0, true
+	}
+	return encodingLatin1, 0, true
+}
+
+// decodeText converts data in encoding to a UTF-8 string.
+func decodeText(data []byte, encoding string) string {
+	switch encoding {
+	case encodingUTF16LE, encodingUTF16BE:
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			if encoding == encodingUTF16LE {
+				units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+			} else {
+				units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+			}
+		}
+		return string(utf16.Decode(units))
+	case encodingLatin1:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return strings.ToValidUTF8(string(data), "�")
+}
+
+// serveSourceView shows a text file with syntax highlighting and line
+// anchors. Binary files are left to the raw file handler.
+func (s *Server) serveSourceView(w http.ResponseWriter, r *http.Request, fullPath string, page viewPage) bool {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	sample := make([]byte, encodingSniffSize)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		log.Printf("Error reading '%s' for view: %v", fullPath, err)
+		return false
+	}
+	encoding, bomLen, ok := detectTextEncoding(sample[:n])
+	if !ok {
+		return false
+	}
+	if _, err := file.Seek(int64(bomLen), io.SeekStart); err != nil {
+		return false
+	}
+
+	page.Class = "source-view"
+	page.Style = sourceCSS
+	page.Script = "viewer.js"
+	if encoding != encodingUTF16LE && encoding != encodingUTF16BE {
+		page.TailURL = page.RawURL + "?view=tail"
+	}
+	if info.Size() > maxHighlightSize {
+		// Paging splits on newline bytes, which UTF-16 does not allow.
+		if encoding == encodingUTF16LE || encoding == encodingUTF16BE {
+			return false
+		}
+		return s.servePagedSource(w, r, file, encoding, page)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("Error reading '%s' for view: %v", fullPath, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return true
+	}
+	source := decodeText(data, encoding)
+	lexer := lexers.Match(page.Name)
+	if lexer == nil {
+		lexer = lexers.Analyse(source)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	content, err := highlightSource(lexer, source, 1)
+	if err != nil {
+		log.Printf("Error highlighting '%s': %v", fullPath, err)
+		http.Error(w, "Error rendering file", http.StatusInternalServerError)
+		return true
+	}
+	page.Content = content
+	lineCount := strings.Count(source, "\n")
+	if source != "" && !strings.HasSuffix(source, "\n") {
+		lineCount++
+	}
+	page.Info = fmt.Sprintf("%s · %s · %d lines", lexer.Config().Name, encoding, lineCount)
+	s.writeViewPage(w, page)
+	return true
+}
+
+// servePagedSource shows one page of a large text file without
+// highlighting. Line numbers and anchors count from the start of the file.
+func (s *Server) servePagedSource(w http.ResponseWriter, r *http.Request, file *os.File, encoding string, page viewPage) bool {
+	pageNo, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || pageNo < 1 {
+		pageNo = 1
+	}
+	firstLine := (pageNo-1)*sourcePageLines + 1
+
+	var lines strings.Builder
+	reader := bufio.NewReader(file)
+	lineNo := 0
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 || err == nil {
+			lineNo++
+			if lineNo >= firstLine && lineNo < firstLine+sourcePageLines {
+				lines.WriteString(decodeText(line, encoding))
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			// The remainder of an over long line continues the same line.
+			lineNo--
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading '%s' for paged view: %v", file.Name(), err)
+			}
+			break
+		}
+	}
+	if lineNo < firstLine && pageNo > 1 {
+		http.Error(w, "Page out of range", http.StatusNotFound)
+		return true
+	}
+
+	content, err := highlightSource(lexers.Fallback, lines.String(), firstLine)
+	if err != nil {
+		log.Printf("Error rendering '%s': %v", file.Name(), err)
+		http.Error(w, "Error rendering file", http.StatusInternalServerError)
+		return true
+	}
+	lastLine := min(firstLine+sourcePageLines-1, lineNo)
+	pageURL := func(n int) string {
+		query := url.Values{"view": {"1"}, "page": {strconv.Itoa(n)}}
+		return page.RawURL + "?" + query.Encode()
+	}
+	page.Content = content
+	page.Info = fmt.Sprintf("%s · too large to highlight", encoding)
+	page.Pager = fmt.Sprintf("Lines %d-%d of %d", firstLine, lastLine, lineNo)
+	page.PageLines = sourcePageLines
+	if pageNo > 1 {
+		page.PrevURL = pageURL(pageNo - 1)
+	}
+	if lastLine < lineNo {
+		page.NextURL = pageURL(pageNo + 1)
+	}
+	s.writeViewPage(w, page)
+	return true
+}
+
+// highlightSource renders source as a chroma code block whose line numbers
+// start at firstLine and link to #L<n> anchors.
+func highlightSource(lexer chroma.Lexer, source string, firstLine int) (template.HTML, error) {
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, source)
+	if err != nil {
+		return "", err
+	}
+	formatter := sourceFormatter
+	if firstLine != 1 {
+		formatter = chromahtml.New(
+			chromahtml.WithClasses(true),
+			chromahtml.WithLineNumbers(true),
+			chromahtml.WithLinkableLineNumbers(true, "L"),
+			chromahtml.BaseLineNumber(firstLine),
+		)
+	}
+	var buf bytes.Buffer
+	if err := formatter.Format(&buf, sourceStyle, iterator); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,154 @@
+// "Cast to device": every open browser can register a device name over the
+// /ws websocket, and any other browser can tell it to open a file.
+import { escapeHTML } from "./escape.js";
+
+const idKey = "serveDeviceId";
+const nameKey = "serveDeviceName";
+
+// The device id stays the same across reloads and reconnects, so a device
+// open in several tabs is listed once.
+function deviceID() {
+  let id = localStorage.getItem(idKey);
+  if (!id) {
+    const bytes = crypto.getRandomValues(new Uint8Array(16));
+    id = Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+    localStorage.setItem(idKey, id);
+  }
+  return id;
+}
+
+export function deviceName() {
+  return localStorage.getItem(nameKey) || "";
+}
+
+export function createCast(basePath) {
+  const id = deviceID();
+  let ws = null;
+  let targets = [];
+  const listeners = [];
+  let menu = null;
+
+  function register() {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+      ws.send(JSON.stringify({ type: "register", id: id, name: deviceName() }));
+    }
+  }
+
+  function closeMenu() {
+    if (menu) menu.remove();
+    menu = null;
+  }
+
+  document.addEventListener("click", (event) => {
+    if (menu && !menu.contains(event.target)) closeMenu();
+  });
+  document.addEventListener("keydown", (event) => {
+    if (event.key === "Escape") closeMenu();
+  });
+
+  const cast = {
+    // attach registers the device on a newly opened /ws connection.
+    attach(socket) {
+      ws = socket;
+      register();
+    },
+
+    // handle processes cast messages and reports whether data was one.
+    handle(data) {
+      switch (data.type) {
+        case "devices":
+          targets = data.devices.filter((device) => device.id !== id);
+          listeners.forEach((listener) => listener(targets));
+          return true;
+        case "open":
+          window.location.href = basePath + data.url;
+          return true;
+        case "cast-result":
+          if (!data.ok) alert("The device is no longer connected.");
+          return true;
+      }
+      return false;
+    },
+
+    targets() {
+      return targets;
+    },
+
+    onTargetsChange(listener) {
+      listeners.push(listener);
+    },
+
+    rename() {
+      const name = prompt(
+        "Name this device so others can cast to it (leave empty to hide it):",
+        deviceName(),
+      );
+      if (name === null) return;
+      localStorage.setItem(nameKey, name.trim().slice(0, 64));
+      register();
+    },
+
+    send(target, url) {
+      if (!ws || ws.readyState !== WebSocket.OPEN) {
+        alert("Not connected to the server.");
+        return;
+      }
+      ws.send(JSON.stringify({ type: "cast", to: target, url: url }));
+    },
+
+    // showMenu lists the devices to cast url to below anchor. url is
+    // relative to the UI, such as "/files/movie.mp4?view=player".
+    showMenu(anchor, url) {
+      closeMenu();
+      menu = document.createElement("div");
+      menu.className = "cast-menu";
+      menu.innerHTML = targets.length
+        ? targets
+            .map(
+              (device) =>
+                `<button data-id="${escapeHTML(device.id)}">📺 ${escapeHTML(device.name)}</button>`,
+            )
+            .join("")
+        : "<span>No other devices. Name a device in its browser to cast to it.</span>";
+      menu.addEventListener("click", (event) => {
+        const button = event.target.closest("button");
+        if (!button) return;
+        cast.send(button.dataset.id, url);
+        closeMenu();
+      });
+      const rect = anchor.getBoundingClientRect();
+      menu.style.top = `${rect.bottom + window.scrollY + 4}px`;
+      menu.style.left = `${Math.max(8, rect.right + window.scrollX - 220)}px`;
+      document.body.appendChild(menu);
+    },
+  };
+  return cast;
+}
+
+// connectCast keeps a /ws connection for pages other than the listing, so
+// they can be cast to and cast from. Other features of the page share the
+// connection through onOpen, called on every (re)connect, and onMessage.
+export function connectCast(basePath, hooks = {}) {
+  const cast = createCast(basePath);
+  function connect() {
+    const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
+    const ws = new WebSocket(
+      `${protocol}//${window.location.host}${basePath}/ws`,
+    );
+    ws.onopen = () => {
+      cast.attach(ws);
+      if (hooks.onOpen) hooks.onOpen(ws);
+    };
+    ws.onmessage = (event) => {
+      try {
+        const data = JSON.parse(event.data);
+        if (!cast.handle(data) && hooks.onMessage) hooks.onMessage(data);
+      } catch (e) {
+        console.error("Error processing WebSocket message:", e);
+      }
+    };
+    ws.onclose = () => setTimeout(connect, 3000);
+  }
+  connect();
+  return cast;
+}
@@ -0,0 +1,23 @@
+// Makes the player page a cast target, lets its "Cast" button send the file
+// on show to another device, and runs watch parties over the same /ws
+// connection.
+import { connectCast } from "./cast.js";
+import { createParty } from "./party.js";
+
+const basePath = document.body.dataset.base || "";
+const player = document.getElementById("player");
+const party = player
+  ? createParty(basePath, player, document.querySelector(".player").dataset.path)
+  : null;
+const cast = connectCast(basePath, {
+  onOpen: (ws) => party && party.attach(ws),
+  onMessage: (data) => party && party.handle(data),
+});
+const button = document.getElementById("castBtn");
+if (button) {
+  button.addEventListener("click", (event) => {
+    event.preventDefault();
+    event.stopPropagation();
+    cast.showMenu(button, button.dataset.url);
+  });
+}
@@ -0,0 +1,8 @@
+// Escaping for markup built from file names and other text the server
+// doesn't control. Quotes are escaped too, so the result is also safe in
+// quoted attribute values.
+const entities = { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" };
+
+export function escapeHTML(text) {
+  return String(text).replace(/[&<>"']/g, (c) => entities[c]);
+}
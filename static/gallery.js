@@ -0,0 +1,169 @@
+// Gallery view of the current directory: a grid of server-rendered
+// thumbnails from /api/gallery and a lightbox that prefetches the
+// neighbouring images.
+import { escapeHTML } from "./escape.js";
+
+const thumbSize = 320;
+const largeSize = 1920;
+
+export function createGallery(basePath) {
+  const grid = document.getElementById("gallery");
+  const lightbox = document.getElementById("lightbox");
+  const lightboxImage = document.getElementById("lightboxImage");
+  const caption = document.getElementById("lightboxCaption");
+  const options = {
+    recursive: document.getElementById("galleryRecursive"),
+    group: document.getElementById("galleryGroup"),
+  };
+  let images = [];
+  let current = -1;
+  let request = 0;
+
+  function thumbURL(image) {
+    if (!image.thumb) return `${basePath}${image.url}`;
+    return `${basePath}${image.thumb}&w=${thumbSize}&h=${thumbSize}&fit=cover`;
+  }
+
+  // Animated GIFs and formats the server cannot resize are shown as is.
+  function largeURL(image) {
+    if (!image.thumb || image.name.toLowerCase().endsWith(".gif"))
+      return `${basePath}${image.url}`;
+    return `${basePath}${image.thumb}&w=${largeSize}&h=${largeSize}`;
+  }
+
+  function renderTile(image, index) {
+    return `
+      <a class="gallery-item" href="${basePath}${image.url}" data-index="${index}" title="${escapeHTML(image.path)}">
+        <img src="${thumbURL(image)}" alt="${escapeHTML(image.name)}" loading="lazy">
+      </a>`;
+  }
+
+  function render(data) {
+    images = data.images;
+    if (images.length === 0) {
+      grid.innerHTML =
+        '<div class="empty-state"><h3>No Images</h3><p>This directory contains no images.</p></div>';
+      return;
+    }
+    let html = "";
+    if (data.groups) {
+      let index = 0;
+      for (const group of data.groups) {
+        const date = new Date(`${group.date}T00:00:00`).toLocaleDateString(
+          [],
+          { year: "numeric", month: "long", day: "numeric" },
+        );
+        html += `<h3 class="gallery-date">${date} <span>${group.count}</span></h3><div class="gallery-grid">`;
+        for (let i = 0; i < group.count; i++, index++) {
+          html += renderTile(images[index], index);
+        }
+        html += "</div>";
+      }
+    } else {
+      html += '<div class="gallery-grid">';
+      images.forEach((image, index) => (html += renderTile(image, index)));
+      html += "</div>";
+    }
+    if (data.truncated) {
+      html += `<p class="gallery-note">Showing the first ${images.length} images.</p>`;
+    }
+    grid.innerHTML = html;
+  }
+
+  function load(path) {
+    const params = new URLSearchParams({ path: path });
+    if (options.recursive.checked) params.set("recursive", "true");
+    if (options.group.checked) params.set("group", "date");
+    const id = ++request;
+    fetch(`${basePath}/api/gallery?${params}`)
+      .then((response) => {
+        if (!response.ok)
+          throw new Error(`HTTP error! status: ${response.status}`);
+        return response.json();
+      })
+      .then((data) => {
+        // Ignore responses to requests that have been superseded.
+        if (id === request) render(data);
+      })
+      .catch((error) => {
+        console.error("Error loading gallery:", error);
+        grid.innerHTML =
+          '<div class="empty-state"><h3>Error</h3><p>Failed to load the gallery. Check console for details.</p></div>';
+      });
+  }
+
+  function describe(image) {
+    const parts = [`<strong>${escapeHTML(image.name)}</strong>`];
+    if (image.width) parts.push(`${image.width} × ${image.height}`);
+    const date = new Date(image.taken || image.modTime);
+    parts.push(date.toLocaleString());
+    if (image.camera) parts.push(escapeHTML(image.camera));
+    if (image.gps) {
+      const { lat, lon } = image.gps;
+      parts.push(
+        `<a href="https://www.openstreetmap.org/?mlat=${lat}&mlon=${lon}#map=15/${lat}/${lon}" target="_blank" rel="noopener">📍 ${lat.toFixed(5)}, ${lon.toFixed(5)}</a>`,
+      );
+    }
+    parts.push(
+      `<a href="${basePath}${image.url}" target="_blank">Original</a>`,
+    );
+    return parts.join(" · ");
+  }
+
+  function prefetch(index) {
+    if (index >= 0 && index < images.length) {
+      new Image().src = largeURL(images[index]);
+    }
+  }
+
+  function show(index) {
+    if (index < 0 || index >= images.length) return;
+    current = index;
+    const image = images[index];
+    lightboxImage.src = largeURL(image);
+    lightboxImage.alt = image.name;
+    caption.innerHTML = describe(image);
+    lightbox.hidden = false;
+    document.body.classList.add("lightbox-open");
+    prefetch(index + 1);
+    prefetch(index - 1);
+  }
+
+  function close() {
+    lightbox.hidden = true;
+    lightboxImage.removeAttribute("src");
+    document.body.classList.remove("lightbox-open");
+    current = -1;
+  }
+
+  grid.addEventListener("click", (event) => {
+    const tile = event.target.closest(".gallery-item");
+    if (!tile || event.ctrlKey || event.metaKey || event.shiftKey) return;
+    event.preventDefault();
+    show(parseInt(tile.dataset.index, 10));
+  });
+  document
+    .getElementById("lightboxPrev")
+    .addEventListener("click", () => show(current - 1));
+  document
+    .getElementById("lightboxNext")
+    .addEventListener("click", () => show(current + 1));
+  document.getElementById("lightboxClose").addEventListener("click", close);
+  lightbox.addEventListener("click", (event) => {
+    if (event.target === lightbox) close();
+  });
+  document.addEventListener("keydown", (event) => {
+    if (lightbox.hidden) return;
+    if (event.key === "Escape") close();
+    else if (event.key === "ArrowLeft") show(current - 1);
+    else if (event.key === "ArrowRight") show(current + 1);
+  });
+
+  return {
+    load,
+    onOptionsChange(callback) {
+      options.recursive.addEventListener("change", callback);
+      options.group.addEventListener("change", callback);
+    },
+  };
+}
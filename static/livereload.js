@@ -0,0 +1,86 @@
+// Live reload client injected into HTML pages when serve runs with
+// --live-reload. It listens for debounced "reload" messages on the websocket
+// and reloads the page, or swaps stylesheets in place for CSS-only changes.
+(function () {
+  const script = document.currentScript;
+  const wsPath = script.dataset.ws;
+  const prefix = script.dataset.prefix || "";
+
+  function decodedPath(url) {
+    try {
+      return decodeURIComponent(new URL(url, window.location.href).pathname);
+    } catch (e) {
+      return "";
+    }
+  }
+
+  // URLs the current page may have been served from, e.g. "/docs/" is
+  // docs/index.html and "/about" may be about.html.
+  function pageCandidates() {
+    let path = decodedPath(window.location.href);
+    if (path.endsWith("/")) path += "index.html";
+    return [path, path + ".html"];
+  }
+
+  function loadedResources() {
+    const urls = new Set();
+    for (const entry of performance.getEntriesByType("resource")) {
+      urls.add(decodedPath(entry.name));
+    }
+    document
+      .querySelectorAll("link[href], script[src], img[src], source[src]")
+      .forEach((el) => urls.add(decodedPath(el.href || el.src)));
+    return urls;
+  }
+
+  function swapStylesheet(path) {
+    let swapped = false;
+    document.querySelectorAll('link[rel="stylesheet"]').forEach((link) => {
+      const url = new URL(link.href, window.location.href);
+      if (decodeURIComponent(url.pathname) !== path) return;
+      url.searchParams.set("livereload", Date.now());
+      const replacement = link.cloneNode();
+      replacement.href = url.toString();
+      replacement.addEventListener("load", () => link.remove());
+      link.after(replacement);
+      swapped = true;
+    });
+    return swapped;
+  }
+
+  function handleReload(data) {
+    if (data.all) {
+      window.location.reload();
+      return;
+    }
+    const changed = (data.paths || []).map((p) => prefix + p);
+    const page = pageCandidates();
+    const resources = loadedResources();
+    let reload = false;
+    for (const path of changed) {
+      if (page.includes(path)) {
+        reload = true;
+        continue;
+      }
+      if (path.endsWith(".css") && swapStylesheet(path)) continue;
+      if (resources.has(path)) reload = true;
+    }
+    if (reload) window.location.reload();
+  }
+
+  function connect() {
+    const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
+    const ws = new WebSocket(`${protocol}//${window.location.host}${wsPath}`);
+    ws.onmessage = (event) => {
+      try {
+        const data = JSON.parse(event.data);
+        if (data.type === "reload") handleReload(data);
+      } catch (e) {
+        console.error("Live reload: bad message", e);
+      }
+    };
+    ws.onclose = () => setTimeout(connect, 1000);
+  }
+
+  connect();
+})();
@@ -0,0 +1,210 @@
+// Watch party on the player page (?view=player&party=<room>): members play
+// the same file in sync over the /ws hub. The server keeps the playback
+// state with its own timestamps; each member estimates its clock offset
+// and corrects drift by nudging the playback rate, or seeking when far off.
+import { deviceName } from "./cast.js";
+import { escapeHTML } from "./escape.js";
+
+const syncInterval = 1000;
+const pingInterval = 30000;
+const seekThreshold = 1; // seconds of drift corrected by seeking
+const rateThreshold = 0.15; // seconds of drift corrected by the playback rate
+const maxNameLength = 64;
+
+function newRoomID() {
+  const bytes = crypto.getRandomValues(new Uint8Array(8));
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+export function createParty(basePath, player, path) {
+  const panel = document.getElementById("party");
+  const status = document.getElementById("partyStatus");
+  const members = document.getElementById("partyMembers");
+  let room = new URLSearchParams(window.location.search).get("party");
+  let ws = null;
+  let state = null; // Last party-state from the server
+  let offset = 0; // Server clock minus local clock, in ms
+  let bestRTT = Infinity;
+  let correcting = false; // Set while applying the server's state
+  let timers = [];
+
+  function send(message) {
+    if (ws && ws.readyState === WebSocket.OPEN) ws.send(JSON.stringify(message));
+  }
+
+  function ping() {
+    send({ type: "party-ping", clientTime: Date.now() });
+  }
+
+  // expected is where playback should be now according to the server.
+  function expected() {
+    if (!state.playing) return state.position;
+    return state.position + (Date.now() + offset - state.serverTime) / 1000;
+  }
+
+  function setStatus(text) {
+    status.textContent = text;
+  }
+
+  function seek(position) {
+    correcting = true;
+    player.currentTime = Math.max(0, position);
+  }
+
+  function sync() {
+    if (!state || player.readyState < 1) return;
+    const target = expected();
+    if (state.playing && player.paused && !player.ended) {
+      seek(target);
+      player.play().catch(() => setStatus("Press play to join the party"));
+      return;
+    }
+    if (!state.playing) {
+      if (!player.paused) {
+        correcting = true;
+        player.pause();
+      }
+      if (Math.abs(player.currentTime - target) > rateThreshold) seek(target);
+      player.playbackRate = 1;
+      return;
+    }
+    const drift = player.currentTime - target;
+    if (Math.abs(drift) > seekThreshold) {
+      seek(target);
+      player.playbackRate = 1;
+    } else if (Math.abs(drift) > rateThreshold) {
+      player.playbackRate = drift > 0 ? 0.95 : 1.05;
+    } else {
+      player.playbackRate = 1;
+    }
+  }
+
+  // Local play, pause and seek are sent only when they change the room's
+  // state, so a member joining late or catching up doesn't rewind everyone.
+  player.addEventListener("play", () => {
+    if (!state || correcting) return;
+    if (!state.playing)
+      send({ type: "party-control", action: "play", position: player.currentTime });
+    else sync();
+  });
+  player.addEventListener("pause", () => {
+    if (!state || correcting) {
+      correcting = false;
+      return;
+    }
+    if (state.playing)
+      send({ type: "party-control", action: "pause", position: player.currentTime });
+  });
+  player.addEventListener("seeked", () => {
+    if (!state || correcting) {
+      correcting = false;
+      return;
+    }
+    if (Math.abs(player.currentTime - expected()) > seekThreshold)
+      send({ type: "party-control", action: "seek", position: player.currentTime });
+  });
+
+  function showLink() {
+    const url = new URL(window.location.href);
+    url.searchParams.set("view", "player");
+    url.searchParams.set("party", room);
+    window.history.replaceState(null, "", url);
+    return url.toString();
+  }
+
+  function start() {
+    if (!room) room = newRoomID();
+    panel.hidden = false;
+    showLink();
+    setStatus(`Room ${room}`);
+    if (ws) attach(ws);
+  }
+
+  function leave() {
+    send({ type: "party-leave" });
+    timers.forEach(clearInterval);
+    timers = [];
+    room = null;
+    state = null;
+    player.playbackRate = 1;
+    panel.hidden = true;
+    const url = new URL(window.location.href);
+    url.searchParams.delete("party");
+    window.history.replaceState(null, "", url);
+  }
+
+  // attach joins the room on a newly opened /ws connection.
+  function attach(socket) {
+    ws = socket;
+    if (!room) return;
+    const name = (deviceName() || localStorage.getItem("servePartyName") || "Guest").slice(0, maxNameLength);
+    send({ type: "party-join", room: room, name: name, path: path });
+    bestRTT = Infinity;
+    timers.forEach(clearInterval);
+    // A burst of pings for a first offset estimate, then occasional ones.
+    for (let i = 0; i < 5; i++) setTimeout(ping, i * 200);
+    timers = [setInterval(sync, syncInterval), setInterval(ping, pingInterval)];
+  }
+
+  function handle(data) {
+    switch (data.type) {
+      case "party-state":
+        if (data.room !== room) return true;
+        if (data.path !== path) {
+          // The room plays another file: follow it.
+          window.location.href = `${basePath}${data.url}?view=player&party=${encodeURIComponent(room)}`;
+          return true;
+        }
+        state = data;
+        if (data.by) {
+          setStatus(`Room ${room} · ${data.playing ? "▶" : "⏸"} by ${data.by}`);
+        }
+        sync();
+        return true;
+      case "party-members":
+        if (data.room === room)
+          members.innerHTML = data.members.map(escapeHTML).join(", ");
+        return true;
+      case "party-pong": {
+        // The sample with the shortest round trip gives the best estimate.
+        const now = Date.now();
+        const rtt = now - data.clientTime;
+        if (rtt <= bestRTT) {
+          bestRTT = rtt;
+          offset = data.serverTime - (data.clientTime + rtt / 2);
+        }
+        return true;
+      }
+      case "party-error":
+        setStatus(data.error);
+        return true;
+    }
+    return false;
+  }
+
+  document.getElementById("partyStart").addEventListener("click", (event) => {
+    event.preventDefault();
+    if (!deviceName() && !localStorage.getItem("servePartyName")) {
+      const name = prompt("Your name in the watch party:", "");
+      if (name) localStorage.setItem("servePartyName", name.trim());
+    }
+    start();
+  });
+  document.getElementById("partyCopy").addEventListener("click", (event) => {
+    event.preventDefault();
+    const link = showLink();
+    navigator.clipboard
+      ? navigator.clipboard.writeText(link).then(() => setStatus("Link copied"), () => prompt("Share this link:", link))
+      : prompt("Share this link:", link);
+  });
+  document.getElementById("partyLeave").addEventListener("click", (event) => {
+    event.preventDefault();
+    leave();
+  });
+  if (room) {
+    panel.hidden = false;
+    setStatus(`Room ${room}`);
+  }
+
+  return { attach, handle };
+}
@@ -0,0 +1,89 @@
+// Media player page (?view=player). Shows the subtitle track matching the
+// browser language, and resumes from and reports to /api/progress.
+(function () {
+  const basePath = document.body.dataset.base || "";
+  const container = document.querySelector(".player");
+  const player = document.getElementById("player");
+  const reportInterval = 15000;
+
+  function selectSubtitles() {
+    const tracks = Array.from(player.textTracks || []);
+    if (tracks.length === 0) return;
+    const languages = (navigator.languages || [navigator.language]).map(
+      (language) => language.toLowerCase().split("-")[0],
+    );
+    let preferred = tracks[0];
+    for (const language of languages) {
+      const match = tracks.find((track) => track.language === language);
+      if (match) {
+        preferred = match;
+        break;
+      }
+    }
+    tracks.forEach((track) => {
+      track.mode = track === preferred ? "showing" : "disabled";
+    });
+  }
+
+  function formatPosition(seconds) {
+    const s = Math.floor(seconds % 60);
+    const m = Math.floor(seconds / 60) % 60;
+    const h = Math.floor(seconds / 3600);
+    const mm = h ? String(m).padStart(2, "0") : m;
+    return `${h ? h + ":" : ""}${mm}:${String(s).padStart(2, "0")}`;
+  }
+
+  // Positions are kept per profile name, set in the "Continue" view.
+  function rememberPosition() {
+    const path = container.dataset.path;
+    const user = localStorage.getItem("serveProfile") || "";
+    const url = `${basePath}/api/progress`;
+    let lastReport = 0;
+
+    function report(watched) {
+      if (!player.duration || player.currentTime === 0) return;
+      lastReport = Date.now();
+      const body = {
+        path: path,
+        user: user,
+        position: player.currentTime,
+        duration: player.duration,
+      };
+      if (watched !== undefined) body.watched = watched;
+      navigator.sendBeacon(url, JSON.stringify(body));
+    }
+
+    player.addEventListener("loadedmetadata", () => {
+      const params = new URLSearchParams({ path: path, user: user });
+      fetch(`${url}?${params}`)
+        .then((response) => (response.ok ? response.json() : null))
+        .then((progress) => {
+          if (!progress || progress.watched || player.currentTime > 0) return;
+          player.currentTime = progress.position;
+          const resume = document.getElementById("playerResume");
+          resume.innerHTML = `Resumed at ${formatPosition(progress.position)} · <a href="#">Start over</a>`;
+          resume.hidden = false;
+          resume.querySelector("a").addEventListener("click", (event) => {
+            event.preventDefault();
+            player.currentTime = 0;
+            resume.hidden = true;
+          });
+        })
+        .catch((error) => console.error("Error loading position:", error));
+    });
+    player.addEventListener("timeupdate", () => {
+      if (!player.paused && Date.now() - lastReport >= reportInterval)
+        report();
+    });
+    player.addEventListener("pause", () => {
+      if (!player.ended) report();
+    });
+    player.addEventListener("ended", () => report(true));
+    document.addEventListener("visibilitychange", () => {
+      if (document.visibilityState === "hidden" && !player.ended) report();
+    });
+  }
+
+  selectSubtitles();
+  if (container.dataset.progress === "true") rememberPosition();
+})();
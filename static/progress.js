@@ -0,0 +1,100 @@
+// "Continue watching" view: the partially played audio and video from
+// /api/progress/continue. Positions are kept per profile name, stored in
+// the browser; the empty profile is shared by all devices.
+import { escapeHTML } from "./escape.js";
+
+const profileKey = "serveProfile";
+
+export function progressUser() {
+  return localStorage.getItem(profileKey) || "";
+}
+
+export function formatPosition(seconds) {
+  const s = Math.floor(seconds % 60);
+  const m = Math.floor(seconds / 60) % 60;
+  const h = Math.floor(seconds / 3600);
+  const mm = h ? String(m).padStart(2, "0") : m;
+  return `${h ? h + ":" : ""}${mm}:${String(s).padStart(2, "0")}`;
+}
+
+// progressBar renders the played share of a file, or nothing when the
+// duration is unknown.
+export function progressBar(progress) {
+  if (!progress.duration) return "";
+  const percent = Math.min(100, (progress.position / progress.duration) * 100);
+  return `<span class="progress-bar" title="${formatPosition(progress.position)} / ${formatPosition(progress.duration)}"><span style="width: ${percent.toFixed(1)}%"></span></span>`;
+}
+
+export function createContinueView(basePath, onProfileChange) {
+  const container = document.getElementById("continueWatching");
+  const profile = document.getElementById("progressProfile");
+  const list = document.getElementById("continueList");
+  let request = 0;
+
+  profile.value = progressUser();
+  profile.addEventListener("change", () => {
+    localStorage.setItem(profileKey, profile.value.trim());
+    onProfileChange();
+  });
+
+  function render(items) {
+    if (items.length === 0) {
+      list.innerHTML =
+        '<div class="empty-state"><h3>Nothing to continue</h3><p>Partially played audio and video shows up here.</p></div>';
+      return;
+    }
+    list.innerHTML = items
+      .map(
+        (item) => `
+        <div class="file-item media continue-item">
+            <div class="file-name">
+                <span class="file-icon">${item.kind === "video" ? "🎬" : "🎵"}</span>
+                <a href="${basePath}${item.url}?view=player" target="_blank" title="${escapeHTML(item.path)}">${escapeHTML(item.name)}</a>
+                ${progressBar(item)}
+            </div>
+            <div class="continue-position">${formatPosition(item.position)}${item.duration ? " / " + formatPosition(item.duration) : ""}</div>
+            <div class="file-date">${new Date(item.updated).toLocaleString()}</div>
+            <button class="continue-forget" data-path="${escapeHTML(item.path)}" title="Forget this position">✕</button>
+        </div>`,
+      )
+      .join("");
+  }
+
+  function load() {
+    const params = new URLSearchParams({ user: progressUser() });
+    const id = ++request;
+    fetch(`${basePath}/api/progress/continue?${params}`)
+      .then((response) => {
+        if (!response.ok)
+          throw new Error(`HTTP error! status: ${response.status}`);
+        return response.json();
+      })
+      .then((items) => {
+        if (id === request) render(items);
+      })
+      .catch((error) => {
+        console.error("Error loading continue watching:", error);
+        list.innerHTML =
+          '<div class="empty-state"><h3>Error</h3><p>Failed to load partially played media. Check console for details.</p></div>';
+      });
+  }
+
+  list.addEventListener("click", (event) => {
+    const button = event.target.closest(".continue-forget");
+    if (!button) return;
+    const params = new URLSearchParams({
+      path: button.dataset.path,
+      user: progressUser(),
+    });
+    fetch(`${basePath}/api/progress?${params}`, { method: "DELETE" })
+      .then(load)
+      .catch((error) => console.error("Error forgetting position:", error));
+  });
+
+  return {
+    load,
+    show(visible) {
+      container.style.display = visible ? "" : "none";
+    },
+  };
+}
@@ -1,3 +1,12 @@
+import { createCast, deviceName } from "./cast.js";
+import { escapeHTML } from "./escape.js";
+import { createGallery } from "./gallery.js";
+import {
+  createContinueView,
+  progressBar,
+  progressUser,
+} from "./progress.js";
+
 let ws;
 let directoryData = {};
 let currentSort = {
@@ -5,11 +14,19 @@ let currentSort = {
   order: "asc",
 };
 let currentPath = "";
+// URL prefix of the UI; only set when serve runs in site mode.
+const basePath = document.body.dataset.base || "";
+// "list", "gallery" or "continue", remembered across visits.
+let viewMode = localStorage.getItem("serveViewMode") || "list";
+let gallery;
+let continueView;
+const cast = createCast(basePath);
+const progressEnabled = document.body.dataset.progressEnabled === "true";
 
 function getCurrentPath() {
   const path = window.location.pathname;
-  if (path.startsWith("/browse/")) {
-    return decodeURIComponent(path.substring(8));
+  if (path.startsWith(`${basePath}/browse/`)) {
+    return decodeURIComponent(path.substring(basePath.length + 8));
   }
   return "";
 }
@@ -19,7 +36,7 @@ function updateURL(path) {
     .split("/")
     .map((segment) => encodeURIComponent(segment))
     .join("/");
-  const url = path ? `/browse/${urlPathSegments}` : "/";
+  const url = path ? `${basePath}/browse/${urlPathSegments}` : `${basePath}/`;
   window.history.pushState({ path: path }, "", url);
 }
 
@@ -112,6 +129,27 @@ function getFileClass(file) {
   return "other";
 }
 
+// Audio and video files open in the player page, which attaches subtitles.
+const playableExts = [
+  "mp3",
+  "wav",
+  "flac",
+  "aac",
+  "ogg",
+  "opus",
+  "m4a",
+  "m4b",
+  "mp4",
+  "mkv",
+  "mov",
+  "webm",
+  "m4v",
+];
+
+function isPlayable(file) {
+  return playableExts.includes(file.name.split(".").pop().toLowerCase());
+}
+
 function renderBreadcrumb(data) {
   const breadcrumb = document.getElementById("breadcrumb");
   const path = data.currentPath; // Clean, unencoded current path
@@ -126,9 +164,9 @@ function renderBreadcrumb(data) {
       const isLast = i === parts.length - 1;
       html += '<span class="separator">›</span>';
       if (isLast) {
-        html += `<span class="current">${parts[i]}</span>`;
+        html += `<span class="current">${escapeHTML(parts[i])}</span>`;
       } else {
-        html += `<a href="#" class="nav-link" data-path="${currentPathBuild}">${parts[i]}</a>`;
+        html += `<a href="#" class="nav-link" data-path="${escapeHTML(currentPathBuild)}">${escapeHTML(parts[i])}</a>`;
       }
     }
   }
@@ -174,21 +212,38 @@ function renderFileList(data) {
     const size = file.isDir ? "-" : formatFileSize(file.size);
     const date = formatDate(file.modTime);
     let linkAttributes = "";
+    const subtitles = file.subtitles
+      ? `<span class="file-badge" title="${escapeHTML(file.subtitles.map((track) => track.label).join(", "))}">CC</span>`
+      : "";
+    const castButton =
+      !file.isDir && fileClass === "media"
+        ? `<button class="cast-btn" data-url="${file.path}${isPlayable(file) ? "?view=player" : ""}" title="Cast to another device">📺</button>`
+        : "";
+    let progress = "";
+    if (file.progress) {
+      progress = file.progress.watched
+        ? '<span class="file-badge watched" title="Watched">✓</span>'
+        : progressBar(file.progress);
+    }
 
     if (file.isDir) {
       const newPath = data.currentPath
         ? `${data.currentPath}/${file.name}`
         : file.name;
-      linkAttributes = `href="#" class="nav-link" data-path="${newPath}"`;
+      linkAttributes = `href="#" class="nav-link" data-path="${escapeHTML(newPath)}"`;
     } else {
-      linkAttributes = `href="${file.path}" target="_blank"`;
+      // Non-media files open in the viewer; the server still serves binary
+      // files raw.
+      let view = fileClass === "other" ? "?view=1" : "";
+      if (isPlayable(file)) view = "?view=player";
+      linkAttributes = `href="${basePath}${file.path}${view}" target="_blank"`;
     }
 
     html += `
             <div class="file-item ${fileClass}">
                 <div class="file-name">
                     <span class="file-icon">${icon}</span>
-                    <a ${linkAttributes}>${file.name}</a>
+                    <a ${linkAttributes}>${escapeHTML(file.name)}</a>${subtitles}${progress}${castButton}
                 </div>
                 <div class="file-size">${size}</div>
                 <div class="file-date">${date}</div>
@@ -199,6 +254,18 @@ function renderFileList(data) {
   fileList.innerHTML = html;
 }
 
+// The README is rendered and sanitized by the server.
+function renderReadme(data) {
+  const readme = document.getElementById("readme");
+  if (data.readme) {
+    readme.innerHTML = data.readme;
+    readme.style.display = "block";
+  } else {
+    readme.innerHTML = "";
+    readme.style.display = "none";
+  }
+}
+
 function updateSortIndicators() {
   document.querySelectorAll(".sort-indicator").forEach((indicator) => {
     indicator.textContent = "▲";
@@ -228,8 +295,9 @@ function loadDirectory(path = "") {
     sort: currentSort.column,
     order: currentSort.order,
   });
+  if (progressEnabled && progressUser()) params.set("user", progressUser());
 
-  fetch(`/api/files?${params}`)
+  fetch(`${basePath}/api/files?${params}`)
     .then((response) => {
       if (!response.ok)
         throw new Error(`HTTP error! status: ${response.status}`);
@@ -239,7 +307,11 @@ function loadDirectory(path = "") {
       directoryData = data;
       renderBreadcrumb(data);
       renderFileList(data);
+      renderReadme(data);
+      renderPlaylistLinks(data);
       updateSortIndicators();
+      if (viewMode === "gallery") gallery.load(path);
+      if (viewMode === "continue") continueView.load();
     })
     .catch((error) => {
       console.error("Error loading directory:", error);
@@ -249,6 +321,65 @@ function loadDirectory(path = "") {
     });
 }
 
+// Playlists of the folder and its subfolders for external players, in the
+// listing's sort order.
+function renderPlaylistLinks(data) {
+  const links = document.getElementById("playlistLinks");
+  if (!data.files.some((file) => file.isDir || isPlayable(file))) {
+    links.style.display = "none";
+    return;
+  }
+  for (const format of ["m3u8", "xspf"]) {
+    const params = new URLSearchParams({
+      path: data.currentPath,
+      recursive: "true",
+      format: format,
+      sort: currentSort.column,
+      order: currentSort.order,
+    });
+    document.getElementById(
+      format === "m3u8" ? "playlistM3U" : "playlistXSPF",
+    ).href = `${basePath}/api/playlist?${params}`;
+  }
+  const feedPath = data.currentPath.split("/").map(encodeURIComponent).join("/");
+  document.getElementById("playlistPodcast").href =
+    `${basePath}/feed/podcast/${feedPath}`;
+  links.style.display = "flex";
+}
+
+function applyViewMode() {
+  if (viewMode === "continue" && !progressEnabled) viewMode = "list";
+  const isList = viewMode === "list";
+  const isGallery = viewMode === "gallery";
+  const isContinue = viewMode === "continue";
+  document.querySelector(".file-list-header").style.display = isList
+    ? ""
+    : "none";
+  document.querySelector(".file-list").style.display = isList ? "" : "none";
+  document.getElementById("gallery").style.display = isGallery ? "" : "none";
+  document.getElementById("galleryOptions").style.display = isGallery
+    ? "flex"
+    : "none";
+  document.getElementById("readme").hidden = isContinue;
+  continueView.show(isContinue);
+  document.getElementById("listViewBtn").classList.toggle("active", isList);
+  document
+    .getElementById("galleryViewBtn")
+    .classList.toggle("active", isGallery);
+  document
+    .getElementById("continueViewBtn")
+    .classList.toggle("active", isContinue);
+}
+
+function setViewMode(mode) {
+  if (mode === viewMode) return;
+  viewMode = mode;
+  localStorage.setItem("serveViewMode", mode);
+  applyViewMode();
+  if (mode === "gallery") gallery.load(currentPath);
+  if (mode === "continue") continueView.load();
+}
+
 function handleSort(column) {
   if (currentSort.column === column) {
     currentSort.order = currentSort.order === "asc" ? "desc" : "asc";
@@ -261,21 +392,28 @@ function handleSort(column) {
   loadDirectory(currentPath);
 }
 
+// The server deals files from a per-session shuffle queue, so every file is
+// played once before any repeats.
 function playRandomMedia() {
   const btn = document.getElementById("playRandomBtn");
   btn.disabled = true;
   btn.textContent = "🎲 Loading...";
-  fetch(`/api/random-media?path=${encodeURIComponent(currentPath)}`)
+  const params = new URLSearchParams({ path: currentPath });
+  const type = document.getElementById("randomType").value;
+  if (type) params.set("type", type);
+  if (document.getElementById("randomRecursive").checked)
+    params.set("recursive", "true");
+  fetch(`${basePath}/api/random-media?${params}`)
     .then((response) => {
       if (!response.ok)
         return response.text().then((text) => {
           throw new Error(text || "No media files found or server error");
         });
-      return response.text();
+      return response.json();
     })
-    .then((mediaPath) => {
-      if (mediaPath) window.open(mediaPath, "_blank");
-      else throw new Error("Empty media path received");
+    .then((media) => {
+      const view = media.kind === "image" ? "" : "?view=player";
+      window.open(basePath + media.url + view, "_blank");
     })
     .catch((error) => {
       console.error("Error playing random media:", error);
@@ -287,9 +425,20 @@ function playRandomMedia() {
     });
 }
 
+// Opens the continuous shuffle player with the same options.
+function openShuffle() {
+  const params = new URLSearchParams();
+  const type = document.getElementById("randomType").value;
+  if (type) params.set("type", type);
+  if (document.getElementById("randomRecursive").checked)
+    params.set("recursive", "true");
+  const path = currentPath.split("/").map(encodeURIComponent).join("/");
+  window.open(`${basePath}/shuffle/${path}?${params}`, "_blank");
+}
+
 function initWebSocket() {
   const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
-  const wsUrl = `${protocol}//${window.location.host}/ws`;
+  const wsUrl = `${protocol}//${window.location.host}${basePath}/ws`;
   if (
     ws &&
     (ws.readyState === WebSocket.OPEN || ws.readyState === WebSocket.CONNECTING)
@@ -300,11 +449,13 @@ function initWebSocket() {
   ws.onopen = () => {
     console.log("WebSocket connected");
     updateConnectionStatus("connected");
+    cast.attach(ws);
     loadDirectory(currentPath);
   };
   ws.onmessage = (event) => {
     try {
       const data = JSON.parse(event.data);
+      if (cast.handle(data)) return;
       if (data.type === "update") {
         console.log("Update received, reloading...");
         loadDirectory(currentPath);
@@ -346,6 +497,12 @@ function scrollToTop() {
 
 document.addEventListener("DOMContentLoaded", function () {
   currentPath = getCurrentPath();
+  gallery = createGallery(basePath);
+  gallery.onOptionsChange(() => gallery.load(currentPath));
+  continueView = createContinueView(basePath, () => loadDirectory(currentPath));
+  if (progressEnabled)
+    document.getElementById("continueViewBtn").style.display = "";
+  applyViewMode();
   loadDirectory(currentPath);
   initWebSocket();
 
@@ -385,6 +542,34 @@ document.addEventListener("DOMContentLoaded", function () {
   document
     .getElementById("playRandomBtn")
     .addEventListener("click", playRandomMedia);
+  document.getElementById("shuffleBtn").addEventListener("click", openShuffle);
+  document
+    .getElementById("listViewBtn")
+    .addEventListener("click", () => setViewMode("list"));
+  document
+    .getElementById("galleryViewBtn")
+    .addEventListener("click", () => setViewMode("gallery"));
+  document
+    .getElementById("continueViewBtn")
+    .addEventListener("click", () => setViewMode("continue"));
+  document.getElementById("fileList").addEventListener("click", (event) => {
+    const button = event.target.closest(".cast-btn");
+    if (!button) return;
+    event.preventDefault();
+    event.stopPropagation();
+    cast.showMenu(button, button.dataset.url);
+  });
+  const deviceNameBtn = document.getElementById("deviceNameBtn");
+  const updateDeviceName = () =>
+    (deviceNameBtn.textContent = `📺 ${deviceName() || "Name this device"}`);
+  updateDeviceName();
+  deviceNameBtn.addEventListener("click", () => {
+    cast.rename();
+    updateDeviceName();
+  });
+  cast.onTargetsChange((targets) =>
+    document.body.classList.toggle("has-cast-targets", targets.length > 0),
+  );
   document.getElementById("goToTop").addEventListener("click", scrollToTop);
   window.addEventListener("scroll", handleScroll);
   window.addEventListener("popstate", function (event) {
@@ -0,0 +1,183 @@
+// Continuous shuffle player (/shuffle/<path>). Draws files from the
+// server's shuffle queue at /api/random-media, advancing audio and video when
+// they end and images on a timer. Played files are kept for prev/next.
+import { escapeHTML } from "./escape.js";
+
+(function () {
+  const basePath = document.body.dataset.base || "";
+  const stage = document.getElementById("shuffleStage");
+  const caption = document.getElementById("shuffleCaption");
+  const info = document.getElementById("shuffleInfo");
+  const pauseButton = document.getElementById("shufflePause");
+  const interval = parseInt(stage.dataset.interval, 10) * 1000;
+  const page = new URLSearchParams(window.location.search);
+  const maxHistory = 200;
+  const maxFailures = 5;
+
+  let history = [];
+  let current = -1;
+  let paused = false;
+  let timer = null;
+  let stale = false; // The folder changed since the last draw
+  let failures = 0;
+  let loading = false;
+
+  function draw() {
+    const params = new URLSearchParams({ path: stage.dataset.path });
+    for (const name of ["recursive", "type", "seed"]) {
+      if (page.get(name)) params.set(name, page.get(name));
+    }
+    if (stale) params.set("refresh", "true");
+    stale = false;
+    return fetch(`${basePath}/api/random-media?${params}`).then((response) => {
+      if (!response.ok)
+        return response.text().then((text) => {
+          throw new Error(text || `HTTP error! status: ${response.status}`);
+        });
+      return response.json();
+    });
+  }
+
+  function next() {
+    if (loading) return;
+    if (current < history.length - 1) {
+      show(current + 1);
+      return;
+    }
+    loading = true;
+    draw()
+      .then((media) => {
+        history.push(media);
+        if (history.length > maxHistory) history.shift();
+        show(history.length - 1);
+      })
+      .catch((error) => {
+        console.error("Error drawing random media:", error);
+        clearTimeout(timer);
+        stage.innerHTML = `<div class="empty-state"><h3>Nothing to play</h3><p>${escapeHTML(error.message)}</p></div>`;
+        caption.textContent = "";
+      })
+      .finally(() => {
+        loading = false;
+      });
+  }
+
+  function prev() {
+    if (current > 0) show(current - 1);
+  }
+
+  // Files that fail to load are skipped, up to a few in a row.
+  function skip() {
+    failures++;
+    if (failures < maxFailures) next();
+  }
+
+  function schedule() {
+    clearTimeout(timer);
+    const media = history[current];
+    if (!paused && media && media.kind === "image") {
+      timer = setTimeout(next, interval);
+    }
+  }
+
+  function show(index) {
+    current = index;
+    const media = history[index];
+    const url = basePath + media.url;
+    clearTimeout(timer);
+    stage.innerHTML = "";
+    let element;
+    if (media.kind === "image") {
+      element = document.createElement("img");
+      element.alt = media.name;
+      element.addEventListener("load", () => (failures = 0));
+    } else {
+      element = document.createElement(
+        media.kind === "video" ? "video" : "audio",
+      );
+      element.controls = true;
+      element.autoplay = !paused;
+      element.addEventListener("playing", () => (failures = 0));
+      element.addEventListener("ended", next);
+    }
+    element.addEventListener("error", skip);
+    element.src = url;
+    stage.appendChild(element);
+
+    const title = media.title
+      ? [media.artist, media.title].filter(Boolean).join(" – ")
+      : media.name;
+    caption.innerHTML = `<a href="${url}" target="_blank">${escapeHTML(title)}</a> · ${escapeHTML(media.path)}`;
+    info.textContent = `${media.total - media.remaining} / ${media.total}`;
+    schedule();
+  }
+
+  function togglePause() {
+    paused = !paused;
+    pauseButton.textContent = paused ? "▶ Play" : "⏸ Pause";
+    const player = stage.querySelector("audio, video");
+    if (player) {
+      if (paused) player.pause();
+      else player.play().catch(() => {});
+    }
+    schedule();
+  }
+
+  function toggleFullscreen() {
+    if (document.fullscreenElement) document.exitFullscreen();
+    else stage.requestFullscreen().catch(() => {});
+  }
+
+  document.getElementById("shufflePrev").addEventListener("click", prev);
+  document.getElementById("shuffleNext").addEventListener("click", next);
+  pauseButton.addEventListener("click", togglePause);
+  document
+    .getElementById("shuffleFullscreen")
+    .addEventListener("click", toggleFullscreen);
+  document.addEventListener("keydown", (event) => {
+    if (event.target.closest("input, select, textarea")) return;
+    if (event.key === "ArrowRight" || event.key === "n") next();
+    else if (event.key === "ArrowLeft" || event.key === "p") prev();
+    else if (event.key === " ") togglePause();
+    else if (event.key === "f") toggleFullscreen();
+    else return;
+    event.preventDefault();
+  });
+
+  // Folder changes arrive over the same websocket as the listing's. New
+  // files join the rest of the round on the next draw; if the file on show
+  // is gone, move on.
+  function connect() {
+    const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
+    const ws = new WebSocket(`${protocol}//${window.location.host}${basePath}/ws`);
+    const statusBar = document.getElementById("statusBar");
+    statusBar.className = "status-bar connecting";
+    ws.onopen = () => (statusBar.className = "status-bar connected");
+    ws.onmessage = (event) => {
+      let data;
+      try {
+        data = JSON.parse(event.data);
+      } catch (e) {
+        return;
+      }
+      if (data.type !== "update") return;
+      stale = true;
+      const media = history[current];
+      if (!media) return;
+      fetch(basePath + media.url, { method: "HEAD" }).then((response) => {
+        if (response.status === 404 && history[current] === media) {
+          history.splice(current, 1);
+          current--;
+          next();
+        }
+      });
+    };
+    ws.onclose = () => {
+      statusBar.className = "status-bar disconnected";
+      setTimeout(connect, 3000);
+    };
+  }
+
+  connect();
+  next();
+})();
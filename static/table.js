@@ -0,0 +1,103 @@
+// Table view for CSV, TSV and JSONL files (?view=1). Pages of rows are
+// loaded from /api/table; sorting applies to the rows of the current page.
+import { escapeHTML } from "./escape.js";
+
+(function () {
+  const content = document.getElementById("viewContent");
+  const state = { page: 1, sort: -1, order: "asc", filter: "" };
+
+  content.innerHTML = `
+    <div class="controls table-controls">
+      <input type="text" id="tableFilter" placeholder="Filter rows (text or column:text)" spellcheck="false">
+      <button id="tablePrev">‹ Previous</button>
+      <span class="table-info" id="tableInfo"></span>
+      <button id="tableNext">Next ›</button>
+    </div>
+    <div class="table-scroll"><table class="data-table" id="dataTable"></table></div>
+  `;
+  const table = document.getElementById("dataTable");
+  const info = document.getElementById("tableInfo");
+  const prevBtn = document.getElementById("tablePrev");
+  const nextBtn = document.getElementById("tableNext");
+
+  function render(data) {
+    let html = "<thead><tr>";
+    data.header.forEach((name, i) => {
+      let indicator = "";
+      if (i === state.sort) indicator = state.order === "asc" ? " ▲" : " ▼";
+      html += `<th data-column="${i}">${escapeHTML(name)}${indicator}</th>`;
+    });
+    html += "</tr></thead><tbody>";
+    for (const row of data.rows) {
+      html += "<tr>";
+      for (const cell of row) html += `<td>${escapeHTML(cell)}</td>`;
+      html += "</tr>";
+    }
+    html += "</tbody>";
+    table.innerHTML = html;
+
+    const first = (data.page - 1) * data.pageSize + 1;
+    const count = data.estimated ? `~${data.rowCount}` : data.rowCount;
+    info.textContent = data.rows.length
+      ? `Page ${data.page} · rows ${first}-${first + data.rows.length - 1}` +
+        (state.filter ? " (filtered)" : ` of ${count}`)
+      : "No rows";
+    prevBtn.disabled = data.page <= 1;
+    nextBtn.disabled = !data.hasMore;
+  }
+
+  function load() {
+    const params = new URLSearchParams({ page: state.page });
+    if (state.sort >= 0) {
+      params.set("sort", state.sort);
+      params.set("order", state.order);
+    }
+    if (state.filter) params.set("filter", state.filter);
+    info.textContent = "Loading…";
+    fetch(`${content.dataset.source}&${params}`)
+      .then((response) => {
+        if (!response.ok)
+          throw new Error(`HTTP error! status: ${response.status}`);
+        return response.json();
+      })
+      .then(render)
+      .catch((error) => {
+        console.error("Error loading table:", error);
+        info.textContent = "Failed to load rows";
+      });
+  }
+
+  table.addEventListener("click", (event) => {
+    const header = event.target.closest("th[data-column]");
+    if (!header) return;
+    const column = parseInt(header.dataset.column, 10);
+    if (state.sort === column) {
+      state.order = state.order === "asc" ? "desc" : "asc";
+    } else {
+      state.sort = column;
+      state.order = "asc";
+    }
+    load();
+  });
+
+  prevBtn.addEventListener("click", () => {
+    state.page--;
+    load();
+  });
+  nextBtn.addEventListener("click", () => {
+    state.page++;
+    load();
+  });
+
+  let filterTimer;
+  document.getElementById("tableFilter").addEventListener("input", (event) => {
+    clearTimeout(filterTimer);
+    filterTimer = setTimeout(() => {
+      state.filter = event.target.value.trim();
+      state.page = 1;
+      load();
+    }, 300);
+  });
+
+  load();
+})();
@@ -0,0 +1,120 @@
+// Live tail page (?view=tail). Lines arrive on the /ws/tail stream; while
+// paused they are buffered and appended when following resumes.
+(function () {
+  const output = document.getElementById("tailOutput");
+  const followBtn = document.getElementById("tailFollow");
+  const patternInput = document.getElementById("tailPattern");
+  const statusText = document.getElementById("tailStatus");
+  const statusBar = document.getElementById("statusBar");
+  // Lines kept in the page; older ones are dropped.
+  const maxLines = 10000;
+
+  let following = true;
+  let paused = [];
+  let pattern = null;
+
+  function setStatus(text) {
+    statusText.textContent = text;
+  }
+
+  function highlightLine(el) {
+    el.classList.toggle("match", pattern !== null && pattern.test(el.textContent));
+  }
+
+  function appendLines(lines) {
+    const fragment = document.createDocumentFragment();
+    for (const line of lines) {
+      const el = document.createElement("div");
+      el.className = "tail-line";
+      el.textContent = line;
+      highlightLine(el);
+      fragment.appendChild(el);
+    }
+    output.appendChild(fragment);
+    while (output.childElementCount > maxLines) {
+      output.firstElementChild.remove();
+    }
+    window.scrollTo(0, document.body.scrollHeight);
+  }
+
+  function appendMarker(text) {
+    const el = document.createElement("div");
+    el.className = "tail-line tail-marker";
+    el.textContent = `── ${text} ──`;
+    output.appendChild(el);
+  }
+
+  function handleMessage(msg) {
+    switch (msg.type) {
+      case "lines":
+        if (following) appendLines(msg.lines);
+        else {
+          paused.push(...msg.lines);
+          setStatus(`${paused.length} new lines`);
+        }
+        break;
+      case "truncated":
+        appendMarker("file truncated");
+        break;
+      case "rotated":
+        appendMarker("file rotated");
+        break;
+      case "error":
+        setStatus(msg.message);
+        break;
+    }
+  }
+
+  function connect() {
+    const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
+    const params = new URLSearchParams({ lines: output.dataset.lines });
+    // Only the first connection asks for the last lines; reconnects resume
+    // from the end of the file.
+    if (output.childElementCount > 0) params.set("lines", "0");
+    const ws = new WebSocket(
+      `${protocol}//${window.location.host}${output.dataset.stream}&${params}`,
+    );
+    statusBar.className = "status-bar connecting";
+    ws.onopen = () => {
+      statusBar.className = "status-bar connected";
+    };
+    ws.onmessage = (event) => {
+      try {
+        handleMessage(JSON.parse(event.data));
+      } catch (e) {
+        console.error("Tail: bad message", e);
+      }
+    };
+    ws.onclose = () => {
+      statusBar.className = "status-bar disconnected";
+      setTimeout(connect, 3000);
+    };
+  }
+
+  followBtn.addEventListener("click", () => {
+    following = !following;
+    followBtn.textContent = following ? "⏸ Pause" : "▶ Follow";
+    if (following) {
+      appendLines(paused);
+      paused = [];
+      setStatus("");
+    }
+  });
+
+  patternInput.addEventListener("input", () => {
+    try {
+      pattern = patternInput.value ? new RegExp(patternInput.value, "i") : null;
+      patternInput.classList.remove("invalid");
+    } catch (e) {
+      patternInput.classList.add("invalid");
+      return;
+    }
+    output.querySelectorAll(".tail-line").forEach(highlightLine);
+  });
+
+  document.getElementById("tailClear").addEventListener("click", () => {
+    output.replaceChildren();
+  });
+
+  connect();
+})();
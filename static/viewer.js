@@ -0,0 +1,56 @@
+// Line anchors for the source viewer: #L10 selects a line, #L10-L20 a range.
+// Shift-click on a line number extends the selection from the current line.
+(function () {
+  const content = document.getElementById("viewContent");
+  const pageLines = parseInt(content.dataset.pageLines, 10) || 0;
+
+  function parseHash() {
+    const match = /^#L(\d+)(?:-L(\d+))?$/.exec(window.location.hash);
+    if (!match) return null;
+    const start = parseInt(match[1], 10);
+    const end = match[2] ? parseInt(match[2], 10) : start;
+    return { start: Math.min(start, end), end: Math.max(start, end) };
+  }
+
+  function highlight() {
+    content
+      .querySelectorAll(".line.hl")
+      .forEach((line) => line.classList.remove("hl"));
+    const range = parseHash();
+    if (!range) return;
+    const first = document.getElementById(`L${range.start}`);
+    if (!first && pageLines > 0) {
+      // The line lives on another page of a paged view.
+      const params = new URLSearchParams(window.location.search);
+      params.set("page", Math.floor((range.start - 1) / pageLines) + 1);
+      window.location.replace(
+        `${window.location.pathname}?${params}${window.location.hash}`,
+      );
+      return;
+    }
+    for (let n = range.start; n <= range.end; n++) {
+      const number = document.getElementById(`L${n}`);
+      if (number) number.parentElement.classList.add("hl");
+    }
+    if (first) first.scrollIntoView({ block: "center" });
+  }
+
+  content.addEventListener("click", (event) => {
+    const link = event.target.closest("a.lnlinks");
+    if (!link) return;
+    event.preventDefault();
+    const line = parseInt(link.textContent, 10);
+    const current = parseHash();
+    let hash = `#L${line}`;
+    if (event.shiftKey && current) {
+      const start = Math.min(current.start, line);
+      const end = Math.max(current.start, line);
+      hash = start === end ? `#L${start}` : `#L${start}-L${end}`;
+    }
+    window.history.replaceState(null, "", hash);
+    highlight();
+  });
+
+  window.addEventListener("hashchange", highlight);
+  highlight();
+})();
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// maxSubtitleSize is the largest subtitle file converted for the browser.
+const maxSubtitleSize = 10 << 20
+
+// subtitleExts are the subtitle formats found next to videos.
+var subtitleExts = map[string]bool{".srt": true, ".vtt": true}
+
+// subtitleDirs are the folder names searched for subtitles besides the
+// video's own directory, compared case-insensitively.
+var subtitleDirs = map[string]bool{"subs": true, "subtitles": true, "subtitle": true}
+
+// subtitleListingDir returns the directory whose listing shows the
+// subtitles at fullPath, a file or folder inside a subtitle folder:
+// "movies" for "movies/Subs/movie.srt" and "movies/Subs/movie/2_English.srt".
+func subtitleListingDir(fullPath string) (string, bool) {
+	dir := filepath.Dir(fullPath)
+	for range 2 {
+		if subtitleDirs[strings.ToLower(filepath.Base(dir))] {
+			return filepath.Dir(dir), true
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "", false
+}
+
+// subtitleLanguages maps ISO 639-1 codes to language names.
+var subtitleLanguages = map[string]string{
+	"ar": "Arabic", "cs": "Czech", "da": "Danish", "de": "German", "el": "Greek",
+	"en": "English", "es": "Spanish", "fi": "Finnish", "fr": "French", "he": "Hebrew",
+	"hi": "Hindi", "hu": "Hungarian", "it": "Italian", "ja": "Japanese", "ko": "Korean",
+	"nl": "Dutch", "no": "Norwegian", "pl": "Polish", "pt": "Portuguese", "ro": "Romanian",
+	"ru": "Russian", "sv": "Swedish", "tr": "Turkish", "uk": "Ukrainian", "zh": "Chinese",
+}
+
+// subtitleLanguageAliases maps ISO 639-2 codes to ISO 639-1.
+var subtitleLanguageAliases = map[string]string{
+	"ara": "ar", "cze": "cs", "ces": "cs", "dan": "da", "ger": "de", "deu": "de",
+	"gre": "el", "ell": "el", "eng": "en", "spa": "es", "fin": "fi", "fre": "fr",
+	"fra": "fr", "heb": "he", "hin": "hi", "hun": "hu", "ita": "it", "jpn": "ja",
+	"kor": "ko", "dut": "nl", "nld": "nl", "nor": "no", "pol": "pl", "por": "pt",
+	"rum": "ro", "ron": "ro", "rus": "ru", "swe": "sv", "tur": "tr", "ukr": "uk",
+	"chi": "zh", "zho": "zh",
+}
+
+// subtitleTrack is a subtitle file found for a video.
+type subtitleTrack struct {
+	Path     string `json:"path"`
+	URL      string `json:"url"` // WebVTT version, from /api/subtitle
+	Language string `json:"language,omitempty"`
+	Label    string `json:"label"`
+}
+
+func isSubtitleFile(name string) bool {
+	return subtitleExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// subtitleLanguage reads the language from the part of a subtitle name
+// after the video name, such as "en", "en.forced" or "2_English".
+func subtitleLanguage(tag string) (language, label string) {
+	var extras []string
+	for _, token := range strings.FieldsFunc(tag, func(r rune) bool {
+		return r == '.' || r == '_' || r == '-' || r == ' '
+	}) {
+		lower := strings.ToLower(token)
+		if code, ok := subtitleLanguageAliases[lower]; ok {
+			lower = code
+		}
+		switch {
+		case language == "" && subtitleLanguages[lower] != "":
+			language = lower
+		case language == "":
+			for code, name := range subtitleLanguages {
+				if strings.EqualFold(name, token) {
+					language = code
+				}
+			}
+			if language == "" && strings.Trim(token, "0123456789") != "" {
+				extras = append(extras, token)
+			}
+		case strings.Trim(token, "0123456789") != "":
+			extras = append(extras, token)
+		}
+	}
+	label = subtitleLanguages[language]
+	switch {
+	case label == "" && len(extras) == 0:
+		label = "Subtitles"
+	case label == "":
+		label = strings.Join(extras, " ")
+	case len(extras) > 0:
+		label += " (" + strings.Join(extras, ", ") + ")"
+	}
+	return language, label
+}
+
+// subtitleFinder finds the subtitles of the videos in one directory,
+// reading the directory and its subtitle folders once.
+type subtitleFinder struct {
+	dir    string   // Slash separated, relative to rootDir
+	files  []string // Subtitle files, relative to dir
+	videos int      // Videos in dir
+}
+
+func newSubtitleFinder(rootDir, dir string) *subtitleFinder {
+	f := &subtitleFinder{dir: dir}
+	var walk func(rel string, depth int)
+	walk = func(rel string, depth int) {
+		entries, err := os.ReadDir(resolveInRoot(rootDir, path.Join(dir, rel)))
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			name := path.Join(rel, entry.Name())
+			if depth == 0 && !entry.IsDir() && mediaKind(entry.Name()) == "video" {
+				f.videos++
+			}
+			switch {
+			case entry.IsDir() && (depth == 0 && subtitleDirs[strings.ToLower(entry.Name())] || depth == 1):
+				walk(name, depth+1)
+			case !entry.IsDir() && isSubtitleFile(entry.Name()):
+				f.files = append(f.files, name)
+			}
+		}
+	}
+	walk("", 0)
+	return f
+}
+
+// find returns the subtitles of the video called name. They are named
+// after the video ("movie.en.srt", "Subs/movie.en.srt"), kept in a folder
+// named after it ("Subs/movie/2_English.srt") or, inside a subtitle folder,
+// named only by language ("Subs/English.srt") when the video is alone in
+// its directory.
+func (f *subtitleFinder) find(name string) []subtitleTrack {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	var tracks []subtitleTrack
+	for _, file := range f.files {
+		dir, fileName := path.Split(file)
+		stem := strings.TrimSuffix(fileName, path.Ext(fileName))
+		var tag string
+		switch {
+		case len(stem) >= len(base) && strings.EqualFold(stem[:len(base)], base) && (len(stem) == len(base) || strings.ContainsRune("._- ", rune(stem[len(base)]))):
+			tag = stem[len(base):]
+		case strings.Count(dir, "/") == 2 && strings.EqualFold(path.Base(dir), base):
+			tag = stem
+		case strings.Count(dir, "/") == 1 && f.videos <= 1:
+			if language, _ := subtitleLanguage(stem); language == "" {
+				continue
+			}
+			tag = stem
+		default:
+			continue
+		}
+		language, label := subtitleLanguage(tag)
+		relPath := path.Join(f.dir, file)
+		tracks = append(tracks, subtitleTrack{
+			Path:     relPath,
+			URL:      "/api/subtitle?" + url.Values{"path": {relPath}}.Encode(),
+			Language: language,
+			Label:    label,
+		})
+	}
+	sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].Label < tracks[j].Label })
+	return tracks
+}
+
+// attachSubtitles fills in the subtitles of the videos in a listing.
+func attachSubtitles(rootDir string, data *DirectoryData) {
+	var finder *subtitleFinder
+	for i := range data.Files {
+		file := &data.Files[i]
+		if file.IsDir || mediaKind(file.Name) != "video" {
+			continue
+		}
+		if finder == nil {
+			finder = newSubtitleFinder(rootDir, filepath.ToSlash(data.CurrentPath))
+			if len(finder.files) == 0 {
+				return
+			}
+		}
+		file.Subtitles = finder.find(file.Name)
+	}
+}
+
+var (
+	srtTiming    = regexp.MustCompile(`^\s*(\d+):(\d{2}):(\d{2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{2}):(\d{2})[,.](\d{1,3})`)
+	srtStyleTags = regexp.MustCompile(`\{\\[^}]*\}|</?font[^>]*>`)
+)
+
+// srtToVTT converts SubRip subtitles to WebVTT: timings use a decimal
+// point, positions after the timing and ASS style overrides are dropped.
+// Cues that broken files run together get the blank line WebVTT needs
+// between them, and "-->" in cue text is escaped so it can't end a cue.
+func srtToVTT(srt string) string {
+	srt = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(srt)
+	isIdentifier := func(line string) bool {
+		line = strings.TrimSpace(line)
+		return line != "" && strings.Trim(line, "0123456789") == ""
+	}
+	out := []string{"WEBVTT", ""}
+	for _, line := range strings.Split(srt, "\n") {
+		if m := srtTiming.FindStringSubmatch(line); m != nil {
+			pad := func(hours, millis string) (string, string) {
+				return strings.Repeat("0", max(0, 2-len(hours))) + hours, millis + strings.Repeat("0", 3-len(millis))
+			}
+			h1, ms1 := pad(m[1], m[4])
+			h2, ms2 := pad(m[5], m[8])
+			last := len(out) - 1
+			switch {
+			case out[last] != "" && !isIdentifier(out[last]):
+				out = append(out, "")
+			case isIdentifier(out[last]) && out[last-1] != "":
+				out = slices.Insert(out, last, "")
+			}
+			out = append(out, h1+":"+m[2]+":"+m[3]+"."+ms1+" --> "+h2+":"+m[6]+":"+m[7]+"."+ms2)
+			continue
+		}
+		text := srtStyleTags.ReplaceAllString(line, "")
+		if strings.TrimSpace(text) == "" {
+			if strings.TrimSpace(line) != "" {
+				continue // Only style overrides, which mustn't end the cue
+			}
+			// Lines of only spaces end SubRip cues but not WebVTT ones.
+			text = ""
+		}
+		out = append(out, strings.ReplaceAll(text, "-->", "--&gt;"))
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// handleSubtitle serves a subtitle file as UTF-8 WebVTT:
+//
+//	/api/subtitle?path=movies/movie.en.srt
+func handleSubtitle(s *Server, w http.ResponseWriter, r *http.Request) {
+	fullPath := resolveInRoot(s.rootDir, r.URL.Query().Get("path"))
+	if !isSubtitleFile(fullPath) {
+		http.Error(w, "Not a subtitle file", http.StatusBadRequest)
+		return
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxSubtitleSize+1))
+	if err != nil {
+		log.Printf("Error reading subtitle '%s': %v", fullPath, err)
+		http.Error(w, "Error reading subtitle", http.StatusInternalServerError)
+		return
+	}
+	if len(data) > maxSubtitleSize {
+		http.Error(w, "Subtitle file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	encoding, bomLen, ok := detectTextEncoding(data[:min(len(data), encodingSniffSize)])
+	if !ok {
+		http.Error(w, "Not a text file", http.StatusUnprocessableEntity)
+		return
+	}
+	text := decodeText(data[bomLen:], encoding)
+	if strings.ToLower(filepath.Ext(fullPath)) == ".srt" {
+		text = srtToVTT(text)
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := io.WriteString(w, text); err != nil {
+		log.Printf("Error writing subtitle '%s': %v", fullPath, err)
+	}
+}
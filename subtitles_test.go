@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestSRTToVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		srt  string
+		want string
+	}{
+		{
+			name: "cues",
+			srt: "1\n00:00:01,000 --> 00:00:04,250\nHello\n<i>world</i>\n\n" +
+				"2\n00:01:02,500 --> 00:01:05,000\nSecond cue\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:04.250\nHello\n<i>world</i>\n\n" +
+				"2\n00:01:02.500 --> 00:01:05.000\nSecond cue\n\n",
+		},
+		{
+			name: "CRLF and CR line endings",
+			srt:  "1\r\n00:00:01,000 --> 00:00:02,000\r\nWindows\r\n\r\n2\r00:00:03,000 --> 00:00:04,000\rMac\r",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nWindows\n\n2\n00:00:03.000 --> 00:00:04.000\nMac\n\n",
+		},
+		{
+			name: "short and long fields",
+			srt:  "1\n1:02:03,5 --> 100:02:03.45\nText\n",
+			want: "WEBVTT\n\n1\n01:02:03.500 --> 100:02:03.450\nText\n\n",
+		},
+		{
+			name: "positions and spacing around the arrow",
+			srt:  "1\n 00:00:01,000-->00:00:02,000  X1:100 X2:200 Y1:10 Y2:50\nText\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nText\n\n",
+		},
+		{
+			name: "style overrides",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\n{\\an8}<font color=\"#ffff00\">Top</font>\n{\\pos(10,10)}\nText\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nTop\nText\n\n",
+		},
+		{
+			name: "arrow in cue text",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nleft --> right\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nleft --&gt; right\n\n",
+		},
+		{
+			name: "blank lines of spaces",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nOne\n  \t\n2\n00:00:03,000 --> 00:00:04,000\nTwo\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nOne\n\n2\n00:00:03.000 --> 00:00:04.000\nTwo\n\n",
+		},
+		{
+			name: "cues without blank lines",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\nOne\n2\n00:00:03,000 --> 00:00:04,000\nTwo\n00:00:05,000 --> 00:00:06,000\nThree\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nOne\n\n2\n00:00:03.000 --> 00:00:04.000\nTwo\n\n00:00:05.000 --> 00:00:06.000\nThree\n\n",
+		},
+		{
+			name: "cue text of digits",
+			srt:  "1\n00:00:01,000 --> 00:00:02,000\n1984\n\n2\n00:00:03,000 --> 00:00:04,000\n42\n",
+			want: "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\n1984\n\n2\n00:00:03.000 --> 00:00:04.000\n42\n\n",
+		},
+		{
+			name: "malformed timings are text",
+			srt:  "1\n00:00:01 --> 00:00:02\n00:0:01,000 --> 00:00:02,000\n00:00:01,0000 --> 00:00:02,000\n",
+			want: "WEBVTT\n\n1\n00:00:01 --&gt; 00:00:02\n00:0:01,000 --&gt; 00:00:02,000\n00:00:01,0000 --&gt; 00:00:02,000\n\n",
+		},
+		{
+			name: "timing first",
+			srt:  "00:00:01,000 --> 00:00:02,000\nNo identifier\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nNo identifier\n\n",
+		},
+		{
+			name: "empty",
+			srt:  "",
+			want: "WEBVTT\n\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := srtToVTT(tt.srt); got != tt.want {
+				t.Errorf("srtToVTT() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTablePageSize = 100
+	maxTablePageSize     = 1000
+	// tableCheckpointRows is the distance in rows between remembered byte
+	// offsets, so later pages of a large file are found without a rescan.
+	tableCheckpointRows = 1000
+	// jsonlHeaderRows is how many JSONL records are read to collect columns.
+	jsonlHeaderRows = 100
+	maxTableIndexes = 32
+)
+
+// tableFormats maps file extensions to the formats /api/table understands.
+var tableFormats = map[string]string{
+	".csv":    "csv",
+	".tsv":    "tsv",
+	".tab":    "tsv",
+	".jsonl":  "jsonl",
+	".ndjson": "jsonl",
+}
+
+func tableFormat(fullPath string) string {
+	return tableFormats[strings.ToLower(filepath.Ext(fullPath))]
+}
+
+// tableIndex remembers what is known about a table file between requests:
+// its header and the byte offset of every tableCheckpointRows-th row.
+type tableIndex struct {
+	mu          sync.Mutex
+	size        int64
+	modTime     time.Time
+	header      []string
+	checkpoints []int64 // checkpoints[i] is the offset of row i*tableCheckpointRows
+	scannedRows int     // rows seen from the start of the file
+	scannedTo   int64   // offset after the last seen row
+	complete    bool    // the whole file has been scanned, scannedRows is exact
+}
+
+// tableResponse is the JSON returned by /api/table.
+type tableResponse struct {
+	Format    string     `json:"format"`
+	Header    []string   `json:"header"`
+	Rows      [][]string `json:"rows"`
+	Page      int        `json:"page"`
+	PageSize  int        `json:"pageSize"`
+	RowCount  int        `json:"rowCount"`
+	Estimated bool       `json:"estimated"` // RowCount is an estimate from the bytes per row seen so far
+	HasMore   bool       `json:"hasMore"`
+}
+
+// tableReader reads the rows of a table file from a byte offset.
+type tableReader struct {
+	format string
+	header []string
+	csv    *csv.Reader
+	lines  *bufio.Reader
+	base   int64 // file offset the reader started at
+	offset int64 // for JSONL, bytes consumed so far
+}
+
+func newTableReader(file *os.File, format string, header []string, offset int64) (*tableReader, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr := &tableReader{format: format, header: header, base: offset}
+	if format == "jsonl" {
+		tr.lines = bufio.NewReaderSize(file, 64<<10)
+		return tr, nil
+	}
+	tr.csv = csv.NewReader(bufio.NewReaderSize(file, 64<<10))
+	tr.csv.FieldsPerRecord = -1
+	tr.csv.LazyQuotes = true
+	tr.csv.ReuseRecord = false
+	if format == "tsv" {
+		tr.csv.Comma = '\t'
+	}
+	return tr, nil
+}
+
+// next returns the next row and the file offset just after it.
+func (tr *tableReader) next() ([]string, int64, error) {
+	if tr.csv != nil {
+		record, err := tr.csv.Read()
+		return record, tr.base + tr.csv.InputOffset(), err
+	}
+	for {
+		line, err := tr.lines.ReadBytes('\n')
+		tr.offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return nil, tr.base + tr.offset, err
+			}
+			continue
+		}
+		var record map[string]any
+		if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+			// Keep the row count stable: show unparsable lines as one cell.
+			return []string{strings.TrimSpace(string(line))}, tr.base + tr.offset, nil
+		}
+		row := make([]string, len(tr.header))
+		for i, column := range tr.header {
+			row[i] = jsonCell(record[column])
+		}
+		return row, tr.base + tr.offset, nil
+	}
+}
+
+func jsonCell(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// readTableHeader returns the header of a table file and the offset of its
+// first data row. JSONL columns are the keys of the first records, in order
+// of appearance.
+func readTableHeader(file *os.File, format string) ([]string, int64, error) {
+	if format != "jsonl" {
+		tr, err := newTableReader(file, format, nil, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		header, offset, err := tr.next()
+		if err == io.EOF {
+			return []string{}, offset, nil
+		}
+		if len(header) > 0 {
+			header[0] = strings.TrimPrefix(header[0], "\ufeff")
+		}
+		return header, offset, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	var header []string
+	seen := make(map[string]bool)
+	for i := 0; i < jsonlHeaderRows; i++ {
+		var record json.RawMessage
+		if err := decoder.Decode(&record); err != nil {
+			break
+		}
+		// Decode again into an ordered token stream to keep key order.
+		keys := json.NewDecoder(bytes.NewReader(record))
+		if token, err := keys.Token(); err != nil || token != json.Delim('{') {
+			continue
+		}
+		for keys.More() {
+			token, err := keys.Token()
+			if err != nil {
+				break
+			}
+			if key, ok := token.(string); ok && !seen[key] {
+				seen[key] = true
+				header = append(header, key)
+			}
+			var skip json.RawMessage
+			if err := keys.Decode(&skip); err != nil {
+				break
+			}
+		}
+	}
+	if header == nil {
+		header = []string{}
+	}
+	return header, 0, nil
+}
+
+// tableIndexFor returns the cached index of fullPath, or a new one if the
+// file changed since it was built.
+func (s *Server) tableIndexFor(fullPath string, info os.FileInfo) *tableIndex {
+	s.tableMu.Lock()
+	defer s.tableMu.Unlock()
+	index := s.tableIndexes[fullPath]
+	if index == nil || index.size != info.Size() || !index.modTime.Equal(info.ModTime()) {
+		if len(s.tableIndexes) >= maxTableIndexes {
+			for key := range s.tableIndexes {
+				delete(s.tableIndexes, key)
+				break
+			}
+		}
+		index = &tableIndex{size: info.Size(), modTime: info.ModTime()}
+		s.tableIndexes[fullPath] = index
+	}
+	return index
+}
+
+// rowMatches reports whether any cell contains filter, or the cell of column
+// when filter has the form "column:text".
+func rowMatches(header, row []string, filter string) bool {
+	if column, text, ok := strings.Cut(filter, ":"); ok {
+		for i, name := range header {
+			if strings.EqualFold(name, strings.TrimSpace(column)) {
+				return i < len(row) && strings.Contains(strings.ToLower(row[i]), strings.TrimSpace(text))
+			}
+		}
+	}
+	for _, cell := range row {
+		if strings.Contains(strings.ToLower(cell), filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortTableRows sorts rows by column, numerically when both cells are numbers.
+func sortTableRows(rows [][]string, column int, descending bool) {
+	cell := func(row []string) string {
+		if column < len(row) {
+			return row[column]
+		}
+		return ""
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := cell(rows[i]), cell(rows[j])
+		if descending {
+			a, b = b, a
+		}
+		x, errX := strconv.ParseFloat(a, 64)
+		y, errY := strconv.ParseFloat(b, 64)
+		if errX == nil && errY == nil {
+			return x < y
+		}
+		return strings.ToLower(a) < strings.ToLower(b)
+	})
+}
+
+// readTablePage reads one page of rows, using and extending index. Without a
+// filter the nearest checkpoint is used; a filter scans from the start.
+func readTablePage(file *os.File, format string, index *tableIndex, page, pageSize int, filter string) (rows [][]string, hasMore bool, err error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if index.header == nil {
+		header, dataStart, err := readTableHeader(file, format)
+		if err != nil {
+			return nil, false, err
+		}
+		index.header = header
+		index.checkpoints = []int64{dataStart}
+		index.scannedTo = dataStart
+	}
+
+	firstRow := (page - 1) * pageSize
+	row, offset := 0, index.checkpoints[0]
+	if filter == "" {
+		checkpoint := min(firstRow/tableCheckpointRows, len(index.checkpoints)-1)
+		row, offset = checkpoint*tableCheckpointRows, index.checkpoints[checkpoint]
+	}
+	tr, err := newTableReader(file, format, index.header, offset)
+	if err != nil {
+		return nil, false, err
+	}
+
+	matched := 0
+	for {
+		record, next, err := tr.next()
+		if errors.Is(err, io.EOF) {
+			// Every scan starts at a checkpoint chained from the first
+			// row, so reaching the end gives the exact row count.
+			index.scannedRows, index.scannedTo, index.complete = row, next, true
+			return rows, false, nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, false, err
+			}
+			record = []string{fmt.Sprintf("(unparsable row: %v)", parseErr.Err)}
+		}
+		row++
+		// Record a checkpoint for the row that starts at next.
+		if row%tableCheckpointRows == 0 && row/tableCheckpointRows == len(index.checkpoints) {
+			index.checkpoints = append(index.checkpoints, next)
+		}
+		if row > index.scannedRows {
+			index.scannedRows, index.scannedTo = row, next
+		}
+
+		if filter != "" {
+			if !rowMatches(index.header, record, filter) {
+				continue
+			}
+			matched++
+			if matched <= firstRow {
+				continue
+			}
+		} else if row <= firstRow {
+			continue
+		}
+		if len(rows) == pageSize {
+			return rows, true, nil
+		}
+		rows = append(rows, record)
+	}
+}
+
+// handleTable serves paged rows of a CSV, TSV or JSONL file as JSON:
+//
+//	/api/table?path=data.csv&page=2&size=100&sort=3&order=desc&filter=text
+//
+// sort orders the rows of the returned page by a column index; filter keeps
+// rows containing text, in a specific column when given as "column:text".
+func handleTable(s *Server, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	relPath := query.Get("path")
+	fullPath := resolveInRoot(s.rootDir, relPath)
+	format := tableFormat(fullPath)
+	if format == "" {
+		http.Error(w, "Unsupported table format, expected .csv, .tsv or .jsonl", http.StatusBadRequest)
+		return
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "Not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(query.Get("size"))
+	if err != nil || pageSize < 1 {
+		pageSize = defaultTablePageSize
+	}
+	pageSize = min(pageSize, maxTablePageSize)
+	// The first row of the page must not overflow.
+	if page > math.MaxInt/pageSize {
+		http.Error(w, "Page out of range", http.StatusBadRequest)
+		return
+	}
+	filter := strings.ToLower(strings.TrimSpace(query.Get("filter")))
+
+	index := s.tableIndexFor(fullPath, info)
+	rows, hasMore, err := readTablePage(file, format, index, page, pageSize, filter)
+	if err != nil {
+		log.Printf("Error reading table '%s': %v", fullPath, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	if column, err := strconv.Atoi(query.Get("sort")); err == nil && column >= 0 {
+		sortTableRows(rows, column, query.Get("order") == "desc")
+	}
+	if rows == nil {
+		rows = [][]string{}
+	}
+
+	index.mu.Lock()
+	resp := tableResponse{
+		Format:   format,
+		Header:   index.header,
+		Rows:     rows,
+		Page:     page,
+		PageSize: pageSize,
+		RowCount: index.scannedRows,
+		HasMore:  hasMore,
+	}
+	if !index.complete && index.scannedRows > 0 && index.scannedTo > index.checkpoints[0] {
+		bytesPerRow := float64(index.scannedTo-index.checkpoints[0]) / float64(index.scannedRows)
+		resp.RowCount = int(float64(index.size-index.checkpoints[0]) / bytesPerRow)
+		resp.Estimated = true
+	}
+	index.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding table response for '%s': %v", relPath, err)
+	}
+}
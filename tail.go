@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTailLines = 100
+	maxTailLines     = 5000
+	// maxTailChunk bounds how much appended data is read per update, so a
+	// burst of output reaches the client in several messages.
+	maxTailChunk = 256 << 10
+	// tailPollInterval catches changes the watcher misses, such as writes
+	// on network filesystems or a file replaced after rotation.
+	tailPollInterval = 2 * time.Second
+)
+
+// tailMessage is sent on /ws/tail. Type is "lines", "truncated", "rotated"
+// or "error".
+type tailMessage struct {
+	Type    string   `json:"type"`
+	Lines   []string `json:"lines,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// subscribeTail returns a channel that receives a value whenever the watcher
+// sees fullPath change. The channel is buffered so notifications coalesce.
+func (s *Server) subscribeTail(fullPath string) chan struct{} {
+	s.tailMu.Lock()
+	defer s.tailMu.Unlock()
+	notify := make(chan struct{}, 1)
+	if s.tails[fullPath] == nil {
+		s.tails[fullPath] = make(map[chan struct{}]bool)
+	}
+	s.tails[fullPath][notify] = true
+	return notify
+}
+
+func (s *Server) unsubscribeTail(fullPath string, notify chan struct{}) {
+	s.tailMu.Lock()
+	defer s.tailMu.Unlock()
+	delete(s.tails[fullPath], notify)
+	if len(s.tails[fullPath]) == 0 {
+		delete(s.tails, fullPath)
+	}
+}
+
+// notifyTails wakes the tails following fullPath; called by the watcher.
+func (s *Server) notifyTails(fullPath string) {
+	s.tailMu.Lock()
+	defer s.tailMu.Unlock()
+	for notify := range s.tails[fullPath] {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// lastLines returns up to n complete lines before offset end, reading the
+// file backwards in blocks.
+func lastLines(file *os.File, end int64, n int) ([]byte, error) {
+	const block = 64 << 10
+	var data []byte
+	pos := end
+	for pos > 0 && bytes.Count(data, []byte("\n")) <= n {
+		size := min(int64(block), pos)
+		pos -= size
+		chunk := make([]byte, size)
+		if _, err := file.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(chunk, data...)
+	}
+	// Keep only the last n lines; a trailing newline ends the last one.
+	trimmed := bytes.TrimSuffix(data, []byte("\n"))
+	if idx := lastNthIndex(trimmed, '\n', n); idx >= 0 {
+		data = data[idx+1:]
+	}
+	return data, nil
+}
+
+// lastNthIndex returns the index of the n-th last occurrence of c in b, or -1.
+func lastNthIndex(b []byte, c byte, n int) int {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] == c {
+			n--
+			if n == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// handleTail streams a text file like tail -f: it sends the last lines of
+// the file, then appended lines whenever the file grows. Truncation restarts
+// from the beginning of the file; rotation follows the new file at the path.
+func handleTail(s *Server, w http.ResponseWriter, r *http.Request) {
+	relPath := r.URL.Query().Get("path")
+	fullPath := resolveInRoot(s.rootDir, relPath)
+	// lines=0 skips the initial lines, e.g. when a client reconnects.
+	lines, err := strconv.Atoi(r.URL.Query().Get("lines"))
+	if err != nil || lines < 0 {
+		lines = defaultTailLines
+	}
+	lines = min(lines, maxTailLines)
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer func() { file.Close() }()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "Not a regular file", http.StatusBadRequest)
+		return
+	}
+	sample := make([]byte, encodingSniffSize)
+	n, _ := file.ReadAt(sample, 0)
+	encoding, _, ok := detectTextEncoding(sample[:n])
+	if !ok || encoding == encodingUTF16LE || encoding == encodingUTF16BE {
+		http.Error(w, "Only UTF-8 and Latin-1 text files can be tailed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("Client %s tailing %s", conn.RemoteAddr(), relPath)
+
+	notify := s.subscribeTail(fullPath)
+	defer s.unsubscribeTail(fullPath, notify)
+
+	// The client only ever closes the stream; reading detects that.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg tailMessage) bool {
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Printf("Error writing tail of %s to client %s: %v", relPath, conn.RemoteAddr(), err)
+			return false
+		}
+		return true
+	}
+
+	// pending holds a trailing partial line until its newline arrives.
+	var pending []byte
+	emit := func(data []byte) bool {
+		data = append(pending, data...)
+		end := bytes.LastIndexByte(data, '\n')
+		if end < 0 && len(data) < maxTailChunk {
+			pending = data
+			return true
+		}
+		if end < 0 {
+			// A single over long line is sent as it is.
+			end = len(data)
+		}
+		pending = nil
+		if end < len(data) {
+			pending = append(pending, data[end+1:]...)
+		}
+		text := decodeText(data[:end], encoding)
+		return send(tailMessage{Type: "lines", Lines: strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")})
+	}
+
+	offset := info.Size()
+	if lines > 0 {
+		initial, err := lastLines(file, offset, lines)
+		if err != nil {
+			send(tailMessage{Type: "error", Message: "Error reading file"})
+			return
+		}
+		if len(initial) > 0 && !emit(initial) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-notify:
+		case <-ticker.C:
+		}
+
+		current, err := os.Stat(fullPath)
+		if err != nil {
+			// Rotated away and not yet recreated; keep waiting.
+			continue
+		}
+		if !os.SameFile(info, current) {
+			reopened, err := os.Open(fullPath)
+			if err != nil {
+				continue
+			}
+			file.Close()
+			file, info, offset, pending = reopened, current, 0, nil
+			if !send(tailMessage{Type: "rotated"}) {
+				return
+			}
+		} else if current.Size() < offset {
+			offset, pending = 0, nil
+			if !send(tailMessage{Type: "truncated"}) {
+				return
+			}
+		}
+		info = current
+
+		for offset < current.Size() {
+			chunk := make([]byte, min(current.Size()-offset, maxTailChunk))
+			read, err := file.ReadAt(chunk, offset)
+			if err != nil && err != io.EOF {
+				log.Printf("Error reading %s for tail: %v", fullPath, err)
+				break
+			}
+			if read == 0 {
+				break
+			}
+			offset += int64(read)
+			if !emit(chunk[:read]) {
+				return
+			}
+		}
+	}
+}
+
+// tailPage is the data of tail.html.
+type tailPage struct {
+	Name      string
+	RawURL    string
+	BrowseURL string
+	ViewURL   string
+	StreamURL string
+	Lines     int
+}
+
+// serveTailPage serves the live tail page for fullPath (?view=tail).
+func (s *Server) serveTailPage(w http.ResponseWriter, fullPath string) bool {
+	if !isRegularFile(fullPath) {
+		return false
+	}
+	rel, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil {
+		return false
+	}
+	relPath := filepath.ToSlash(rel)
+	rawURL := (&url.URL{Path: s.basePath + "/files/" + relPath}).EscapedPath()
+	page := tailPage{
+		Name:      path.Base(relPath),
+		RawURL:    rawURL,
+		BrowseURL: (&url.URL{Path: s.basePath + "/browse/" + strings.TrimPrefix(path.Dir("/"+relPath), "/")}).EscapedPath(),
+		ViewURL:   rawURL + "?view=1",
+		StreamURL: s.basePath + "/ws/tail?" + url.Values{"path": {relPath}}.Encode(),
+		Lines:     defaultTailLines,
+	}
+	var buf bytes.Buffer
+	if err := s.tailTemplate.Execute(&buf, page); err != nil {
+		log.Printf("Error executing tail template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Error writing tail page: %v", err)
+	}
+	return true
+}
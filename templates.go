@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pageTemplateExts are the extensions executed with html/template when
+// --templates is enabled.
+var pageTemplateExts = []string{".gohtml", ".tmpl"}
+
+// maxIncludeDepth bounds nested include calls so a template including itself
+// fails instead of recursing forever.
+const maxIncludeDepth = 10
+
+func isPageTemplate(fullPath string) bool {
+	ext := filepath.Ext(fullPath)
+	for _, templateExt := range pageTemplateExts {
+		if ext == templateExt {
+			return true
+		}
+	}
+	return false
+}
+
+// pageRequest is the request data exposed to templates as .Request.
+type pageRequest struct {
+	Method     string
+	Path       string
+	Query      url.Values
+	Header     http.Header // Without credentials, see templateHeader
+	RemoteAddr string
+}
+
+// pageData is the dot value of an executed page template.
+type pageData struct {
+	Request pageRequest
+	Path    string         // URL path of the template, relative to rootDir
+	Meta    map[string]any // Front matter of the template itself
+	Now     time.Time
+}
+
+// pageRenderer executes one page template and everything it includes.
+type pageRenderer struct {
+	s       *Server
+	request pageRequest
+	depth   int
+}
+
+// templateHeader copies the request headers for templates, leaving out the
+// credentials, so that a page echoing its headers can't hand the HttpOnly
+// session cookie to scripts.
+func templateHeader(header http.Header) http.Header {
+	header = header.Clone()
+	header.Del("Cookie")
+	header.Del("Authorization")
+	header.Del("Proxy-Authorization")
+	return header
+}
+
+// servePageTemplate executes the template at fullPath and writes the result.
+// Errors are logged; in dev mode they are also shown in the browser.
+func (s *Server) servePageTemplate(w http.ResponseWriter, r *http.Request, fullPath string) {
+	pr := &pageRenderer{
+		s: s,
+		request: pageRequest{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.Query(),
+			Header:     templateHeader(r.Header),
+			RemoteAddr: r.RemoteAddr,
+		},
+	}
+	out, err := pr.render(fullPath)
+	if err != nil {
+		log.Printf("Error rendering template '%s': %v", fullPath, err)
+		if errors.Is(err, os.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if s.devMode {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "<!DOCTYPE html><title>Template error</title><h1>Template error</h1><pre>%s</pre>\n", html.EscapeString(err.Error()))
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// page.html.tmpl renders as HTML, feed.xml.tmpl as XML; bare .tmpl
+	// files are assumed to be HTML.
+	contentType := mime.TypeByExtension(filepath.Ext(strings.TrimSuffix(fullPath, filepath.Ext(fullPath))))
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	s.applyCacheRules(w, r.URL.Path)
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", contentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(out); err != nil {
+		log.Printf("Error writing rendered template '%s': %v", fullPath, err)
+	}
+}
+
+// render executes the template at fullPath with its front matter removed.
+func (pr *pageRenderer) render(fullPath string) ([]byte, error) {
+	if pr.depth > maxIncludeDepth {
+		return nil, fmt.Errorf("includes nested deeper than %d", maxIncludeDepth)
+	}
+	source, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	meta, body := splitFrontMatter(source)
+
+	name := pr.relPath(fullPath)
+	tmpl, err := template.New(name).Funcs(pr.funcs(fullPath)).Parse(string(body))
+	if err != nil {
+		return nil, err
+	}
+	data := pageData{Request: pr.request, Path: name, Meta: meta, Now: time.Now()}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// relPath returns fullPath as a slash separated path below rootDir.
+func (pr *pageRenderer) relPath(fullPath string) string {
+	rel, err := filepath.Rel(pr.s.rootDir, fullPath)
+	if err != nil {
+		return filepath.Base(fullPath)
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// resolve maps a path used inside the template at fullPath to a file under
+// rootDir. Paths starting with "/" are relative to rootDir, others to the
+// template's directory.
+func (pr *pageRenderer) resolve(fullPath, name string) string {
+	if strings.HasPrefix(name, "/") {
+		return resolveInRoot(pr.s.rootDir, name)
+	}
+	return resolveInRoot(pr.s.rootDir, path.Join(path.Dir(pr.relPath(fullPath)), name))
+}
+
+func (pr *pageRenderer) funcs(fullPath string) template.FuncMap {
+	return template.FuncMap{
+		// include inserts another file: templates are executed, markdown
+		// is rendered and anything else is escaped as text.
+		"include": func(name string) (template.HTML, error) {
+			target := pr.resolve(fullPath, name)
+			switch {
+			case isPageTemplate(target):
+				nested := &pageRenderer{s: pr.s, request: pr.request, depth: pr.depth + 1}
+				out, err := nested.render(target)
+				return template.HTML(out), err
+			case isMarkdownFile(target):
+				return renderMarkdownFile(target)
+			default:
+				content, err := os.ReadFile(target)
+				return template.HTML(html.EscapeString(string(content))), err
+			}
+		},
+		"listDir": func(name string) ([]FileInfo, error) {
+			rel := strings.TrimPrefix(pr.relPath(pr.resolve(fullPath, name)), "/")
+			listing, err := getDirectoryListing(pr.s.rootDir, rel)
+			if err != nil {
+				return nil, err
+			}
+			return listing.Files, nil
+		},
+		"frontMatter": func(name string) (map[string]any, error) {
+			content, err := os.ReadFile(pr.resolve(fullPath, name))
+			if err != nil {
+				return nil, err
+			}
+			meta, _ := splitFrontMatter(content)
+			return meta, nil
+		},
+		"markdown": func(text string) (template.HTML, error) {
+			return renderMarkdown([]byte(text))
+		},
+		"markdownFile": func(name string) (template.HTML, error) {
+			return renderMarkdownFile(pr.resolve(fullPath, name))
+		},
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder
+)
+
+const (
+	defaultThumbSize = 256
+	maxThumbSize     = 4096
+	// maxThumbSourcePixels rejects images whose decoded form would be too
+	// large to hold in memory (50 megapixels is about 200 MB as RGBA).
+	maxThumbSourcePixels = 50_000_000
+	defaultThumbQuality  = 80
+)
+
+// thumbExts are the image types /api/thumb can decode.
+var thumbExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+func isThumbnailable(fullPath string) bool {
+	return thumbExts[strings.ToLower(filepath.Ext(fullPath))]
+}
+
+// thumbRequest describes one transform. Zero Width or Height leaves that
+// dimension free.
+type thumbRequest struct {
+	Width   int
+	Height  int
+	Fit     string // "contain", "cover" or "fill"
+	Format  string // "jpeg", "png" or "" to pick by transparency
+	Quality int
+}
+
+// thumbCache stores rendered thumbnails on disk, keyed by source path,
+// modification time and transform, and bounds how many are rendered at once.
+type thumbCache struct {
+	dir      string
+	maxBytes int64
+	sem      chan struct{} // limits concurrent decodes
+	mu       sync.Mutex
+	size     int64                    // bytes currently in dir
+	inflight map[string]chan struct{} // key -> closed when rendered
+}
+
+func newThumbCache(dir string, maxBytes int64, workers int) (*thumbCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail cache %s: %w", dir, err)
+	}
+	c := &thumbCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		sem:      make(chan struct{}, max(workers, 1)),
+		inflight: make(map[string]chan struct{}),
+	}
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				c.size += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// cachePath returns where the thumbnail for key is stored. The files have
+// no extension; their type is sniffed when served.
+func (c *thumbCache) cachePath(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get returns the cached thumbnail for key, rendering it with render first
+// if needed. Concurrent requests for the same key share one rendering.
+func (c *thumbCache) get(key string, render func(path string) error) (string, error) {
+	cached := c.cachePath(key)
+	for {
+		if _, err := os.Stat(cached); err == nil {
+			now := time.Now()
+			// The modification time doubles as last access for eviction.
+			_ = os.Chtimes(cached, now, now)
+			return cached, nil
+		}
+		c.mu.Lock()
+		if done, ok := c.inflight[key]; ok {
+			c.mu.Unlock()
+			<-done
+			if _, err := os.Stat(cached); err == nil {
+				return cached, nil
+			}
+			continue
+		}
+		done := make(chan struct{})
+		c.inflight[key] = done
+		c.mu.Unlock()
+
+		c.sem <- struct{}{}
+		err := c.store(cached, render)
+		<-c.sem
+
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		close(done)
+		if err != nil {
+			return "", err
+		}
+		return cached, nil
+	}
+}
+
+func (c *thumbCache) store(cached string, render func(path string) error) error {
+	if err := os.MkdirAll(filepath.Dir(cached), 0o755); err != nil {
+		return err
+	}
+	tmp := cached + ".tmp"
+	if err := render(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cached); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.mu.Lock()
+	c.size += info.Size()
+	over := c.size > c.maxBytes
+	c.mu.Unlock()
+	if over {
+		c.evict(cached)
+	}
+	return nil
+}
+
+// evict removes the least recently used thumbnails until the cache is
+// below 90% of its limit, keeping the one about to be served.
+func (c *thumbCache) evict(keep string) {
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+	var total int64
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, cachedFile{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error scanning thumbnail cache: %v", err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	target := c.maxBytes / 10 * 9
+	for _, file := range files {
+		if total <= target {
+			break
+		}
+		if file.path == keep {
+			continue
+		}
+		if err := os.Remove(file.path); err == nil {
+			total -= file.size
+		}
+	}
+	c.mu.Lock()
+	c.size = total
+	c.mu.Unlock()
+}
+
+// parseThumbRequest reads w, h, fit, format and q from the query.
+func parseThumbRequest(r *http.Request) (thumbRequest, error) {
+	query := r.URL.Query()
+	req := thumbRequest{Fit: query.Get("fit"), Format: query.Get("format"), Quality: defaultThumbQuality}
+	for name, dest := range map[string]*int{"w": &req.Width, "h": &req.Height, "q": &req.Quality} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return req, fmt.Errorf("invalid %s", name)
+			}
+			*dest = n
+		}
+	}
+	if req.Width > maxThumbSize || req.Height > maxThumbSize {
+		return req, fmt.Errorf("w and h must not exceed %d", maxThumbSize)
+	}
+	if req.Width == 0 && req.Height == 0 {
+		req.Width, req.Height = defaultThumbSize, defaultThumbSize
+	}
+	req.Quality = min(req.Quality, 100)
+	switch req.Fit {
+	case "":
+		req.Fit = "contain"
+	case "contain", "cover", "fill":
+	default:
+		return req, errors.New("fit must be contain, cover or fill")
+	}
+	switch req.Format {
+	case "jpg":
+		req.Format = "jpeg"
+	case "", "jpeg", "png":
+	default:
+		return req, errors.New("format must be jpeg or png")
+	}
+	return req, nil
+}
+
+// thumbGeometry works out the output size and the centred source area to
+// scale from, in the orientation the image is displayed in.
+func thumbGeometry(srcW, srcH int, req thumbRequest) (dstW, dstH, cropW, cropH int) {
+	w, h := float64(srcW), float64(srcH)
+	tw, th := float64(req.Width), float64(req.Height)
+	fit := req.Fit
+	if tw == 0 || th == 0 {
+		fit = "contain"
+	}
+	switch fit {
+	case "fill":
+		return req.Width, req.Height, srcW, srcH
+	case "cover":
+		scale := math.Min(math.Max(tw/w, th/h), 1)
+		dstW, dstH = int(math.Min(tw, w*scale)), int(math.Min(th, h*scale))
+		cropW = min(int(math.Round(float64(dstW)/scale)), srcW)
+		cropH = min(int(math.Round(float64(dstH)/scale)), srcH)
+		return max(dstW, 1), max(dstH, 1), cropW, cropH
+	}
+	scale := 1.0
+	if tw > 0 {
+		scale = math.Min(scale, tw/w)
+	}
+	if th > 0 {
+		scale = math.Min(scale, th/h)
+	}
+	return max(int(math.Round(w*scale)), 1), max(int(math.Round(h*scale)), 1), srcW, srcH
+}
+
+// renderThumb decodes the image at fullPath, applies its EXIF orientation,
+// resizes it for req and returns the result with the chosen output format.
+func renderThumb(fullPath string, req thumbRequest) (image.Image, string, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > maxThumbSourcePixels {
+		return nil, "", fmt.Errorf("image is %dx%d, larger than %d pixels", config.Width, config.Height, maxThumbSourcePixels)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	orientation := 1
+	if info, err := readEXIF(fullPath); err == nil {
+		orientation = info.Orientation
+	}
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	swap := orientation >= 5
+	if swap {
+		srcW, srcH = srcH, srcW
+	}
+	dstW, dstH, cropW, cropH := thumbGeometry(srcW, srcH, req)
+	if swap {
+		dstW, dstH, cropW, cropH = dstH, dstW, cropH, cropW
+	}
+	bounds := src.Bounds()
+	crop := image.Rect(0, 0, cropW, cropH).Add(bounds.Min).Add(image.Pt((bounds.Dx()-cropW)/2, (bounds.Dy()-cropH)/2))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	result := orientImage(dst, orientation)
+
+	format := req.Format
+	if format == "" {
+		format = "png"
+		if result.Opaque() {
+			format = "jpeg"
+		}
+	}
+	return result, format, nil
+}
+
+// orientImage turns img upright according to an EXIF orientation value.
+func orientImage(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := sw, sh
+	if orientation >= 5 {
+		dw, dh = sh, sw
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = sw-1-x, y
+			case 3: // rotated 180°
+				sx, sy = sw-1-x, sh-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, sh-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated 90° clockwise
+				sx, sy = y, sh-1-x
+			case 7: // transversed
+				sx, sy = sw-1-y, sh-1-x
+			case 8: // rotated 90° counter-clockwise
+				sx, sy = sw-1-y, x
+			}
+			si := img.PixOffset(sx, sy)
+			di := out.PixOffset(x, y)
+			copy(out.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+	return out
+}
+
+// handleThumb serves a resized copy of an image:
+//
+//	/api/thumb?path=photos/a.jpg&w=320&h=240&fit=cover&format=jpeg&q=80
+//
+// Results are cached on disk until the source changes.
+func handleThumb(s *Server, w http.ResponseWriter, r *http.Request) {
+	relPath := r.URL.Query().Get("path")
+	fullPath := resolveInRoot(s.rootDir, relPath)
+	if !isThumbnailable(fullPath) {
+		http.Error(w, "Unsupported image type", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	req, err := parseThumbRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s|%d|%d|%+v", fullPath, info.ModTime().UnixNano(), info.Size(), req))
+	key := hex.EncodeToString(sum[:16])
+	cached, err := s.thumbs.get(key, func(tmp string) error {
+		img, format, err := renderThumb(fullPath, req)
+		if err != nil {
+			return err
+		}
+		out, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		if format == "png" {
+			err = (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(out, img)
+		} else {
+			err = jpeg.Encode(out, img, &jpeg.Options{Quality: req.Quality})
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Error creating thumbnail for '%s': %v", fullPath, err)
+		http.Error(w, "Error creating thumbnail", http.StatusUnprocessableEntity)
+		return
+	}
+
+	file, err := os.Open(cached)
+	if err != nil {
+		log.Printf("Error opening cached thumbnail '%s': %v", cached, err)
+		http.Error(w, "Error reading thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	// Thumbnail URLs carrying the source version (v=) never change.
+	if r.URL.Query().Get("v") != "" {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", `"`+key+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessTokenTTL is how long a scoped access token stays valid. Tokens are
+// signed with a key generated at startup, so a restart revokes them all.
+const accessTokenTTL = 7 * 24 * time.Hour
+
+// accessTokenParam is the query parameter carrying a scoped access token.
+const accessTokenParam = "token"
+
+// feedKeyIterations is the PBKDF2 work of deriving the feed token key.
+const feedKeyIterations = 200000
+
+func newTokenKey() ([]byte, error) {
+	key := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newFeedKey derives the key of feed tokens from the password, so that
+// podcast apps stay subscribed across restarts until the password changes.
+// The slow derivation keeps a leaked token from being an easy way to guess
+// the password.
+func newFeedKey(password, rootDir string) ([]byte, error) {
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	return pbkdf2.Key(sha256.New, password, []byte("serve feed token:"+absRoot), feedKeyIterations, sha256.Size)
+}
+
+func signToken(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks a token made by signToken and returns its payload.
+func verifyToken(key []byte, token string) (string, bool) {
+	encodedPayload, encodedMAC, found := strings.Cut(token, ".")
+	if !found || key == nil {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", false
+	}
+	return string(payload), true
+}
+
+// accessToken signs read access to the files under scope, a directory
+// relative to rootDir, for external clients without the session cookie.
+func (s *Server) accessToken(scope string) string {
+	scope = strings.Trim(path.Clean("/"+scope), "/")
+	return signToken(s.tokenKey, strconv.FormatInt(time.Now().Add(accessTokenTTL).Unix(), 10)+":"+scope)
+}
+
+// feedToken signs read access to the podcast feed of scope and the files
+// under it. Unlike access tokens it doesn't expire, as podcast apps keep
+// the feed URL for good; changing the password revokes it.
+func (s *Server) feedToken(scope string) string {
+	scope = strings.Trim(path.Clean("/"+scope), "/")
+	return signToken(s.feedKey, "feed:"+scope)
+}
+
+// tokenKinds selects the tokens a route accepts.
+type tokenKinds int
+
+const (
+	accessTokens tokenKinds = 1 << iota // Made by accessToken, expiring
+	feedTokens                          // Made by feedToken
+)
+
+// accessTokenScope checks a token made by accessToken and returns its scope.
+func (s *Server) accessTokenScope(token string) (string, bool) {
+	payload, ok := verifyToken(s.tokenKey, token)
+	if !ok {
+		return "", false
+	}
+	expiry, scope, _ := strings.Cut(payload, ":")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return "", false
+	}
+	return scope, true
+}
+
+// feedTokenScope checks a token made by feedToken and returns its scope.
+func (s *Server) feedTokenScope(token string) (string, bool) {
+	payload, ok := verifyToken(s.feedKey, token)
+	if !ok {
+		return "", false
+	}
+	return strings.CutPrefix(payload, "feed:")
+}
+
+// tokenMiddleware lets GET requests carrying a token of kinds for the
+// requested path through without a session, and otherwise falls back to
+// authMiddleware. prefix is the route the handler is mounted on, such as
+// "/files"; the rest of the URL path is the file relative to rootDir.
+func tokenMiddleware(s *Server, prefix string, kinds tokenKinds, next http.HandlerFunc) http.HandlerFunc {
+	authenticated := authMiddleware(s, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.authEnabled && (r.Method == http.MethodGet || r.Method == http.MethodHead) && s.tokenAllows(prefix, kinds, r.URL) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	}
+}
+
+// tokenAllows reports whether the URL carries a token of kinds whose scope
+// contains the file it asks for.
+func (s *Server) tokenAllows(prefix string, kinds tokenKinds, u *url.URL) bool {
+	token := u.Query().Get(accessTokenParam)
+	if token == "" {
+		return false
+	}
+	scope, ok := "", false
+	if kinds&feedTokens != 0 {
+		scope, ok = s.feedTokenScope(token)
+	}
+	if !ok && kinds&accessTokens != 0 {
+		scope, ok = s.accessTokenScope(token)
+	}
+	if !ok {
+		return false
+	}
+	rest, found := strings.CutPrefix(u.Path, prefix+"/")
+	if !found {
+		return false
+	}
+	rel := strings.Trim(path.Clean("/"+rest), "/")
+	return scope == "" || rel == scope || strings.HasPrefix(rel, scope+"/")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxReadmeSize is the largest README rendered into a directory listing.
+const maxReadmeSize = 1 << 20
+
+// readmeNames are the files shown below a directory listing, in order of
+// preference.
+var readmeNames = []string{"README.md", "readme.md", "Readme.md", "README.markdown"}
+
+// viewPage is the data of view.html, the page shown for ?view=1.
+type viewPage struct {
+	Title     string
+	Name      string
+	RawURL    string
+	BrowseURL string
+	TailURL   string       // Live tail page, for text files
+	Info      string       // Short description such as language and encoding
+	Class     string       // "markdown-body" or "source-view"
+	Style     template.CSS // Extra page styles, e.g. for syntax highlighting
+	Content   template.HTML
+	Pager     string // "Lines 1-2000 of 5120" for paged views
+	PrevURL   string
+	NextURL   string
+	PageLines int    // Lines per page of a paged view, 0 when not paged
+	DataURL   string // API the page script loads its content from
+	Script    string // Static asset run on the page
+}
+
+// serveFileView renders fullPath for the browser when it is opened with
+// ?view=1. It reports false for files that have no rendered view, such as
+// binary files, which are then served as usual.
+func (s *Server) serveFileView(w http.ResponseWriter, r *http.Request, fullPath string) bool {
+	if !isRegularFile(fullPath) {
+		return false
+	}
+	rel, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil {
+		return false
+	}
+	relPath := filepath.ToSlash(rel)
+	page := viewPage{
+		Title:     path.Base(relPath),
+		Name:      path.Base(relPath),
+		RawURL:    (&url.URL{Path: s.basePath + "/files/" + relPath}).EscapedPath(),
+		BrowseURL: (&url.URL{Path: s.basePath + "/browse/" + strings.TrimPrefix(path.Dir("/"+relPath), "/")}).EscapedPath(),
+	}
+	if format := tableFormat(fullPath); format != "" {
+		page.Class = "table-view"
+		page.Info = strings.ToUpper(format)
+		page.DataURL = s.basePath + "/api/table?" + url.Values{"path": {relPath}}.Encode()
+		page.Script = "table.js"
+		s.writeViewPage(w, page)
+		return true
+	}
+	if !isMarkdownFile(fullPath) {
+		return s.serveSourceView(w, r, fullPath, page)
+	}
+
+	source, err := os.ReadFile(fullPath)
+	if err != nil {
+		log.Printf("Error reading markdown file '%s': %v", fullPath, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return true
+	}
+	meta, body := splitFrontMatter(source)
+	content, err := renderMarkdownAt(body, s.markdownBaseURL(relPath))
+	if err != nil {
+		log.Printf("Error rendering markdown file '%s': %v", fullPath, err)
+		http.Error(w, "Error rendering file", http.StatusInternalServerError)
+		return true
+	}
+
+	page.Class = "markdown-body"
+	page.Content = content
+	if title, ok := meta["title"].(string); ok && title != "" {
+		page.Title = title
+	}
+	s.writeViewPage(w, page)
+	return true
+}
+
+func (s *Server) writeViewPage(w http.ResponseWriter, page viewPage) {
+	var buf bytes.Buffer
+	if err := s.viewTemplate.Execute(&buf, page); err != nil {
+		log.Printf("Error executing view template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Error writing view of %s: %v", page.Name, err)
+	}
+}
+
+// renderReadme renders the README of the directory relPath for the listing,
+// or returns "" when there is none.
+func (s *Server) renderReadme(relPath string) template.HTML {
+	for _, name := range readmeNames {
+		fullPath := resolveInRoot(s.rootDir, path.Join(relPath, name))
+		info, err := os.Stat(fullPath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if info.Size() > maxReadmeSize {
+			log.Printf("Skipping README '%s': larger than %d bytes", fullPath, maxReadmeSize)
+			return ""
+		}
+		source, err := os.ReadFile(fullPath)
+		if err != nil {
+			log.Printf("Error reading README '%s': %v", fullPath, err)
+			return ""
+		}
+		_, body := splitFrontMatter(source)
+		content, err := renderMarkdownAt(body, s.markdownBaseURL(path.Join(relPath, name)))
+		if err != nil {
+			log.Printf("Error rendering README '%s': %v", fullPath, err)
+			return ""
+		}
+		return content
+	}
+	return ""
+}